@@ -0,0 +1,369 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI exposes the state of named circuit breakers
+// through Caddy's admin endpoint.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.circuit_breakers",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the admin routes for circuit breakers.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: adminPrefix,
+			Handler: caddy.AdminHandlerFunc(a.handleBreakers),
+		},
+		{
+			Pattern: maintenancePrefix,
+			Handler: caddy.AdminHandlerFunc(a.handleMaintenance),
+		},
+	}
+}
+
+// breakerStatus is the admin API representation of a breaker.
+// The config, window, and history are only included in full
+// status reports, which are meant for support bundles.
+type breakerStatus struct {
+	Name          string              `json:"name"`
+	State         State               `json:"state"`
+	Since         time.Time           `json:"since"`
+	TimeInState   string              `json:"time_in_state"`
+	FactorValue   float64             `json:"factor_value"`
+	AdmissionRate float64             `json:"admission_rate"`
+	HealthScore   int                 `json:"health_score"`
+	MemoryBytes   int64               `json:"memory_bytes"`
+	Suppressed    bool                `json:"suppressed,omitempty"`
+	Overhead      *overheadReport     `json:"overhead,omitempty"`
+	Draining      bool                `json:"draining,omitempty"`
+	InFlight      int64               `json:"in_flight"`
+	Hung          int                 `json:"hung,omitempty"`
+	Limited       int64               `json:"limited_transitions,omitempty"`
+	WarmingUp     bool                `json:"warming_up,omitempty"`
+	Throttled     bool                `json:"evaluation_throttled,omitempty"`
+	ErrorBudgets  []errorBudgetStatus `json:"error_budgets,omitempty"`
+	Stale         *staleStatus        `json:"stale,omitempty"`
+	Factors       *FactorValues       `json:"factors,omitempty"`
+	Config        *Config             `json:"config,omitempty"`
+	Window        *windowStats        `json:"window,omitempty"`
+	History       []Transition        `json:"history,omitempty"`
+	Upstreams     []breakerStatus     `json:"upstreams,omitempty"`
+}
+
+// handleBreakers serves requests for:
+//
+//	GET  /circuit-breakers/                list all named breakers
+//	GET  /circuit-breakers/?summary=true   count them by state; add
+//	                                       &format=prometheus for
+//	                                       gauges to scrape
+//	GET  /circuit-breakers/<name>          status of one breaker
+//	GET  /circuit-breakers/<name>/history  recent state transitions
+//	GET  /circuit-breakers/<name>/series   per-second time series
+//	GET  /circuit-breakers/<name>/trace    recent factor evaluations
+//	GET  /circuit-breakers/<name>/rejected sampled rejected requests
+//	GET  /circuit-breakers/<name>/quarantine
+//	                                       addresses of upstreams with
+//	                                       an open circuit; add
+//	                                       ?format=text or nginx for
+//	                                       plain text instead of JSON
+//	GET  /circuit-breakers/<name>/candidates
+//	                                       candidate configs evaluated
+//	                                       alongside the breaker
+//	PUT  /circuit-breakers/<name>/candidates/<id>
+//	                                       start evaluating the config
+//	                                       in the body as a candidate
+//	DELETE /circuit-breakers/<name>/candidates/<id>
+//	                                       stop evaluating a candidate
+//	POST /circuit-breakers/<name>/reset    close the circuit now; add
+//	                                       ?clear_metrics=true to also
+//	                                       clear the sliding window
+//	POST /circuit-breakers/<name>/drain    reject new requests until
+//	                                       undrained; in_flight in the
+//	                                       status counts down to 0
+//	POST /circuit-breakers/<name>/undrain  end drain mode
+//
+// Requests that change a breaker (PUT, DELETE and POST) are written
+// to the audit log and need the app's admin token, if one is set, as
+// a bearer token. They may name who makes them in the
+// Circuit-Breaker-Actor header and why in a ?reason= parameter.
+//
+// Add ?full=true to either status endpoint to include each breaker's
+// config, window contents, and history, capturing everything about
+// all breakers in a single call.
+func (a adminAPI) handleBreakers(w http.ResponseWriter, r *http.Request) error {
+	full, _ := strconv.ParseBool(r.URL.Query().Get("full"))
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, adminPrefix), "/"), "/")
+	if parts[0] == "" {
+		if err := requireMethod(r, http.MethodGet); err != nil {
+			return err
+		}
+		if summary, _ := strconv.ParseBool(r.URL.Query().Get("summary")); summary {
+			return writeSummary(w, r.URL.Query().Get("format"), Summarize())
+		}
+		statuses := make([]breakerStatus, 0)
+		for _, name := range breakerNames() {
+			if c, ok := lookupBreaker(name); ok {
+				statuses = append(statuses, c.status(full))
+			}
+		}
+		return writeJSON(w, statuses)
+	}
+
+	c, ok := lookupBreaker(parts[0])
+	if !ok {
+		return caddy.APIError{
+			Code: http.StatusNotFound,
+			Err:  fmt.Errorf("unknown circuit breaker: %s", parts[0]),
+		}
+	}
+
+	switch {
+	case len(parts) == 1:
+		if err := requireMethod(r, http.MethodGet); err != nil {
+			return err
+		}
+		return writeJSON(w, c.status(full))
+
+	case len(parts) == 2 && parts[1] == "history":
+		if err := requireMethod(r, http.MethodGet); err != nil {
+			return err
+		}
+		return writeJSON(w, c.History())
+
+	case len(parts) == 2 && parts[1] == "series":
+		if err := requireMethod(r, http.MethodGet); err != nil {
+			return err
+		}
+		points := c.Series()
+		if points == nil {
+			return caddy.APIError{
+				Code: http.StatusNotFound,
+				Err:  fmt.Errorf("%w: time series not enabled for circuit breaker: %s", ErrMetricsUnavailable, c.Name),
+			}
+		}
+		return writeJSON(w, points)
+
+	case len(parts) == 2 && parts[1] == "trace":
+		if err := requireMethod(r, http.MethodGet); err != nil {
+			return err
+		}
+		evaluations := c.Evaluations()
+		if evaluations == nil {
+			return caddy.APIError{
+				Code: http.StatusNotFound,
+				Err:  fmt.Errorf("trace not enabled for circuit breaker: %s", c.Name),
+			}
+		}
+		return writeJSON(w, evaluations)
+
+	case len(parts) == 2 && parts[1] == "rejected":
+		if err := requireMethod(r, http.MethodGet); err != nil {
+			return err
+		}
+		rejected := c.Rejected()
+		if rejected == nil {
+			return caddy.APIError{
+				Code: http.StatusNotFound,
+				Err:  fmt.Errorf("rejected_samples not enabled for circuit breaker: %s", c.Name),
+			}
+		}
+		return writeJSON(w, rejected)
+
+	case len(parts) == 2 && parts[1] == "quarantine":
+		if err := requireMethod(r, http.MethodGet); err != nil {
+			return err
+		}
+		addrs := c.Quarantined()
+		if addrs == nil {
+			return caddy.APIError{
+				Code: http.StatusNotFound,
+				Err:  fmt.Errorf("per_upstream not enabled for circuit breaker: %s", c.Name),
+			}
+		}
+		return writeQuarantine(w, r.URL.Query().Get("format"), addrs)
+
+	case len(parts) == 2 && parts[1] == "candidates":
+		if err := requireMethod(r, http.MethodGet); err != nil {
+			return err
+		}
+		return writeJSON(w, c.candidateStatuses())
+
+	case len(parts) == 3 && parts[1] == "candidates":
+		return handleCandidate(w, r, c, parts[2])
+
+	case len(parts) == 2 && parts[1] == "drain":
+		if err := requireMethod(r, http.MethodPost); err != nil {
+			return err
+		}
+		if _, err := authorizeAction(r, c.Name, "drain"); err != nil {
+			return err
+		}
+		c.Drain()
+		return writeJSON(w, c.status(false))
+
+	case len(parts) == 2 && parts[1] == "undrain":
+		if err := requireMethod(r, http.MethodPost); err != nil {
+			return err
+		}
+		if _, err := authorizeAction(r, c.Name, "undrain"); err != nil {
+			return err
+		}
+		c.Undrain()
+		return writeJSON(w, c.status(false))
+
+	case len(parts) == 2 && parts[1] == "reset":
+		if err := requireMethod(r, http.MethodPost); err != nil {
+			return err
+		}
+		actor, err := authorizeAction(r, c.Name, "reset")
+		if err != nil {
+			return err
+		}
+		clearMetrics, _ := strconv.ParseBool(r.URL.Query().Get("clear_metrics"))
+		c.reset(clearMetrics, ReasonReset, actionReason(r, "reset", actor))
+		return writeJSON(w, c.status(false))
+	}
+
+	return caddy.APIError{
+		Code: http.StatusNotFound,
+		Err:  fmt.Errorf("not found: %s", r.URL.Path),
+	}
+}
+
+// handleCandidate adds or removes the candidate config id of c.
+func handleCandidate(w http.ResponseWriter, r *http.Request, c *Simple, id string) error {
+	switch r.Method {
+	case http.MethodPut:
+		if _, err := authorizeAction(r, c.Name, "add candidate "+id); err != nil {
+			return err
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxCandidateConfigSize))
+		if err != nil {
+			return err
+		}
+		cfg, err := DecodeConfig(body, true)
+		if err != nil {
+			return caddy.APIError{
+				Code: http.StatusBadRequest,
+				Err:  err,
+			}
+		}
+		if err := c.AddCandidate(id, cfg); err != nil {
+			return caddy.APIError{
+				Code: http.StatusBadRequest,
+				Err:  fmt.Errorf("adding candidate %s: %v", id, err),
+			}
+		}
+		return writeJSON(w, c.candidateStatuses())
+
+	case http.MethodDelete:
+		if _, err := authorizeAction(r, c.Name, "remove candidate "+id); err != nil {
+			return err
+		}
+		if !c.RemoveCandidate(id) {
+			return caddy.APIError{
+				Code: http.StatusNotFound,
+				Err:  fmt.Errorf("unknown candidate: %s", id),
+			}
+		}
+		return writeJSON(w, c.candidateStatuses())
+	}
+	return caddy.APIError{
+		Code: http.StatusMethodNotAllowed,
+		Err:  fmt.Errorf("method not allowed"),
+	}
+}
+
+// writeQuarantine writes a list of quarantined upstream addresses:
+// as a JSON array by default; with format text, one address per
+// line, as read by HAProxy for ACL and map files; or with format
+// nginx, as server lines marked down, to include in an upstream block.
+func writeQuarantine(w http.ResponseWriter, format string, addrs []string) error {
+	var line string
+	switch format {
+	case "", "json":
+		return writeJSON(w, addrs)
+	case "text":
+		line = "%s\n"
+	case "nginx":
+		line = "server %s down;\n"
+	default:
+		return caddy.APIError{
+			Code: http.StatusBadRequest,
+			Err:  fmt.Errorf("unknown format: %s", format),
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, addr := range addrs {
+		fmt.Fprintf(w, line, addr)
+	}
+	return nil
+}
+
+func requireMethod(r *http.Request, method string) error {
+	if r.Method != method {
+		return caddy.APIError{
+			Code: http.StatusMethodNotAllowed,
+			Err:  fmt.Errorf("method not allowed"),
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		return caddy.APIError{
+			Code: http.StatusInternalServerError,
+			Err:  fmt.Errorf("encoding response: %v", err),
+		}
+	}
+	return nil
+}
+
+const (
+	adminPrefix            = "/circuit-breakers/"
+	maxCandidateConfigSize = 1 << 20
+)
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
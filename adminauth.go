@@ -0,0 +1,89 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// adminActions guards the admin endpoints that change the state of
+// a breaker, such as reset and drain. They are authorized by the admin
+// token of the running app, if it has one, and every one of them is
+// written to the audit log, whether authorized or not.
+var adminActions = struct {
+	sync.Mutex
+	app *App
+}{}
+
+// authorizeAction checks that r may perform action on the breaker
+// named name, and writes the attempt to the audit log. It returns a
+// description of who performed it, for the breaker's history.
+func authorizeAction(r *http.Request, name, action string) (string, error) {
+	adminActions.Lock()
+	app := adminActions.app
+	adminActions.Unlock()
+
+	logger := caddy.Log().Named("circuit_breaker.audit")
+	var token string
+	if app != nil {
+		logger = app.logger.Named("audit")
+		token = app.adminToken
+	}
+
+	actor := r.Header.Get(actorHeader)
+	if actor == "" {
+		actor = "unknown"
+	}
+	fields := []zap.Field{
+		zap.String("name", name),
+		zap.String("action", action),
+		zap.String("actor", actor),
+		zap.String("reason", r.URL.Query().Get("reason")),
+		zap.String("remote_addr", r.RemoteAddr),
+	}
+
+	if token != "" {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			logger.Warn("unauthorized admin action", fields...)
+			return "", caddy.APIError{
+				Code: http.StatusUnauthorized,
+				Err:  fmt.Errorf("%s requires a valid admin token", action),
+			}
+		}
+	}
+	logger.Info("admin action", append(fields, zap.Bool("authenticated", token != ""))...)
+	return actor, nil
+}
+
+// actionReason returns the reason to record in the history of a
+// breaker for action, performed by actor through r.
+func actionReason(r *http.Request, action, actor string) string {
+	reason := fmt.Sprintf("%s through admin API by %s", action, actor)
+	if why := r.URL.Query().Get("reason"); why != "" {
+		reason += ": " + why
+	}
+	return reason
+}
+
+// actorHeader names who performs an admin action, for the audit log.
+const actorHeader = "Circuit-Breaker-Actor"
@@ -0,0 +1,224 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// Annotations posts the state transitions of named breakers to an
+// annotations endpoint, so that trips show up on the dashboards that
+// already graph the upstream's latency and errors. With the grafana
+// format, each transition becomes an annotation through Grafana's
+// HTTP API; with the events format, the state event is posted as is,
+// as the state socket would write it, for other collectors.
+type Annotations struct {
+	// The URL to post to, such as
+	// https://grafana.example.com/api/annotations. Required.
+	URL string `json:"url,omitempty"`
+	// The body to post: "grafana", the default, or "events".
+	Format string `json:"format,omitempty"`
+	// An optional bearer token, such as a Grafana service account
+	// token. Placeholders such as {env.GRAFANA_TOKEN} are replaced.
+	Token string `json:"token,omitempty"`
+	// With the grafana format, the UID of a dashboard to limit the
+	// annotations to; by default, they are organization-wide.
+	DashboardUID string `json:"dashboard_uid,omitempty"`
+	// With the grafana format, tags to add to every annotation, in
+	// addition to circuit_breaker, the breaker's name, and its new
+	// state.
+	Tags []string `json:"tags,omitempty"`
+	// How long to wait for the endpoint to answer. The default is 5s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	token  string
+	client *http.Client
+	logger *zap.Logger
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// grafanaAnnotation is the body of a request to create an annotation
+// through Grafana's HTTP API.
+type grafanaAnnotation struct {
+	DashboardUID string   `json:"dashboardUID,omitempty"`
+	Time         int64    `json:"time"` // milliseconds since the epoch
+	Tags         []string `json:"tags"`
+	Text         string   `json:"text"`
+}
+
+func (a *Annotations) provision(logger *zap.Logger) error {
+	u, err := url.Parse(a.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("url must be an http or https URL: %s", a.URL)
+	}
+	switch a.Format {
+	case "":
+		a.Format = annotationsGrafana
+	case annotationsGrafana, annotationsEvents:
+	default:
+		return fmt.Errorf("unknown format %q; must be grafana or events", a.Format)
+	}
+	if a.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if a.Timeout == 0 {
+		a.Timeout = caddy.Duration(defaultAnnotationsTimeout)
+	}
+	a.token = caddy.NewReplacer().ReplaceAll(a.Token, "")
+	a.client = &http.Client{Timeout: time.Duration(a.Timeout)}
+	a.logger = logger.Named("annotations")
+	return nil
+}
+
+// start posts every transition until stop is called.
+func (a *Annotations) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	events := subscribeStates()
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		for a.forward(ctx, events) {
+			a.logger.Warn("annotation endpoint could not keep up; transitions were not posted",
+				zap.String("url", a.URL))
+			events = subscribeStates()
+		}
+		unsubscribeStates(events)
+	}()
+}
+
+// forward posts the events until ctx is done, in which case it
+// returns false, or until events is closed because posting could
+// not keep up, in which case it returns true.
+func (a *Annotations) forward(ctx context.Context, events chan StateEvent) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case ev, ok := <-events:
+			if !ok {
+				return true
+			}
+			if err := a.post(ctx, ev); err != nil && ctx.Err() == nil {
+				a.logger.Warn("posting annotation",
+					zap.String("url", a.URL),
+					zap.String("name", ev.Breaker),
+					zap.Error(err))
+			}
+		}
+	}
+}
+
+func (a *Annotations) stop() {
+	if a.cancel == nil {
+		return
+	}
+	a.cancel()
+	a.wg.Wait()
+	a.cancel = nil
+}
+
+// post sends ev to the endpoint.
+func (a *Annotations) post(ctx context.Context, ev StateEvent) error {
+	var body interface{} = ev
+	if a.Format == annotationsGrafana {
+		body = a.grafanaAnnotation(ev)
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, a.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// grafanaAnnotation describes ev as a Grafana annotation.
+func (a *Annotations) grafanaAnnotation(ev StateEvent) grafanaAnnotation {
+	subject, name := "circuit breaker "+ev.Breaker, ev.Breaker
+	switch {
+	case ev.Domain != "":
+		subject, name = "failure domain "+ev.Domain, ev.Domain
+	case ev.Correlated:
+		subject, name = "correlated failure", "correlated_failure"
+	}
+	text := fmt.Sprintf("%s: %s", subject, ev.To)
+	if ev.From != 0 {
+		text = fmt.Sprintf("%s: %s → %s", subject, ev.From, ev.To)
+	}
+	if ev.Reason != "" {
+		text += " (" + ev.Reason + ")"
+	}
+	if ev.Transitions > 1 {
+		text += fmt.Sprintf(", summarizing %d transitions", ev.Transitions)
+	}
+	if ev.Maintenance != "" {
+		text += ", during maintenance window " + ev.Maintenance
+	}
+	if ev.RunbookURL != "" {
+		text += ", runbook: " + ev.RunbookURL
+	}
+	tags := append([]string{"circuit_breaker", name, ev.To.String()}, a.Tags...)
+	if ev.Domain != "" {
+		tags = append(tags, "failure_domain")
+	}
+	if ev.Maintenance != "" {
+		tags = append(tags, "maintenance")
+	}
+	return grafanaAnnotation{
+		DashboardUID: a.DashboardUID,
+		Time:         ev.Time.UnixNano() / int64(time.Millisecond),
+		Tags:         tags,
+		Text:         text,
+	}
+}
+
+// Possible values of Annotations.Format.
+const (
+	annotationsGrafana = "grafana"
+	annotationsEvents  = "events"
+)
+
+const defaultAnnotationsTimeout = 5 * time.Second
@@ -0,0 +1,173 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(App{})
+}
+
+// App holds process-wide settings shared by all circuit breakers.
+// It does not need to be configured; breakers work without it. It
+// is configured in JSON only, as it has no Caddyfile global options.
+type App struct {
+	// Default settings inherited by every circuit breaker. Any
+	// field set on an individual breaker overrides its default.
+	Defaults *Config `json:"defaults,omitempty"`
+
+	// An optional guard that suppresses enforcement by all breakers
+	// when many of them trip at about the same time.
+	CorrelationGuard *CorrelationGuard `json:"correlation_guard,omitempty"`
+
+	// An optional path of a unix socket on which every state
+	// transition of a named breaker is streamed as a line of JSON,
+	// preceded by the current state of each breaker on connect. This
+	// lets local sidecars and agents follow breaker state without
+	// access to the admin API.
+	StateSocket string `json:"state_socket,omitempty"`
+
+	// An optional token that admin API requests which change the state
+	// of a breaker, such as reset and drain, must present as a bearer
+	// token in the Authorization header. Placeholders such as
+	// {env.CIRCUIT_BREAKER_TOKEN} are replaced, so that the token need
+	// not be in the config. Whether or not a token is set, every such
+	// request is written to the audit log.
+	AdminToken string `json:"admin_token,omitempty"`
+
+	// An optional endpoint, such as Grafana's annotations API, to
+	// which every state transition of a named breaker is posted.
+	Annotations *Annotations `json:"annotations,omitempty"`
+
+	stateServer *stateServer
+	adminToken  string
+	logger      *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "circuit_breaker",
+		New: func() caddy.Module { return new(App) },
+	}
+}
+
+// Provision sets up the app.
+func (a *App) Provision(ctx caddy.Context) error {
+	a.logger = ctx.Logger(a)
+	a.adminToken = caddy.NewReplacer().ReplaceAll(a.AdminToken, "")
+	if a.CorrelationGuard != nil {
+		if err := a.CorrelationGuard.provision(a.logger); err != nil {
+			return fmt.Errorf("correlation_guard: %v", err)
+		}
+	}
+	if a.Annotations != nil {
+		if err := a.Annotations.provision(a.logger); err != nil {
+			return fmt.Errorf("annotations: %v", err)
+		}
+	}
+	return nil
+}
+
+// Start starts the state socket and annotations, if configured,
+// and authorizes admin actions by the admin token of this app.
+func (a *App) Start() error {
+	adminActions.Lock()
+	adminActions.app = a
+	adminActions.Unlock()
+	if a.Annotations != nil {
+		a.Annotations.start()
+	}
+	if a.StateSocket == "" {
+		return nil
+	}
+	s, err := startStateServer(a.StateSocket, a.CorrelationGuard, a.logger)
+	if err != nil {
+		return fmt.Errorf("starting state socket: %v", err)
+	}
+	a.stateServer = s
+	return nil
+}
+
+// Stop stops the state socket and annotations, if running.
+func (a *App) Stop() error {
+	adminActions.Lock()
+	if adminActions.app == a {
+		adminActions.app = nil
+	}
+	adminActions.Unlock()
+	if a.Annotations != nil {
+		a.Annotations.stop()
+	}
+	if a.stateServer == nil {
+		return nil
+	}
+	err := a.stateServer.close()
+	a.stateServer = nil
+	return err
+}
+
+// inheritDefaults fills in every unset field of cfg from the
+// defaults configured on the app, if any, including the fields
+// of a preset named by the defaults. The name is never inherited.
+func (a *App) inheritDefaults(cfg *Config) error {
+	if a == nil || a.Defaults == nil {
+		return nil
+	}
+	if err := cfg.inherit(a.Defaults); err != nil {
+		return err
+	}
+	return cfg.applyPreset()
+}
+
+// inherit sets every field of cfg that is unset (zero) to its value
+// in from, except for the name. It works on the JSON encoding of both
+// so that it covers every field without having to list them. The
+// merge is shallow: a block set in cfg replaces the block of from as
+// a whole, and a bool that is true in from can't be set to false.
+func (cfg *Config) inherit(from *Config) error {
+	var merged, own map[string]json.RawMessage
+	if err := remarshal(from, &merged); err != nil {
+		return err
+	}
+	if err := remarshal(cfg, &own); err != nil {
+		return err
+	}
+	delete(merged, "name")
+	for k, v := range own {
+		merged[k] = v
+	}
+	return remarshal(merged, cfg)
+}
+
+func remarshal(from, to interface{}) error {
+	b, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, to)
+}
+
+// Interface guards
+var (
+	_ caddy.App         = (*App)(nil)
+	_ caddy.Provisioner = (*App)(nil)
+)
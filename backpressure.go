@@ -0,0 +1,81 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+// Backpressure is the signal a breaker gives to other modules in
+// the same process, such as rate limiters, that want to back off an
+// upstream before its circuit opens. It is implemented by *Simple;
+// use LookupBackpressure to find a named breaker.
+type Backpressure interface {
+	// Tier returns the coarse state of the upstream.
+	Tier() BackpressureTier
+	// AdmissionRate returns the suggested share of requests to let
+	// through, from 0.0 to 1.0, such as for scaling a rate limit.
+	AdmissionRate() float64
+}
+
+// BackpressureTier is the coarse state of an upstream as seen by
+// its breaker.
+type BackpressureTier int
+
+const (
+	// TierNormal means the factor is well below its threshold.
+	TierNormal BackpressureTier = iota
+	// TierWarning means the factor passed admission_start times its
+	// threshold, so the admission rate is below 1.0: the upstream is
+	// struggling and load should be reduced to keep the circuit closed.
+	TierWarning
+	// TierOpen means the circuit is open.
+	TierOpen
+)
+
+// String returns the name of the tier.
+func (t BackpressureTier) String() string {
+	switch t {
+	case TierNormal:
+		return "normal"
+	case TierWarning:
+		return "warning"
+	case TierOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+// Tier implements Backpressure.
+func (c *Simple) Tier() BackpressureTier {
+	switch rate := c.AdmissionRate(); {
+	case !c.OK():
+		return TierOpen
+	case rate < 1:
+		return TierWarning
+	}
+	return TierNormal
+}
+
+// LookupBackpressure returns the backpressure signal of the named
+// breaker, for modules that are configured with the name of the
+// breaker guarding their upstream. The breaker is looked up once:
+// after a config reload, look it up again.
+func LookupBackpressure(name string) (Backpressure, bool) {
+	c, ok := lookupBreaker(name)
+	if !ok {
+		return nil, false
+	}
+	return c, true
+}
+
+// Interface guards
+var _ Backpressure = (*Simple)(nil)
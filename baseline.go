@@ -0,0 +1,147 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// baselineMaxSamples is the most latencies that a baseline seeds a
+// window with, however many requests it was measured over.
+const baselineMaxSamples = 1000
+
+// latencyPoint is the latency at a percentile, from 0 to 100.
+type latencyPoint struct {
+	q       float64
+	latency time.Duration
+}
+
+// SeedLatencies seeds the window with the latencies of another
+// window, such as that of another instance, given as a snapshot
+// taken with the given quantiles, so that a new breaker reads
+// sensible latency quantiles from its first requests on. The seeded
+// latencies are not counted as requests and drop out of the window
+// like the latencies recorded now. It must be called before the
+// window sees requests; a breaker with window_of or the log
+// window_mode cannot be seeded.
+func (c *Simple) SeedLatencies(quantiles []float64, snap WindowSnapshot) error {
+	if len(quantiles) != len(snap.Latencies) {
+		return fmt.Errorf("snapshot has %d latencies for %d quantiles", len(snap.Latencies), len(quantiles))
+	}
+	points := make([]latencyPoint, len(quantiles))
+	for i, q := range quantiles {
+		points[i] = latencyPoint{q: q, latency: snap.Latencies[i]}
+	}
+	return c.seedLatencies(points, snap.Requests)
+}
+
+// seedLatencies seeds the window with latencies following points,
+// as many as requests but at most baselineMaxSamples.
+func (c *Simple) seedLatencies(points []latencyPoint, requests int64) error {
+	if c.WindowMode == windowModeLog || c.WindowOf != "" {
+		return fmt.Errorf("seeding latencies requires the buckets window_mode and a window of the breaker's own")
+	}
+	if len(points) == 0 || requests <= 0 {
+		return fmt.Errorf("baseline has no latencies")
+	}
+	for _, p := range points {
+		if p.q < 0 || p.q > 100 {
+			return fmt.Errorf("baseline quantile %v must be between 0 and 100", p.q)
+		}
+		if p.latency < 0 {
+			return fmt.Errorf("baseline latency at p%v must not be negative", p.q)
+		}
+	}
+	n := requests
+	if n > baselineMaxSamples {
+		n = baselineMaxSamples
+	}
+	c.metrics.seedLatencies(baselineSamples(points, int(n)))
+	return nil
+}
+
+// baselineSamples returns n latencies spread over the percentiles
+// so that their quantiles are those of points, interpolating
+// linearly between them. Below the lowest and above the highest
+// point, the latency of that point is used.
+func baselineSamples(points []latencyPoint, n int) []time.Duration {
+	sorted := append([]latencyPoint(nil), points...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].q < sorted[j].q })
+	samples := make([]time.Duration, n)
+	for i := range samples {
+		q := 100 * (float64(i) + 0.5) / float64(n)
+		j := sort.Search(len(sorted), func(j int) bool { return sorted[j].q >= q })
+		switch {
+		case j == 0:
+			samples[i] = sorted[0].latency
+		case j == len(sorted):
+			samples[i] = sorted[j-1].latency
+		default:
+			lo, hi := sorted[j-1], sorted[j]
+			f := (q - lo.q) / (hi.q - lo.q)
+			samples[i] = lo.latency + time.Duration(f*float64(hi.latency-lo.latency))
+		}
+	}
+	return samples
+}
+
+// loadLatencyBaseline reads the latency quantiles of a window from
+// the file at path, which holds either the window of a breaker's
+// status in the admin API, or the whole status, as exported from
+// another instance with GET /circuit-breakers/<name>?full=true.
+func loadLatencyBaseline(path string) ([]latencyPoint, int64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	var doc struct {
+		windowStats
+		Window *windowStats `json:"window"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, 0, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	stats := &doc.windowStats
+	if doc.Window != nil {
+		stats = doc.Window
+	}
+	points := make([]latencyPoint, 0, len(stats.Latency))
+	for key, us := range stats.Latency {
+		q, err := strconv.ParseFloat(strings.TrimPrefix(key, "p"), 64)
+		if err != nil || !strings.HasPrefix(key, "p") {
+			return nil, 0, fmt.Errorf("parsing %s: invalid quantile %q", path, key)
+		}
+		points = append(points, latencyPoint{q: q, latency: time.Duration(us) * time.Microsecond})
+	}
+	return points, stats.Requests, nil
+}
+
+// seedLatencyBaseline seeds the window from the latency_baseline file.
+func (c *Simple) seedLatencyBaseline() error {
+	points, requests, err := loadLatencyBaseline(c.LatencyBaseline)
+	if err != nil {
+		return fmt.Errorf("latency_baseline: %v", err)
+	}
+	if err := c.seedLatencies(points, requests); err != nil {
+		return fmt.Errorf("latency_baseline: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// OKForRequest is like OK, but for a particular request: requests
+// matched by one of the bypass matcher sets, such as probes or
+// requests of critical priority, are let through regardless of the
+// state of the circuit, even while draining. Integrations that see
+// the request, such as the handler, should use it instead of OK.
+func (c *Simple) OKForRequest(r *http.Request) bool {
+	if c.bypassed(r) {
+		return true
+	}
+	return c.OK()
+}
+
+// bypassed returns whether r is matched by one of the bypass matcher sets.
+func (c *Simple) bypassed(r *http.Request) bool {
+	if len(c.bypass) == 0 {
+		return false
+	}
+	// matchers expect a replacer, which only Caddy's server provides
+	if _, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); !ok {
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	}
+	return c.bypass.AnyMatch(r)
+}
+
+// provisionBypass loads the bypass matcher sets.
+func (c *Simple) provisionBypass(ctx caddy.Context) error {
+	if c.BypassRaw == nil {
+		return nil
+	}
+	mods, err := ctx.LoadModule(&c.Config, "BypassRaw")
+	if err != nil {
+		return fmt.Errorf("loading bypass matchers: %v", err)
+	}
+	return c.bypass.FromInterface(mods)
+}
+
+// unmarshalMatcherSet parses a block of request matchers, one per
+// line, into a matcher set which a request must match all of.
+func unmarshalMatcherSet(d *caddyfile.Dispenser) (caddy.ModuleMap, error) {
+	set := make(caddy.ModuleMap)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		name := d.Val()
+		if _, ok := set[name]; ok {
+			return nil, d.Errf("duplicate %s matcher in the same set", name)
+		}
+		modInfo, err := caddy.GetModule("http.matchers." + name)
+		if err != nil {
+			return nil, d.Errf("getting matcher module '%s': %v", name, err)
+		}
+		mod := modInfo.New()
+		unm, ok := mod.(caddyfile.Unmarshaler)
+		if !ok {
+			return nil, d.Errf("matcher module '%s' is not a Caddyfile unmarshaler", name)
+		}
+		if err := unm.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+			return nil, err
+		}
+		if _, ok := mod.(caddyhttp.RequestMatcher); !ok {
+			return nil, d.Errf("matcher module '%s' is not a request matcher", name)
+		}
+		set[name] = caddyconfig.JSON(mod, nil)
+	}
+	if len(set) == 0 {
+		return nil, d.Err("expected at least one matcher")
+	}
+	return set, nil
+}
@@ -0,0 +1,802 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// UnmarshalCaddyfile sets up the circuit breaker from Caddyfile tokens. Syntax:
+//
+//	simple {
+//	    name                       <name>
+//	    preset                     <aggressive|conservative|latency_sensitive>
+//	    factor                     <latency|error_ratio|status_ratio|deadline_miss_ratio|throughput|custom>
+//	    latency {
+//	        quantile   <percentile>
+//	        threshold  <duration>
+//	        hedge      <duration>
+//	        unit       <ns|us|ms|s>
+//	        confidence <ratio>
+//	        trim       <percentage>
+//	        exclude_queueing
+//	        floor      <duration>
+//	        ceiling    <duration>
+//	        clamp      <clip|discard>
+//	        quantiles  <percentile...>
+//	    }
+//	    error_ratio|deadline_miss_ratio {
+//	        threshold    <ratio>
+//	        min_requests <n>
+//	        include      <code...>
+//	        exclude      <502|504...>
+//	    }
+//	    status_ratio {
+//	        threshold    <ratio>
+//	        min_requests <n>
+//	        range        <first> <last>
+//	        of           <first> <last>
+//	    }
+//	    throughput {
+//	        threshold    <fraction>
+//	        metric       <responses|bytes>
+//	        baseline     <duration>
+//	        min_baseline <rate>
+//	    }
+//	    custom <module> [{ <module options...> }]
+//	    trip_duration              <duration>
+//	    dynamic {
+//	        file|placeholder <source>
+//	        interval         <duration>
+//	    }
+//	    status_weight              <code|class> <weight>
+//	    stream_reset_threshold     <ratio>
+//	    stream_reset_trip_duration <duration>
+//	    require_full_window
+//	    cooldown_after_close       <duration>
+//	    cooldown_severity          <multiplier>
+//	    late_samples               window|stale|discard
+//	    hung_request_multiple      <multiple>
+//	    per_upstream
+//	    upstream_ttl               <duration>
+//	    reset_changed_upstreams
+//	    upstream_warmup            <duration>
+//	    time_series                <seconds>
+//	    storage                    <backend> [{ <backend options...> }]
+//	    bypass {
+//	        <matcher> <args...>
+//	    }
+//	    cardinality_budget         <n>
+//	    admission_start            <fraction>
+//	    measure_overhead
+//	    trace                      <n>
+//	    rejected_samples           <n> [<rate>]
+//	    history_size               <n>
+//	    min_state_interval         <duration>
+//	    notify_settle              <duration>
+//	    window_of                  <name>
+//	    window_file                <path>
+//	    latency_baseline           <path>
+//	    max_evaluation_qps         <n>
+//	    evaluation_interval        <duration>
+//	    random_seed                <n>
+//	    labels                     <label...>
+//	    propagate_trip_to          <label...>
+//	    failure_domain             <domain>
+//	    runbook_url                <url>
+//	    trip_reason                <template>
+//	    error_budget               <code|class> <budget> [<period>] [{ min_requests <n> }]
+//	    coalesce_records
+//	    window_mode                <buckets|log>
+//	    log_capacity               <n>
+//	    histogram                  <hdr|fixed>
+//	    export_all_factors
+//	}
+func (c *Simple) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		if err := c.Config.unmarshalCaddyfileBlock(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmarshalCaddyfileBlock parses the subdirectives of a circuit
+// breaker block. It is shared by breakers and the global defaults.
+func (cfg *Config) unmarshalCaddyfileBlock(d *caddyfile.Dispenser) error {
+	for d.NextBlock(0) {
+		if err := cfg.unmarshalCaddyfileOption(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmarshalCaddyfileOption parses the breaker subdirective at
+// the current token, so that modules embedding Config can mix
+// in their own subdirectives.
+func (cfg *Config) unmarshalCaddyfileOption(d *caddyfile.Dispenser) error {
+	switch d.Val() {
+	case "name":
+		if !d.AllArgs(&cfg.Name) {
+			return d.ArgErr()
+		}
+
+	case "preset":
+		if !d.AllArgs(&cfg.Preset) {
+			return d.ArgErr()
+		}
+		if _, ok := presets[cfg.Preset]; !ok {
+			return d.Errf("unknown preset: %s", cfg.Preset)
+		}
+
+	case "factor":
+		if !d.AllArgs(&cfg.Factor) {
+			return d.ArgErr()
+		}
+		if _, ok := typeCB[cfg.Factor]; !ok {
+			return d.Errf("unknown factor: %s", cfg.Factor)
+		}
+
+	case "latency":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		l := new(LatencyFactor)
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "quantile":
+				if err := parseFloatArg(d, &l.Quantile); err != nil {
+					return err
+				}
+			case "threshold":
+				if err := parseDurationArg(d, &l.Threshold); err != nil {
+					return err
+				}
+			case "hedge":
+				if err := parseDurationArg(d, &l.Hedge); err != nil {
+					return err
+				}
+			case "unit":
+				if !d.AllArgs(&l.Unit) {
+					return d.ArgErr()
+				}
+				if _, ok := latencyUnits[l.Unit]; !ok {
+					return d.Errf("unknown latency unit: %s", l.Unit)
+				}
+			case "confidence":
+				if err := parseFloatArg(d, &l.Confidence); err != nil {
+					return err
+				}
+			case "trim":
+				if err := parseFloatArg(d, &l.Trim); err != nil {
+					return err
+				}
+			case "exclude_queueing":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				l.ExcludeQueueing = true
+			case "floor":
+				if err := parseDurationArg(d, &l.Floor); err != nil {
+					return err
+				}
+			case "ceiling":
+				if err := parseDurationArg(d, &l.Ceiling); err != nil {
+					return err
+				}
+			case "clamp":
+				if !d.AllArgs(&l.Clamp) {
+					return d.ArgErr()
+				}
+			case "quantiles":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				for _, arg := range args {
+					q, err := strconv.ParseFloat(arg, 64)
+					if err != nil {
+						return d.Errf("parsing quantiles: %v", err)
+					}
+					l.Quantiles = append(l.Quantiles, q)
+				}
+			default:
+				return d.Errf("unrecognized latency subdirective: %s", d.Val())
+			}
+		}
+		cfg.Latency = l
+
+	case "error_ratio", "deadline_miss_ratio":
+		name := d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		r := new(RatioFactor)
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			if err := r.unmarshalCaddyfileOption(d, name); err != nil {
+				return err
+			}
+		}
+		if name == "error_ratio" {
+			cfg.ErrorRatio = r
+		} else {
+			cfg.DeadlineMissRatio = r
+		}
+
+	case "custom":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		raw, err := unmarshalCustomFactor(d)
+		if err != nil {
+			return err
+		}
+		cfg.CustomFactorRaw = raw
+
+	case "status_ratio":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		sr := new(StatusRatioFactor)
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			option := d.Val()
+			if option != "range" && option != "of" {
+				if err := sr.RatioFactor.unmarshalCaddyfileOption(d, "status_ratio"); err != nil {
+					return err
+				}
+				continue
+			}
+			var first, last string
+			if !d.AllArgs(&first, &last) {
+				return d.ArgErr()
+			}
+			from, err := strconv.Atoi(first)
+			if err != nil {
+				return d.Errf("parsing %s: %v", option, err)
+			}
+			to, err := strconv.Atoi(last)
+			if err != nil {
+				return d.Errf("parsing %s: %v", option, err)
+			}
+			if option == "of" {
+				sr.Of = append(sr.Of, []int{from, to})
+			} else {
+				sr.Range = []int{from, to}
+			}
+		}
+		cfg.StatusRatio = sr
+
+	case "throughput":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		t := new(ThroughputFactor)
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "threshold":
+				if err := parseFloatArg(d, &t.Threshold); err != nil {
+					return err
+				}
+			case "metric":
+				if !d.AllArgs(&t.Metric) {
+					return d.ArgErr()
+				}
+			case "baseline":
+				if err := parseDurationArg(d, &t.Baseline); err != nil {
+					return err
+				}
+			case "min_baseline":
+				if err := parseFloatArg(d, &t.MinBaseline); err != nil {
+					return err
+				}
+			default:
+				return d.Errf("unrecognized throughput subdirective: %s", d.Val())
+			}
+		}
+		cfg.Throughput = t
+
+	case "threshold":
+		var val string
+		if !d.AllArgs(&val) {
+			return d.ArgErr()
+		}
+		threshold, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return d.Errf("parsing threshold: %v", err)
+		}
+		cfg.Threshold = threshold
+
+	case "trip_duration":
+		var val string
+		if !d.AllArgs(&val) {
+			return d.ArgErr()
+		}
+		dur, err := time.ParseDuration(val)
+		if err != nil {
+			return d.Errf("parsing trip_duration: %v", err)
+		}
+		cfg.TripDuration = caddy.Duration(dur)
+
+	case "dynamic":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		dt := new(DynamicThresholds)
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "file":
+				if !d.AllArgs(&dt.File) {
+					return d.ArgErr()
+				}
+			case "placeholder":
+				if !d.AllArgs(&dt.Placeholder) {
+					return d.ArgErr()
+				}
+			case "interval":
+				if err := parseDurationArg(d, &dt.Interval); err != nil {
+					return err
+				}
+			default:
+				return d.Errf("unrecognized dynamic subdirective: %s", d.Val())
+			}
+		}
+		cfg.Dynamic = dt
+
+	case "status_weight":
+		var key, val string
+		if !d.AllArgs(&key, &val) {
+			return d.ArgErr()
+		}
+		weight, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return d.Errf("parsing status_weight: %v", err)
+		}
+		if cfg.StatusWeights == nil {
+			cfg.StatusWeights = make(map[string]float64)
+		}
+		cfg.StatusWeights[key] = weight
+
+	case "hedge_threshold":
+		var val string
+		if !d.AllArgs(&val) {
+			return d.ArgErr()
+		}
+		threshold, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return d.Errf("parsing hedge_threshold: %v", err)
+		}
+		cfg.HedgeThreshold = threshold
+
+	case "stream_reset_threshold":
+		var val string
+		if !d.AllArgs(&val) {
+			return d.ArgErr()
+		}
+		threshold, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return d.Errf("parsing stream_reset_threshold: %v", err)
+		}
+		cfg.StreamResetThreshold = threshold
+
+	case "stream_reset_trip_duration":
+		var val string
+		if !d.AllArgs(&val) {
+			return d.ArgErr()
+		}
+		dur, err := time.ParseDuration(val)
+		if err != nil {
+			return d.Errf("parsing stream_reset_trip_duration: %v", err)
+		}
+		cfg.StreamResetTripDuration = caddy.Duration(dur)
+
+	case "require_full_window":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		cfg.RequireFullWindow = true
+
+	case "time_series":
+		var val string
+		if !d.AllArgs(&val) {
+			return d.ArgErr()
+		}
+		seconds, err := strconv.Atoi(val)
+		if err != nil {
+			return d.Errf("parsing time_series: %v", err)
+		}
+		cfg.TimeSeries = seconds
+
+	case "storage":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		raw, err := unmarshalStorage(d)
+		if err != nil {
+			return err
+		}
+		cfg.StorageRaw = raw
+
+	case "bypass":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		set, err := unmarshalMatcherSet(d)
+		if err != nil {
+			return err
+		}
+		cfg.BypassRaw = append(cfg.BypassRaw, set)
+
+	case "cardinality_budget":
+		var val string
+		if !d.AllArgs(&val) {
+			return d.ArgErr()
+		}
+		budget, err := strconv.Atoi(val)
+		if err != nil {
+			return d.Errf("parsing cardinality_budget: %v", err)
+		}
+		cfg.CardinalityBudget = budget
+
+	case "cooldown_after_close":
+		if err := parseDurationArg(d, &cfg.CooldownAfterClose); err != nil {
+			return err
+		}
+
+	case "cooldown_severity":
+		if err := parseFloatArg(d, &cfg.CooldownSeverity); err != nil {
+			return err
+		}
+
+	case "late_samples":
+		if !d.AllArgs(&cfg.LateSamples) {
+			return d.ArgErr()
+		}
+
+	case "hung_request_multiple":
+		if err := parseFloatArg(d, &cfg.HungRequestMultiple); err != nil {
+			return err
+		}
+
+	case "per_upstream":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		cfg.PerUpstream = true
+
+	case "upstream_ttl":
+		if err := parseDurationArg(d, &cfg.UpstreamTTL); err != nil {
+			return err
+		}
+
+	case "upstream_warmup":
+		if err := parseDurationArg(d, &cfg.UpstreamWarmup); err != nil {
+			return err
+		}
+
+	case "reset_changed_upstreams":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		cfg.ResetChangedUpstreams = true
+
+	case "admission_start":
+		if err := parseFloatArg(d, &cfg.AdmissionStart); err != nil {
+			return err
+		}
+
+	case "measure_overhead":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		cfg.MeasureOverhead = true
+
+	case "trace":
+		var val string
+		if !d.AllArgs(&val) {
+			return d.ArgErr()
+		}
+		size, err := strconv.Atoi(val)
+		if err != nil {
+			return d.Errf("parsing trace: %v", err)
+		}
+		cfg.Trace = size
+
+	case "rejected_samples":
+		args := d.RemainingArgs()
+		if len(args) < 1 || len(args) > 2 {
+			return d.ArgErr()
+		}
+		size, err := strconv.Atoi(args[0])
+		if err != nil {
+			return d.Errf("parsing rejected_samples: %v", err)
+		}
+		cfg.RejectedSamples = size
+		if len(args) == 2 {
+			rate, err := strconv.ParseFloat(args[1], 64)
+			if err != nil {
+				return d.Errf("parsing rejected_samples rate: %v", err)
+			}
+			cfg.RejectedSampleRate = rate
+		}
+
+	case "history_size":
+		var val string
+		if !d.AllArgs(&val) {
+			return d.ArgErr()
+		}
+		size, err := strconv.Atoi(val)
+		if err != nil {
+			return d.Errf("parsing history_size: %v", err)
+		}
+		cfg.HistorySize = size
+
+	case "max_evaluation_qps":
+		var val string
+		if !d.AllArgs(&val) {
+			return d.ArgErr()
+		}
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return d.Errf("parsing max_evaluation_qps: %v", err)
+		}
+		cfg.MaxEvaluationQPS = n
+
+	case "evaluation_interval":
+		if err := parseDurationArg(d, &cfg.EvaluationInterval); err != nil {
+			return err
+		}
+
+	case "window_of":
+		if !d.AllArgs(&cfg.WindowOf) {
+			return d.ArgErr()
+		}
+
+	case "window_file":
+		if !d.AllArgs(&cfg.WindowFile) {
+			return d.ArgErr()
+		}
+
+	case "latency_baseline":
+		if !d.AllArgs(&cfg.LatencyBaseline) {
+			return d.ArgErr()
+		}
+
+	case "notify_settle":
+		if err := parseDurationArg(d, &cfg.NotifySettle); err != nil {
+			return err
+		}
+
+	case "min_state_interval":
+		if err := parseDurationArg(d, &cfg.MinStateInterval); err != nil {
+			return err
+		}
+
+	case "random_seed":
+		var val string
+		if !d.AllArgs(&val) {
+			return d.ArgErr()
+		}
+		seed, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return d.Errf("parsing random_seed: %v", err)
+		}
+		cfg.RandomSeed = seed
+
+	case "error_budget":
+		args := d.RemainingArgs()
+		if len(args) < 2 || len(args) > 3 {
+			return d.ArgErr()
+		}
+		b := ErrorBudget{Status: args[0]}
+		budget, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return d.Errf("parsing error_budget: %v", err)
+		}
+		b.Budget = budget
+		if len(args) == 3 {
+			period, err := time.ParseDuration(args[2])
+			if err != nil {
+				return d.Errf("parsing error_budget period: %v", err)
+			}
+			b.Period = caddy.Duration(period)
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "min_requests":
+				var val string
+				if !d.AllArgs(&val) {
+					return d.ArgErr()
+				}
+				n, err := strconv.ParseInt(val, 10, 64)
+				if err != nil {
+					return d.Errf("parsing min_requests: %v", err)
+				}
+				b.MinRequests = n
+			default:
+				return d.Errf("unrecognized error_budget subdirective: %s", d.Val())
+			}
+		}
+		cfg.ErrorBudgets = append(cfg.ErrorBudgets, b)
+
+	case "coalesce_records":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		cfg.CoalesceRecords = true
+
+	case "window_mode":
+		if !d.AllArgs(&cfg.WindowMode) {
+			return d.ArgErr()
+		}
+
+	case "histogram":
+		if !d.AllArgs(&cfg.Histogram) {
+			return d.ArgErr()
+		}
+
+	case "log_capacity":
+		var val string
+		if !d.AllArgs(&val) {
+			return d.ArgErr()
+		}
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return d.Errf("parsing log_capacity: %v", err)
+		}
+		cfg.LogCapacity = n
+
+	case "export_all_factors":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		cfg.ExportAllFactors = true
+
+	case "labels":
+		cfg.Labels = d.RemainingArgs()
+		if len(cfg.Labels) == 0 {
+			return d.ArgErr()
+		}
+
+	case "failure_domain":
+		if !d.AllArgs(&cfg.FailureDomain) {
+			return d.ArgErr()
+		}
+
+	case "runbook_url":
+		if !d.AllArgs(&cfg.RunbookURL) {
+			return d.ArgErr()
+		}
+
+	case "trip_reason":
+		if !d.AllArgs(&cfg.TripReason) {
+			return d.ArgErr()
+		}
+
+	case "propagate_trip_to":
+		cfg.PropagateTripTo = d.RemainingArgs()
+		if len(cfg.PropagateTripTo) == 0 {
+			return d.ArgErr()
+		}
+
+	default:
+		return d.Errf("unrecognized subdirective: %s", d.Val())
+	}
+	return nil
+}
+
+// unmarshalCaddyfileOption parses a subdirective of a ratio factor block.
+func (r *RatioFactor) unmarshalCaddyfileOption(d *caddyfile.Dispenser, factor string) error {
+	switch d.Val() {
+	case "threshold":
+		return parseFloatArg(d, &r.Threshold)
+	case "min_requests":
+		var val string
+		if !d.AllArgs(&val) {
+			return d.ArgErr()
+		}
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return d.Errf("parsing min_requests: %v", err)
+		}
+		r.MinRequests = n
+		return nil
+	case "include", "exclude":
+		if factor != "error_ratio" {
+			break
+		}
+		option := d.Val()
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return d.ArgErr()
+		}
+		for _, arg := range args {
+			code, err := strconv.Atoi(arg)
+			if err != nil {
+				return d.Errf("parsing %s: %v", option, err)
+			}
+			if option == "include" {
+				r.Include = append(r.Include, code)
+			} else {
+				r.Exclude = append(r.Exclude, code)
+			}
+		}
+		return nil
+	}
+	return d.Errf("unrecognized %s subdirective: %s", factor, d.Val())
+}
+
+// unmarshalStorage parses the storage backend named by the current
+// token, along with its options, into the JSON of a storage module.
+func unmarshalStorage(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	name := d.Val()
+	modInfo, err := caddy.GetModule("circuit_breaker.storage." + name)
+	if err != nil {
+		return nil, d.Errf("getting storage module '%s': %v", name, err)
+	}
+	mod := modInfo.New()
+	unm, ok := mod.(caddyfile.Unmarshaler)
+	if !ok {
+		return nil, d.Errf("storage module '%s' is not a Caddyfile unmarshaler", name)
+	}
+	if err := unm.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+		return nil, err
+	}
+	return caddyconfig.JSONModuleObject(mod, "backend", name, nil), nil
+}
+
+// parseFloatArg parses the single argument of the current subdirective.
+func parseFloatArg(d *caddyfile.Dispenser, f *float64) error {
+	name := d.Val()
+	var val string
+	if !d.AllArgs(&val) {
+		return d.ArgErr()
+	}
+	parsed, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return d.Errf("parsing %s: %v", name, err)
+	}
+	*f = parsed
+	return nil
+}
+
+// parseDurationArg parses the single argument of the current subdirective.
+func parseDurationArg(d *caddyfile.Dispenser, dur *caddy.Duration) error {
+	name := d.Val()
+	var val string
+	if !d.AllArgs(&val) {
+		return d.ArgErr()
+	}
+	parsed, err := time.ParseDuration(val)
+	if err != nil {
+		return d.Errf("parsing %s: %v", name, err)
+	}
+	*dur = caddy.Duration(parsed)
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*Simple)(nil)
+)
@@ -0,0 +1,141 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// candidateSet holds the candidate configs evaluated alongside a
+// named breaker. Each candidate is a breaker of its own that sees
+// every sample the live breaker sees, but is never enforced, so its
+// history shows when it would have tripped.
+type candidateSet struct {
+	mu sync.RWMutex
+	m  map[string]*Simple
+}
+
+func (s *candidateSet) record(sample Sample) {
+	if s == nil {
+		return
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, c := range s.m {
+		c.Record(sample)
+	}
+}
+
+func (s *candidateSet) recordBatch(samples []Sample) {
+	if s == nil {
+		return
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, c := range s.m {
+		c.RecordBatch(samples)
+	}
+}
+
+// AddCandidate starts evaluating cfg alongside the breaker under the
+// given id, replacing any candidate with the same id. Fields not set
+// in cfg are taken from the breaker's own config, so a candidate
+// only needs to name what it changes, such as a threshold. The
+// candidate starts with an empty window and sees the same requests
+// as the breaker from then on; its trips are recorded in its history
+// but never enforced. Only named breakers take candidates.
+func (c *Simple) AddCandidate(id string, cfg Config) error {
+	if c.candidates == nil {
+		return fmt.Errorf("candidates require a named breaker")
+	}
+	if id == "" {
+		return fmt.Errorf("candidate id must not be empty")
+	}
+
+	// a factor block given alone selects its factor, rather than
+	// the breaker's factor being inherited alongside it
+	cfg.inferFactor()
+	if err := cfg.inherit(&c.Config); err != nil {
+		return fmt.Errorf("inheriting config: %v", err)
+	}
+	cfg.Name = id
+	cfg.StorageRaw = nil
+	cfg.Dynamic = nil
+	cfg.PerUpstream = false
+	cfg.TimeSeries = 0
+	cfg.MeasureOverhead = false
+	cfg.Labels = nil
+	cfg.PropagateTripTo = nil
+	cfg.WindowOf = ""
+	cfg.WindowFile = ""
+	cfg.LatencyBaseline = ""
+	cfg.RejectedSamples = 0
+
+	cand := &Simple{Config: cfg}
+	cand.logger = c.logger.With(zap.String("candidate", id))
+	cand.clock = c.clock
+	cand.afterFunc = c.afterFunc
+	if err := cand.provisionConfig(nil); err != nil {
+		return err
+	}
+	if err := cand.initState(); err != nil {
+		return err
+	}
+	if cand.Trace > 0 {
+		cand.trace = newTrace(cand.Trace)
+	}
+	cand.rand = c.rand
+
+	c.candidates.mu.Lock()
+	if c.candidates.m == nil {
+		c.candidates.m = make(map[string]*Simple)
+	}
+	c.candidates.m[id] = cand
+	c.candidates.mu.Unlock()
+	return nil
+}
+
+// RemoveCandidate stops evaluating the candidate with the given id.
+// It returns false if there is no such candidate.
+func (c *Simple) RemoveCandidate(id string) bool {
+	if c.candidates == nil {
+		return false
+	}
+	c.candidates.mu.Lock()
+	defer c.candidates.mu.Unlock()
+	_, ok := c.candidates.m[id]
+	delete(c.candidates.m, id)
+	return ok
+}
+
+// candidateStatuses returns the full status of each candidate,
+// sorted by id.
+func (c *Simple) candidateStatuses() []breakerStatus {
+	statuses := make([]breakerStatus, 0)
+	if c.candidates == nil {
+		return statuses
+	}
+	c.candidates.mu.RLock()
+	for _, cand := range c.candidates.m {
+		statuses = append(statuses, cand.status(true))
+	}
+	c.candidates.mu.RUnlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import "sync"
+
+// cardinalityBudget bounds how many distinct keys a breaker tracks
+// separately. Once the budget is used up, new keys are merged into a
+// coarser key instead of growing memory without bound, and exceeded
+// is called once so the degradation can be reported.
+type cardinalityBudget struct {
+	mu       sync.Mutex
+	limit    int
+	seen     map[int]struct{}
+	degraded bool
+	exceeded func()
+}
+
+func newCardinalityBudget(limit int, exceeded func()) *cardinalityBudget {
+	return &cardinalityBudget{
+		limit:    limit,
+		seen:     make(map[int]struct{}),
+		exceeded: exceeded,
+	}
+}
+
+// statusCode returns the key under which statusCode is tracked: the
+// code itself while the budget allows, otherwise the first code of
+// its class, such as 500 for 503. Class codes are always admitted
+// so that merged codes stay within any status range that covers
+// their whole class.
+func (b *cardinalityBudget) statusCode(statusCode int) int {
+	if b == nil {
+		return statusCode
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.seen[statusCode]; ok {
+		return statusCode
+	}
+	class := statusCode - statusCode%100
+	if len(b.seen) < b.limit || statusCode == class {
+		b.seen[statusCode] = struct{}{}
+		return statusCode
+	}
+	if !b.degraded {
+		b.degraded = true
+		if b.exceeded != nil {
+			b.exceeded()
+		}
+	}
+	b.seen[class] = struct{}{}
+	return class
+}
+
+const defaultCardinalityBudget = 64
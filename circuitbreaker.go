@@ -17,13 +17,17 @@
 package circuitbreaker
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
-	"github.com/vulcand/oxy/memmetrics"
+	"go.uber.org/zap"
 )
 
 func init() {
@@ -33,9 +37,54 @@ func init() {
 // Simple implements circuit breaking functionality for
 // requests within this process over a sliding time window.
 type Simple struct {
-	tripped  int32 // accessed atomically
-	cbFactor int32
-	metrics  *memmetrics.RTMetrics
+	lastValue    uint64 // accessed atomically; float64 bits of the last factor value
+	admission    uint64 // accessed atomically; float64 bits of the suggested admission rate
+	pressure     uint64 // accessed atomically; float64 bits of the factor value over its threshold
+	tripped      int32  // accessed atomically
+	hedging      int32  // accessed atomically
+	draining     int32  // accessed atomically
+	inFlight     int64  // accessed atomically
+	closedAt     int64  // accessed atomically; clock() when the circuit last closed, or -1
+	trippedAt    int64  // accessed atomically; clock() when the circuit last tripped, or -1
+	limited      int64  // accessed atomically; state changes held back by min_state_interval
+	cbFactor     int32
+	metrics      *window
+	deadlines    *outcomeCounter
+	streamResets *outcomeCounter
+	stale        *outcomeCounter
+	hung         *hungTracker
+	throughput   *throughputCounter
+	series       *timeSeries
+	weights      *statusWeights
+	bypass       caddyhttp.MatcherSets
+	errors       map[int]bool
+	history      *history
+	trace        *trace
+	rejected     *rejectedLog // sampled rejected requests; nil unless rejected_samples is set
+	overhead     *overhead
+	upstreams    *upstreamSet
+	guard        *CorrelationGuard
+	shared       *distributed
+	candidates   *candidateSet
+	budgets      []*errorBudget
+	records      *recordQueue
+	settle       *settleFilter
+	evals        *evalGuard
+	logger       *zap.Logger
+	clock        func() time.Duration        // monotonic; set before start to run on other time
+	afterFunc    func(time.Duration, func()) // schedules on clock; time.AfterFunc if nil
+	rand         Random
+
+	mu            *sync.Mutex
+	closed        chan struct{} // closed while the circuit is closed
+	generation    uint64        // incremented whenever a pending close becomes stale
+	drained       chan struct{} // closed once draining completed
+	drainedClosed bool
+	openUntil     time.Time     // when an open circuit closes
+	openedFor     string        // the reason of the trip that opened the circuit
+	changedAt     time.Duration // clock() at the last state change, or -1
+	limitLogged   bool          // whether a held back change was logged since then
+
 	Config
 }
 
@@ -49,106 +98,1414 @@ func (Simple) CaddyModule() caddy.ModuleInfo {
 
 // Provision sets up a configured circuit breaker.
 func (c *Simple) Provision(ctx caddy.Context) error {
+	c.logger = ctx.Logger(c)
+
+	appIface, err := ctx.App("circuit_breaker")
+	if err != nil {
+		return fmt.Errorf("getting circuit_breaker app: %v", err)
+	}
+	app := appIface.(*App)
+	if err := c.provisionConfig(app); err != nil {
+		return err
+	}
+
+	c.guard = app.CorrelationGuard
+	if err := c.provisionBypass(ctx); err != nil {
+		return err
+	}
+	if err := c.provisionCustomFactor(ctx); err != nil {
+		return err
+	}
+	if err := c.start(); err != nil {
+		return err
+	}
+
+	if c.StorageRaw != nil {
+		if c.Name == "" {
+			return fmt.Errorf("storage requires a name to share state under")
+		}
+		mod, err := ctx.LoadModule(&c.Config, "StorageRaw")
+		if err != nil {
+			return fmt.Errorf("loading storage module: %v", err)
+		}
+		c.startDistributed(mod.(Storage))
+	}
+
+	if c.Name != "" {
+		c.candidates = new(candidateSet)
+		registerBreaker(c)
+	}
+
+	return nil
+}
+
+// New returns a circuit breaker with the given config, for use
+// outside of a Caddy config, such as by other programs or in tests.
+// Unset fields take their values from DefaultConfig. Named breakers
+// are not registered for the admin API, and a storage cannot be
+// used, since it is a Caddy module, nor can bypass matchers. Call
+// Cleanup once the breaker is no longer needed.
+func New(cfg Config) (*Simple, error) {
+	return newStandalone(cfg, nil)
+}
+
+// newStandalone creates a breaker as New does, calling setup, if
+// not nil, once the config is provisioned but before it starts.
+func newStandalone(cfg Config, setup func(*Simple)) (*Simple, error) {
+	if cfg.StorageRaw != nil {
+		return nil, fmt.Errorf("storage requires provisioning by Caddy")
+	}
+	if cfg.BypassRaw != nil {
+		return nil, fmt.Errorf("bypass requires provisioning by Caddy")
+	}
+	if cfg.CustomFactorRaw != nil {
+		return nil, fmt.Errorf("custom factor modules require provisioning by Caddy; set CustomFactor instead")
+	}
+	c := &Simple{Config: cfg}
+	c.logger = caddy.Log().Named("circuit_breaker")
+	if err := c.provisionConfig(nil); err != nil {
+		return nil, err
+	}
+	if setup != nil {
+		setup(c)
+	}
+	if err := c.start(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// start sets up the runtime state of a breaker whose config has
+// been provisioned, and starts its background work.
+func (c *Simple) start() error {
+	if err := c.initState(); err != nil {
+		return err
+	}
+	if c.WindowFile != "" {
+		if err := c.metrics.attachFile(c.WindowFile, c.Name); err != nil {
+			return err
+		}
+	}
+	if c.LatencyBaseline != "" {
+		if err := c.seedLatencyBaseline(); err != nil {
+			return err
+		}
+	}
+	if c.Dynamic != nil {
+		c.watchDynamic()
+	}
+	if c.HungRequestMultiple > 0 {
+		c.hung = newHungTracker(c.HungRequestMultiple)
+		c.watchHung()
+	}
+	if c.Trace > 0 {
+		c.trace = newTrace(c.Trace)
+	}
+	if c.RejectedSamples > 0 {
+		c.rejected = newRejectedLog(c.RejectedSamples)
+	}
+	if c.MeasureOverhead {
+		c.overhead = new(overhead)
+	}
+	if c.PerUpstream {
+		c.upstreams = newUpstreamSet(time.Duration(c.UpstreamTTL), time.Duration(c.UpstreamWarmup))
+		c.upstreams.clock = c.clock
+		c.inheritUpstreams()
+	}
+	if c.CoalesceRecords {
+		c.startRecordQueue()
+	}
+	c.joinWindowShare()
+	return nil
+}
+
+// provisionConfig validates the config of the breaker and fills in
+// its defaults, including those configured on app, if not nil.
+func (c *Simple) provisionConfig(app *App) error {
+	upgraded := c.Config.upgradeLegacy()
+	if err := c.Config.applyPreset(); err != nil {
+		return err
+	}
+	if err := app.inheritDefaults(&c.Config); err != nil {
+		return fmt.Errorf("inheriting defaults: %v", err)
+	}
+	upgraded = c.Config.upgradeLegacy() || upgraded
+	c.Config.inferFactor()
+	if upgraded {
+		// the config keeps working, but point users to what to write instead
+		block, _ := json.Marshal(c.Config.factorBlock())
+		c.logger.Warn("deprecated flat threshold or hedge_threshold converted into the factor block; configure the block instead",
+			zap.String("name", c.Name),
+			zap.String("factor", c.Factor),
+			zap.ByteString("config", block))
+	}
+
 	f, ok := typeCB[c.Factor]
 	if !ok {
-		return fmt.Errorf("type is not defined")
+		return fmt.Errorf("%w: %q", ErrUnknownFactor, c.Factor)
+	}
+	if err := c.Config.provisionFactors(); err != nil {
+		return err
 	}
+	c.Config.applyDefaults()
 
-	if c.TripDuration == 0 {
-		c.TripDuration = caddy.Duration(defaultTripDuration)
+	if len(c.StatusWeights) > 0 {
+		w, err := parseStatusWeights(c.StatusWeights)
+		if err != nil {
+			return fmt.Errorf("status_weights: %v", err)
+		}
+		c.weights = w
+	}
+	if c.ErrorRatio != nil {
+		c.errors = c.ErrorRatio.errorCodes()
 	}
 
-	mt, err := memmetrics.NewRTMetrics()
-	if err != nil {
-		return fmt.Errorf("cannot create new metrics: %v", err.Error())
+	if c.CardinalityBudget < 0 {
+		return fmt.Errorf("cardinality_budget must not be negative")
+	}
+
+	if c.StreamResetThreshold < 0 {
+		return fmt.Errorf("stream_reset_threshold: %w: must not be negative", ErrInvalidThreshold)
+	}
+	if c.StreamResetTripDuration == 0 {
+		c.StreamResetTripDuration = c.TripDuration
+	}
+
+	if c.TimeSeries < 0 {
+		return fmt.Errorf("time_series must not be negative")
+	}
+	if c.TimeSeries > 0 {
+		ts, err := newTimeSeries(c.TimeSeries, nil)
+		if err != nil {
+			return fmt.Errorf("%w: creating time series: %v", ErrMetricsUnavailable, err)
+		}
+		c.series = ts
+	}
+
+	if c.CooldownAfterClose < 0 {
+		return fmt.Errorf("cooldown_after_close must not be negative")
+	}
+	if c.CooldownSeverity < 0 {
+		return fmt.Errorf("cooldown_severity: %w: must not be negative", ErrInvalidThreshold)
+	}
+
+	switch c.LateSamples {
+	case "", lateSamplesWindow, lateSamplesStale, lateSamplesDiscard:
+	default:
+		return fmt.Errorf("unknown late_samples %q; must be window, stale, or discard", c.LateSamples)
+	}
+	if c.HungRequestMultiple < 0 || (c.HungRequestMultiple > 0 && c.HungRequestMultiple <= 1) {
+		return fmt.Errorf("hung_request_multiple must be above 1")
+	}
+
+	if c.Trace < 0 {
+		return fmt.Errorf("trace must not be negative")
+	}
+	if c.RejectedSamples < 0 {
+		return fmt.Errorf("rejected_samples must not be negative")
+	}
+	if c.RejectedSampleRate < 0 || c.RejectedSampleRate > 1 {
+		return fmt.Errorf("rejected_sample_rate must be between 0 and 1")
+	}
+	if c.RejectedSamples > 0 && c.RejectedSampleRate == 0 {
+		c.RejectedSampleRate = defaultRejectedSampleRate
+	}
+
+	if c.AdmissionStart < 0 || c.AdmissionStart >= 1 {
+		return fmt.Errorf("admission_start must be at least 0 and below 1")
+	}
+
+	if c.UpstreamTTL < 0 {
+		return fmt.Errorf("upstream_ttl must not be negative")
+	}
+	if c.UpstreamWarmup < 0 {
+		return fmt.Errorf("upstream_warmup must not be negative")
+	}
+
+	if c.HistorySize < 0 {
+		return fmt.Errorf("history_size must not be negative")
+	}
+	if c.MinStateInterval < 0 {
+		return fmt.Errorf("min_state_interval must not be negative")
+	}
+	if c.WindowOf != "" && c.WindowOf == c.Name {
+		return fmt.Errorf("window_of must name another breaker")
+	}
+	if c.MaxEvaluationQPS < 0 || c.EvaluationInterval < 0 {
+		return fmt.Errorf("max_evaluation_qps and evaluation_interval must not be negative")
+	}
+	if c.MaxEvaluationQPS > 0 && c.EvaluationInterval == 0 {
+		c.EvaluationInterval = caddy.Duration(defaultEvaluationInterval)
+	}
+	if c.NotifySettle < 0 {
+		return fmt.Errorf("notify_settle must not be negative")
+	}
+	switch c.WindowMode {
+	case "", windowModeBuckets:
+	case windowModeLog:
+		if c.LogCapacity < 0 {
+			return fmt.Errorf("log_capacity must not be negative")
+		}
+		if c.LogCapacity == 0 {
+			c.LogCapacity = defaultLogCapacity
+		}
+	default:
+		return fmt.Errorf("unknown window_mode %q; must be buckets or log", c.WindowMode)
+	}
+	if c.WindowFile != "" && (c.WindowMode == windowModeLog || c.WindowOf != "") {
+		return fmt.Errorf("window_file requires the buckets window_mode and a window of the breaker's own")
+	}
+	if c.WindowFile != "" && c.Name == "" {
+		return fmt.Errorf("window_file requires a name")
+	}
+	if c.LatencyBaseline != "" && (c.WindowMode == windowModeLog || c.WindowOf != "") {
+		return fmt.Errorf("latency_baseline requires the buckets window_mode and a window of the breaker's own")
+	}
+	switch c.Histogram {
+	case "", histogramHDR:
+	case histogramFixed:
+		if c.WindowMode == windowModeLog {
+			return fmt.Errorf("histogram fixed requires the buckets window_mode")
+		}
+		if c.Latency != nil && len(c.Latency.Quantiles) > 0 {
+			return fmt.Errorf("histogram fixed cannot be combined with registered latency quantiles")
+		}
+	default:
+		return fmt.Errorf("unknown histogram %q; must be hdr or fixed", c.Histogram)
+	}
+	if err := c.Config.provisionErrorBudgets(); err != nil {
+		return err
+	}
+
+	if c.Dynamic != nil {
+		if err := c.Dynamic.provision(); err != nil {
+			return fmt.Errorf("dynamic: %v", err)
+		}
 	}
 
 	c.cbFactor = f
+	return nil
+}
+
+// initState sets up the runtime state of a breaker whose
+// config has been validated, with the circuit closed. Everything
+// measures time with c.clock, which is the monotonic clock of the
+// process unless it was set before.
+func (c *Simple) initState() error {
+	if c.clock == nil {
+		c.clock = monotonicClock()
+	}
+	var mt *window
+	var quantiles []float64
+	if c.Latency != nil {
+		quantiles = c.Latency.Quantiles
+	}
+	switch {
+	case c.WindowMode == windowModeLog:
+		var dropped int32
+		mt = newLogWindow(c.clock, c.LogCapacity, func() {
+			if atomic.CompareAndSwapInt32(&dropped, 0, 1) {
+				c.logger.Warn("window log full; dropping oldest samples, so ratios cover less than the window",
+					zap.String("name", c.Name),
+					zap.Int("log_capacity", c.LogCapacity))
+			}
+		})
+		mt.quantiles = quantiles
+	case len(quantiles) > 0:
+		mt = newQuantileWindow(c.clock, quantiles)
+	case c.Histogram == histogramFixed:
+		mt = newFixedWindow(c.clock)
+	default:
+		var err error
+		mt, err = newWindow(c.clock)
+		if err != nil {
+			return fmt.Errorf("%w: creating window: %v", ErrMetricsUnavailable, err)
+		}
+	}
+	mt.budget = newCardinalityBudget(c.CardinalityBudget, func() {
+		c.logger.Warn("cardinality budget exceeded; merging further status codes into their class",
+			zap.String("name", c.Name),
+			zap.Int("cardinality_budget", c.CardinalityBudget))
+	})
+
 	c.metrics = mt
+	c.admission = math.Float64bits(1)
+	c.deadlines = newOutcomeCounter(c.clock)
+	c.streamResets = newOutcomeCounter(c.clock)
+	if c.Throughput != nil {
+		c.throughput = newThroughputCounter(c.clock, time.Duration(c.Throughput.Baseline))
+	}
 	c.tripped = 0
+	c.closedAt = -1
+	c.trippedAt = -1
+	if c.LateSamples == lateSamplesStale {
+		c.stale = newOutcomeCounter(c.clock)
+	}
+	c.changedAt = -1
+	c.rand = newRandom(c.RandomSeed)
+	c.budgets = newErrorBudgets(c.ErrorBudgets, c.clock)
+	if c.MaxEvaluationQPS > 0 {
+		c.evals = newEvalGuard(c.clock, c.MaxEvaluationQPS, time.Duration(c.EvaluationInterval), func(throttled bool) {
+			c.logger.Info("evaluation rate changed",
+				zap.String("name", c.Name),
+				zap.Bool("throttled", throttled),
+				zap.Duration("evaluation_interval", time.Duration(c.EvaluationInterval)))
+		})
+	}
+	if c.NotifySettle > 0 {
+		c.settle = newSettleFilter(time.Duration(c.NotifySettle), broadcastState)
+	}
+	c.history = newHistory(c.HistorySize, StateClosed)
+	c.mu = new(sync.Mutex)
+	c.closed = make(chan struct{})
+	close(c.closed)
+	return nil
+}
 
+// Cleanup removes the circuit breaker from the registry
+// and stops sharing its state.
+func (c *Simple) Cleanup() error {
+	c.stopRecordQueue()
+	c.leaveWindowShare()
+	c.stopDistributed()
+	c.stopDynamic()
+	c.stopHung()
+	if err := c.metrics.closeFile(); err != nil {
+		c.logger.Warn("closing window file", zap.String("name", c.Name), zap.Error(err))
+	}
+	if c.Name != "" {
+		unregisterBreaker(c)
+	}
 	return nil
 }
 
-// OK returns whether the circuit breaker is tripped or not.
+// OK returns whether the circuit breaker is tripped or not. While
+// the correlation guard is suppressing enforcement, it is always true,
+// unless the breaker is draining.
 func (c *Simple) OK() bool {
-	return atomic.LoadInt32(&c.tripped) == 0
+	if c.overhead != nil {
+		defer c.overhead.ok.observe(time.Now())
+	}
+	if c.Draining() {
+		return false
+	}
+	return atomic.LoadInt32(&c.tripped) == 0 || c.guard.suppressing()
+}
+
+// Hedging returns whether the latency observed by the breaker is
+// above the configured hedge threshold. A retry or hedging policy
+// can use this as a signal to start issuing hedged requests before
+// the circuit actually opens. It is always false if no hedge
+// threshold is configured.
+func (c *Simple) Hedging() bool {
+	return atomic.LoadInt32(&c.hedging) == 1
+}
+
+// AdmissionRate returns an advisory share of requests, from 0.0 to 1.0,
+// that should be let through to the upstream. It is 1.0 while the
+// factor is below admission_start times its threshold and falls
+// linearly to 0.0 as the factor approaches the threshold, so rate
+// limiters and upstream pickers can slow down before the circuit
+// ever opens. It is 0.0 while the circuit is open.
+func (c *Simple) AdmissionRate() float64 {
+	if !c.OK() {
+		return 0
+	}
+	return math.Float64frombits(atomic.LoadUint64(&c.admission))
+}
+
+// admissionRate computes the suggested admission rate for a
+// factor value, given its threshold and where throttling starts,
+// as a fraction of the threshold.
+func admissionRate(value, threshold, start float64) float64 {
+	from := threshold * start
+	switch {
+	case value <= from:
+		return 1
+	case value >= threshold:
+		return 0
+	}
+	return (threshold - value) / (threshold - from)
+}
+
+// factorValue returns the value the configured factor had when it was
+// last evaluated: a ratio, or a latency in the unit of the latency factor.
+func (c *Simple) factorValue() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.lastValue))
+}
+
+// closedNotify returns a channel that is closed once the circuit is closed.
+func (c *Simple) closedNotify() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// History returns the most recent state transitions, oldest first.
+func (c *Simple) History() []Transition {
+	return c.history.transitions()
+}
+
+// Evaluations returns the most recent factor evaluations, oldest first,
+// or nil if trace is not enabled.
+func (c *Simple) Evaluations() []Evaluation {
+	if c.trace == nil {
+		return nil
+	}
+	return c.trace.evaluations()
+}
+
+// Series returns the per-second request counts and latencies of
+// the last seconds, oldest first, or nil if time_series is not enabled.
+func (c *Simple) Series() []SeriesPoint {
+	if c.series == nil {
+		return nil
+	}
+	return c.series.points()
+}
+
+// TimeInState returns how long the circuit breaker has been in its current state.
+func (c *Simple) TimeInState() time.Duration {
+	_, since := c.history.current()
+	return time.Since(since)
+}
+
+func (c *Simple) status(full bool) breakerStatus {
+	_, since := c.history.current()
+	st := breakerStatus{
+		Name:          c.Name,
+		State:         c.State(),
+		Since:         since,
+		TimeInState:   time.Since(since).String(),
+		FactorValue:   c.factorValue(),
+		AdmissionRate: c.AdmissionRate(),
+		HealthScore:   c.HealthScore(),
+		MemoryBytes:   c.MemoryUsage(),
+		Suppressed:    c.guard.suppressing(),
+		Overhead:      c.overhead.report(),
+		Draining:      c.Draining(),
+		InFlight:      c.InFlight(),
+		Hung:          c.Hung(),
+		Limited:       atomic.LoadInt64(&c.limited),
+		Throttled:     c.evals.isThrottled(),
+		ErrorBudgets:  c.errorBudgetStatuses(),
+		Stale:         c.staleStatus(),
+	}
+	if c.ExportAllFactors {
+		v := c.FactorValues()
+		st.Factors = &v
+	}
+	if full {
+		cfg := c.Config
+		stats := c.metrics.stats()
+		st.Config = &cfg
+		st.Window = &stats
+		st.History = c.History()
+	}
+	if c.upstreams != nil {
+		st.Upstreams = c.upstreamStatuses()
+	}
+	return st
 }
 
 // RecordMetric records a response status code and execution time of a request. This function should be run in a separate goroutine.
 func (c *Simple) RecordMetric(statusCode int, latency time.Duration) {
-	c.metrics.Record(statusCode, latency)
-	c.checkAndSet()
+	c.submit(Sample{StatusCode: statusCode, Latency: latency})
+}
+
+// RecordMetricWithDeadline is like RecordMetric, but for requests that
+// carried a deadline; missed reports whether the request finished after
+// it. Only these requests are considered by the deadline_miss_ratio factor.
+// This function should be run in a separate goroutine.
+func (c *Simple) RecordMetricWithDeadline(statusCode int, latency time.Duration, missed bool) {
+	c.submit(Sample{
+		StatusCode:     statusCode,
+		Latency:        latency,
+		HasDeadline:    true,
+		MissedDeadline: missed,
+	})
+}
+
+// Sample is the outcome of a single request, as recorded by the
+// breaker. Integrations fill in as many of the request attributes
+// as they know; the breaker ignores those it does not use.
+type Sample struct {
+	// The status code of the response.
+	StatusCode int
+	// How long the request took.
+	Latency time.Duration
+	// How much of the latency the request spent queued in the proxy
+	// before it began connecting to the upstream, if known.
+	QueueTime time.Duration
+	// The size of the response body, if known.
+	Bytes int64
+	// The request method.
+	Method string
+	// The pattern of the route that matched the request, such as
+	// "/api/users/*", rather than the raw path, which would make
+	// anything keyed by it unbounded.
+	PathPattern string
+	// The dial address (host:port) of the upstream that served the
+	// request; for dynamic upstreams, the resolved address.
+	Upstream string
+	// How many times the request was retried before this outcome.
+	Retries int
+	// The error that ended the request, if any.
+	Err error
+	// Whether the request carried a deadline, and if so,
+	// whether it finished after it.
+	HasDeadline    bool
+	MissedDeadline bool
+}
+
+// Record records the outcome of a request. This function should be
+// run in a separate goroutine.
+func (c *Simple) Record(s Sample) {
+	if c.overhead != nil {
+		defer c.overhead.record.observe(time.Now())
+	}
+	if c.upstreams != nil && s.Upstream != "" {
+		if u := c.upstream(s.Upstream); u != nil {
+			if c.keepWarmingUp(u, c.upstreams.warmupWeight(s.Upstream), s) {
+				u.Record(s)
+			}
+		}
+	}
+	c.candidates.record(s)
+	c.recordErrorBudgets(s)
+	if c.late(s) {
+		if c.stale != nil {
+			c.stale.record(isFailure(s))
+		}
+		return
+	}
+	s.Latency = c.serviceTime(s)
+	if c.WindowOf == "" {
+		c.metrics.record(s.StatusCode, s.Latency)
+	}
+	if c.series != nil {
+		c.series.record(s.StatusCode, s.Latency)
+		if c.ExportAllFactors {
+			c.series.recordFactors(c.FactorValues)
+		}
+	}
+	if s.HasDeadline {
+		c.deadlines.record(s.MissedDeadline)
+	}
+	if c.throughput != nil {
+		c.throughput.record(s)
+	}
+	c.streamResets.record(isStreamReset(s.Err))
+	if c.overhead != nil {
+		defer c.overhead.evaluate.observe(time.Now())
+	}
+	if c.evals.allow(1) {
+		c.checkAndSet()
+	}
+	c.evaluateFollowers()
+}
+
+// serviceTime returns the latency of s to evaluate: all of it, or
+// with exclude_queueing, only the part after the request left the
+// proxy's queue; clamped to the floor and ceiling, if any.
+func (c *Simple) serviceTime(s Sample) time.Duration {
+	if c.Latency == nil {
+		return s.Latency
+	}
+	if !c.Latency.ExcludeQueueing || s.QueueTime <= 0 {
+		return c.Latency.clamp(s.Latency)
+	}
+	if s.QueueTime >= s.Latency {
+		return c.Latency.clamp(0)
+	}
+	return c.Latency.clamp(s.Latency - s.QueueTime)
+}
+
+// RecordBatch records the outcomes of several requests at once, for
+// integrations that aggregate samples, such as a sampling shim or a
+// feed from another instance. Every part of the breaker is updated once
+// per batch rather than once per sample, and the factor is evaluated
+// once, after all samples were added. This function should be run in
+// a separate goroutine.
+func (c *Simple) RecordBatch(samples []Sample) {
+	if len(samples) == 0 {
+		return
+	}
+	if c.overhead != nil {
+		defer c.overhead.record.observe(time.Now())
+	}
+	if c.upstreams != nil {
+		byUpstream := make(map[string][]Sample)
+		for _, s := range samples {
+			if s.Upstream != "" {
+				byUpstream[s.Upstream] = append(byUpstream[s.Upstream], s)
+			}
+		}
+		for addr, batch := range byUpstream {
+			if u := c.upstream(addr); u != nil {
+				u.RecordBatch(c.warmingUp(addr, u, batch))
+			}
+		}
+	}
+	c.candidates.recordBatch(samples)
+	c.recordErrorBudgets(samples...)
+	if samples = c.recordLate(samples); len(samples) == 0 {
+		return
+	}
+	if l := c.Latency; l != nil && (l.ExcludeQueueing || l.Floor > 0 || l.Ceiling > 0) {
+		adjusted := make([]Sample, len(samples))
+		for i, s := range samples {
+			s.Latency = c.serviceTime(s)
+			adjusted[i] = s
+		}
+		samples = adjusted
+	}
+
+	if c.WindowOf == "" {
+		c.metrics.recordBatch(samples)
+	}
+	if c.series != nil {
+		c.series.recordBatch(samples)
+		if c.ExportAllFactors {
+			c.series.recordFactors(c.FactorValues)
+		}
+	}
+	var missed, deadlines, resets int64
+	for _, s := range samples {
+		if s.HasDeadline {
+			deadlines++
+			if s.MissedDeadline {
+				missed++
+			}
+		}
+		if isStreamReset(s.Err) {
+			resets++
+		}
+	}
+	if deadlines > 0 {
+		c.deadlines.add(missed, deadlines)
+	}
+	c.streamResets.add(resets, int64(len(samples)))
+	if c.throughput != nil {
+		c.throughput.record(samples...)
+	}
+	if c.overhead != nil {
+		defer c.overhead.evaluate.observe(time.Now())
+	}
+	if c.evals.allow(len(samples)) {
+		c.checkAndSet()
+	}
+	c.evaluateFollowers()
 }
 
 // Ok checks our metrics to see if we should trip our circuit breaker, or if the fallback duration has completed.
 func (c *Simple) checkAndSet() {
 	var isTripped bool
+	var reason string
+	cause := ReasonThreshold
+	var severity float64 // how many times its threshold the value is
+	tripDuration := c.tripDuration(c.TripDuration)
+	ev := Evaluation{Factor: c.Factor, Decision: decisionBelowThreshold}
+
+	// ratios over a partially filled window are dominated by the first few requests
+	ratiosReady := !c.RequireFullWindow || c.metrics.full()
+
+	// hung requests in flight count as failures of the ratio and latency factors
+	hungAges := c.hung.hungAges()
+	hung := int64(len(hungAges))
 
 	switch c.cbFactor {
 	case factorErrorRatio:
+		n := c.metrics.totalCount()
+		ev.Requests, ev.Hung = n+hung, hung
+		ev.Threshold = c.ratioThreshold(c.ErrorRatio.Threshold)
+		if !ratiosReady {
+			ev.Decision = decisionWindowNotFull
+			break
+		}
+		if ev.Requests < c.ErrorRatio.MinRequests {
+			ev.Decision = decisionTooFewRequests
+			break
+		}
 		// check if amount of network errors exceed threshold over sliding window, threshold for comparison should be < 1.0 i.e. .5 = 50th percentile
-		if c.metrics.NetworkErrorRatio() > c.Threshold {
+		ratio := presumeFailures(c.errorRatio(), n, hung)
+		ev.Value = ratio
+		atomic.StoreUint64(&c.lastValue, math.Float64bits(ratio))
+		if ratio > ev.Threshold {
 			isTripped = true
+			severity = ratio / ev.Threshold
+			reason = fmt.Sprintf("error ratio %.3f exceeded threshold %v", ratio, ev.Threshold) + hungReason(hung)
 		}
 	case factorLatency:
-		// check if threshold in milliseconds is reached and trip
-		hist, err := c.metrics.LatencyHistogram()
+		// check if the latency at the configured quantile exceeds the threshold and trip
+		unit := float64(c.Latency.unit())
+		threshold := c.latencyThreshold()
+		n := c.metrics.totalCount()
+		ev.Requests, ev.Hung = n+hung, hung
+		ev.Threshold = float64(threshold) / unit
+		quantile, ok := c.Latency.guardedQuantile(ev.Requests)
+		if !ok {
+			ev.Decision = decisionTooFewRequests
+			break
+		}
+		l, err := c.latencyWithHung(quantile, n, hungAges)
 		if err != nil {
 			return
 		}
-
-		l := hist.LatencyAtQuantile(c.Threshold)
-		if l.Nanoseconds()/int64(time.Millisecond) > int64(c.Threshold) {
+		ev.Value = float64(l) / unit
+		atomic.StoreUint64(&c.lastValue, math.Float64bits(ev.Value))
+		if c.Latency.Hedge > 0 {
+			var hedging int32
+			if l > time.Duration(c.Latency.Hedge) {
+				hedging = 1
+			}
+			atomic.StoreInt32(&c.hedging, hedging)
+		}
+		if l > threshold {
 			isTripped = true
+			severity = float64(l) / float64(threshold)
+			reason = fmt.Sprintf("p%v latency %s exceeded threshold %s", c.Latency.Quantile, l, threshold)
+			if quantile != c.Latency.Quantile {
+				reason += fmt.Sprintf(" (read at p%.3g of %d samples)", quantile, ev.Requests)
+			}
+			reason += hungReason(hung)
 		}
 	case factorStatusCodeRatio:
+		n := c.metrics.totalCount()
+		ev.Requests, ev.Hung = n+hung, hung
+		ev.Threshold = c.ratioThreshold(c.StatusRatio.Threshold)
+		if !ratiosReady {
+			ev.Decision = decisionWindowNotFull
+			break
+		}
+		if ev.Requests < c.StatusRatio.MinRequests {
+			ev.Decision = decisionTooFewRequests
+			break
+		}
 		// check ratio of error status codes of sliding window, threshold for comparison should be < 1.0 i.e. .5 = 50th percentile
-		if c.metrics.ResponseCodeRatio(500, 600, 0, 600) > c.Threshold {
+		var ratio float64
+		if c.weights != nil || len(c.StatusRatio.Of) > 0 {
+			ratio = c.StatusRatio.ratio(c.metrics.statusCodeCounts(), c.weights)
+		} else {
+			ratio = c.metrics.responseCodeRatio(c.StatusRatio.Range[0], c.StatusRatio.Range[1]+1, 0, 600)
+		}
+		ratio = presumeFailures(ratio, n, hung)
+		ev.Value = ratio
+		atomic.StoreUint64(&c.lastValue, math.Float64bits(ratio))
+		if ratio > ev.Threshold {
 			isTripped = true
+			severity = ratio / ev.Threshold
+			reason = fmt.Sprintf("status ratio %.3f exceeded threshold %v", ratio, ev.Threshold) + hungReason(hung)
+		}
+	case factorDeadlineMissRatio:
+		ev.Requests = c.deadlines.count()
+		ev.Threshold = c.ratioThreshold(c.DeadlineMissRatio.Threshold)
+		if !ratiosReady {
+			ev.Decision = decisionWindowNotFull
+			break
 		}
+		if ev.Requests < c.DeadlineMissRatio.MinRequests {
+			ev.Decision = decisionTooFewRequests
+			break
+		}
+		// check ratio of requests that finished after their deadline, threshold for comparison should be < 1.0
+		ratio := c.deadlines.ratio()
+		ev.Value = ratio
+		atomic.StoreUint64(&c.lastValue, math.Float64bits(ratio))
+		if ratio > ev.Threshold {
+			isTripped = true
+			severity = ratio / ev.Threshold
+			reason = fmt.Sprintf("deadline miss ratio %.3f exceeded threshold %v", ratio, ev.Threshold)
+		}
+	case factorThroughput:
+		reason = c.evaluateThroughput(&ev)
+		atomic.StoreUint64(&c.lastValue, math.Float64bits(ev.Value))
+		if reason != "" {
+			isTripped = true
+			severity = ev.Value / ev.Threshold
+		}
+	case factorCustom:
+		if !ratiosReady {
+			ev.Decision = decisionWindowNotFull
+			break
+		}
+		reason, severity = c.evaluateCustom(&ev)
+		atomic.StoreUint64(&c.lastValue, math.Float64bits(ev.Value))
+		isTripped = reason != ""
 	}
 
+	// stream resets and GOAWAYs are checked on their own, independently of the factor
+	if !isTripped && ratiosReady && c.StreamResetThreshold > 0 {
+		if ratio := c.streamResets.ratio(); ratio > c.StreamResetThreshold {
+			isTripped = true
+			severity = ratio / c.StreamResetThreshold
+			cause = ReasonStreamResets
+			reason = fmt.Sprintf("stream reset ratio %.3f exceeded threshold %v", ratio, c.StreamResetThreshold)
+			tripDuration = c.tripDuration(c.StreamResetTripDuration)
+		}
+	}
+
+	// so are error budgets, over their own periods
+	if !isTripped {
+		if b, consumed := c.exhaustedErrorBudget(); b != nil {
+			isTripped = true
+			severity = consumed
+			cause = ReasonErrorBudget
+			reason = fmt.Sprintf("%s error budget of %v over %s exhausted (%.0f%% consumed)",
+				b.Status, b.Budget, time.Duration(b.Period), 100*consumed)
+		}
+	}
+
+	var counts *WindowCounts
+	if isTripped {
+		reason = c.tripReason(cause, reason)
+		// tripping resets the window, so take its counts first
+		counts = c.metrics.windowCounts()
+	}
+	switch {
+	case !isTripped:
+	case c.maintenanceHolds(severity):
+		ev.Decision = decisionMaintenance
+	case c.coolingDown() && severity <= c.CooldownSeverity:
+		// right after closing, residual failures of requests that were
+		// queued before recovery only trip the circuit again if severe
+		ev.Decision = decisionCoolingDown
+	case c.changeLimited():
+		ev.Decision = decisionRateLimited
+	case c.trip(cause, reason, tripDuration):
+		ev.Decision = decisionTripped
+		c.guard.check()
+		go c.publish(SharedState{Open: true, Until: time.Now().Add(tripDuration), Reason: reason, Counts: counts})
+		c.propagateTrip(reason, tripDuration)
+	default:
+		ev.Decision = decisionAlreadyOpen
+	}
 	if isTripped {
-		c.metrics.Reset()
-		atomic.AddInt32(&c.tripped, 1)
+		ev.Reason = reason
+	}
+	c.trace.record(ev)
+
+	rate, pressure := 1.0, 0.0
+	if ev.Decision != decisionWindowNotFull && ev.Decision != decisionTooFewRequests {
+		rate = admissionRate(ev.Value, ev.Threshold, c.AdmissionStart)
+		if ev.Threshold > 0 {
+			pressure = ev.Value / ev.Threshold
+		}
+	}
+	atomic.StoreUint64(&c.admission, math.Float64bits(rate))
+	atomic.StoreUint64(&c.pressure, math.Float64bits(pressure))
+}
+
+// coolingDown returns whether the circuit closed less than
+// cooldown_after_close ago.
+func (c *Simple) coolingDown() bool {
+	if c.CooldownAfterClose == 0 {
+		return false
+	}
+	closedAt := atomic.LoadInt64(&c.closedAt)
+	return closedAt >= 0 && c.clock()-time.Duration(closedAt) < time.Duration(c.CooldownAfterClose)
+}
+
+// trip opens the circuit for the given duration, unless it is already
+// open. It returns whether the circuit was opened.
+func (c *Simple) trip(cause Reason, reason string, d time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if atomic.LoadInt32(&c.tripped) == 1 {
+		return false
+	}
+
+	c.resetMetrics()
+	atomic.StoreInt32(&c.tripped, 1)
+	atomic.StoreInt64(&c.trippedAt, int64(c.clock()))
+	c.closed = make(chan struct{})
+	c.notifyTransition(c.history.record(StateOpen, cause, reason, c.maintenanceID()))
+	c.changedLocked()
+	c.openUntil = time.Now().Add(d)
+	c.openedFor = reason
+
+	// wait TripDuration amount before allowing operations to resume.
+	c.scheduleCloseLocked(d)
+	return true
+}
+
+// scheduleCloseLocked closes the circuit after d, or once
+// min_state_interval allows it, unless the close becomes stale
+// in the meantime. c.mu must be held.
+func (c *Simple) scheduleCloseLocked(d time.Duration) {
+	c.generation++
+	gen := c.generation
+	c.after(d, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if gen != c.generation {
+			return
+		}
+		if wait := c.changeWaitLocked(); wait > 0 {
+			c.limitLocked("close")
+			c.openUntil = time.Now().Add(wait)
+			c.scheduleCloseLocked(wait)
+			return
+		}
+		c.closeLocked(ReasonTripElapsed, "trip duration elapsed")
+	})
+}
 
-		// wait TripDuration amount before allowing operations to resume.
-		t := time.NewTimer(time.Duration(c.Config.TripDuration))
-		<-t.C
+// after calls f once d elapsed on the breaker's clock.
+func (c *Simple) after(d time.Duration, f func()) {
+	if c.afterFunc != nil {
+		c.afterFunc(d, f)
+		return
+	}
+	time.AfterFunc(d, f)
+}
 
-		atomic.AddInt32(&c.tripped, -1)
+// changeLimited reports whether the closed circuit may not trip
+// yet because it changed state less than min_state_interval ago,
+// and if so, counts the held back change.
+func (c *Simple) changeLimited() bool {
+	if c.MinStateInterval == 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if atomic.LoadInt32(&c.tripped) == 1 || c.changeWaitLocked() == 0 {
+		return false
+	}
+	c.limitLocked("trip")
+	return true
+}
+
+// changeWaitLocked returns how much longer the state must be kept
+// to honor min_state_interval. c.mu must be held.
+func (c *Simple) changeWaitLocked() time.Duration {
+	if c.MinStateInterval == 0 || c.changedAt < 0 {
+		return 0
+	}
+	wait := time.Duration(c.MinStateInterval) - (c.clock() - c.changedAt)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// limitLocked counts a held back state change, logging only the
+// first one per state so that flapping does not flood the log.
+// c.mu must be held.
+func (c *Simple) limitLocked(change string) {
+	atomic.AddInt64(&c.limited, 1)
+	if c.limitLogged {
+		return
+	}
+	c.limitLogged = true
+	c.logger.Info("state change held back by min_state_interval",
+		zap.String("name", c.Name),
+		zap.String("change", change),
+		zap.Duration("min_state_interval", time.Duration(c.MinStateInterval)))
+}
+
+// changedLocked notes that the state just changed. c.mu must be held.
+func (c *Simple) changedLocked() {
+	c.changedAt = c.clock()
+	c.limitLogged = false
+}
+
+// closeLocked closes the circuit if it is open. c.mu must be held.
+func (c *Simple) closeLocked(cause Reason, reason string) {
+	if atomic.LoadInt32(&c.tripped) == 0 {
+		return
+	}
+	c.generation++ // invalidate any pending timer
+	atomic.StoreInt32(&c.tripped, 0)
+	atomic.StoreInt64(&c.closedAt, int64(c.clock()))
+	close(c.closed)
+	c.notifyTransition(c.history.record(StateClosed, cause, reason, c.maintenanceID()))
+	c.changedLocked()
+}
+
+// Reset closes the circuit immediately, without waiting for the
+// trip duration to elapse, for example once the backend is known
+// to be fixed. If clearMetrics is true, the sliding window is
+// cleared as well so that failures recorded before the reset do
+// not trip the circuit again right away. With a storage, the
+// circuit is closed on all instances sharing it.
+func (c *Simple) Reset(clearMetrics bool) {
+	c.reset(clearMetrics, ReasonReset, "reset")
+}
+
+// reset is Reset, recording cause and reason in the history.
+func (c *Simple) reset(clearMetrics bool, cause Reason, reason string) {
+	c.mu.Lock()
+	if clearMetrics {
+		c.resetMetrics()
+	}
+	c.closeLocked(cause, reason)
+	c.mu.Unlock()
+	c.publish(SharedState{Reason: reason, Counts: c.metrics.windowCounts()})
+}
+
+func (c *Simple) resetMetrics() {
+	if c.WindowOf == "" {
+		c.metrics.reset()
+	}
+	c.deadlines.reset()
+	c.streamResets.reset()
+	if c.throughput != nil {
+		c.throughput.reset()
 	}
 }
 
 // Config represents the configuration of a circuit breaker.
 type Config struct {
-	// The threshold over sliding window that would trip the circuit breaker
+	// An optional name for this circuit breaker. Named breakers
+	// can be inspected through the admin API at /circuit-breakers/.
+	Name string `json:"name,omitempty"`
+	// The name of a built-in set of settings to start from: one of
+	// aggressive, conservative, or latency_sensitive. Any field set
+	// alongside the preset overrides the preset's value.
+	Preset string `json:"preset,omitempty"`
+	// The threshold over sliding window that would trip the circuit breaker.
+	//
+	// Deprecated: set the threshold in the block of the selected
+	// factor instead. For the latency factor, this value was used
+	// both as the quantile and as the latency in the unit of the
+	// latency block, milliseconds by default.
 	Threshold float64 `json:"threshold,omitempty"`
-	// Possible values: latency, error_ratio, and status_ratio. It
-	// defaults to latency.
+	// Which factor trips the circuit. Possible values: latency,
+	// error_ratio, status_ratio, deadline_miss_ratio, throughput, and
+	// custom. If unset and exactly one factor block is configured, that factor
+	// is used. The deadline_miss_ratio factor only sees requests that
+	// carry a deadline, which requires the handler variant of the
+	// breaker.
 	Factor string `json:"factor,omitempty"`
+	// Settings of the latency factor.
+	Latency *LatencyFactor `json:"latency,omitempty"`
+	// Settings of the error_ratio factor, which is based on the
+	// share of 502 and 504 responses.
+	ErrorRatio *RatioFactor `json:"error_ratio,omitempty"`
+	// Settings of the status_ratio factor.
+	StatusRatio *StatusRatioFactor `json:"status_ratio,omitempty"`
+	// Settings of the deadline_miss_ratio factor.
+	DeadlineMissRatio *RatioFactor `json:"deadline_miss_ratio,omitempty"`
+	// Settings of the throughput factor.
+	Throughput *ThroughputFactor `json:"throughput,omitempty"`
+	// The module of the custom factor, a third-party trip condition
+	// in the circuit_breaker.factors namespace.
+	CustomFactorRaw json.RawMessage `json:"custom,omitempty" caddy:"namespace=circuit_breaker.factors inline_key=name"`
+	// The custom factor, for breakers created with New. It is set
+	// from CustomFactorRaw when provisioned by Caddy.
+	CustomFactor Factor `json:"-"`
 	// How long to wait after the circuit is tripped before allowing operations to resume.
 	// The default is 5s.
 	TripDuration caddy.Duration `json:"trip_duration,omitempty"`
+	// Optional source of a threshold and trip duration to use instead
+	// of the configured ones, re-read periodically.
+	Dynamic *DynamicThresholds `json:"dynamic,omitempty"`
+	// Optional weights applied to status codes when computing the
+	// status_ratio factor. Keys are either exact status codes ("503")
+	// or classes ("5xx"); exact codes take precedence over classes.
+	// A weighted response in the range of status_ratio counts that
+	// many times towards the error side of the ratio, so a weight of 0
+	// ignores it entirely. Codes in the range without a weight count
+	// as 1; codes outside of it count as 0, whatever their weight.
+	// Note that weights above 1 allow the ratio to exceed 1.0.
+	StatusWeights map[string]float64 `json:"status_weights,omitempty"`
+	// An optional latency in the unit of the latency block,
+	// milliseconds by default, lower than threshold,
+	// above which the breaker signals that requests should be
+	// hedged. Only valid with the latency factor.
+	//
+	// Deprecated: use the hedge field of the latency block instead.
+	HedgeThreshold float64 `json:"hedge_threshold,omitempty"`
+	// An optional ratio of requests ending in an HTTP/2 stream reset
+	// (RST_STREAM) or GOAWAY from the upstream above which the circuit
+	// trips, regardless of factor. These usually mean the backend is
+	// restarting or shedding load. Errors are only visible to the
+	// handler variant of the breaker.
+	StreamResetThreshold float64 `json:"stream_reset_threshold,omitempty"`
+	// How long to wait after the circuit is tripped by stream resets
+	// before allowing operations to resume. Defaults to trip_duration.
+	StreamResetTripDuration caddy.Duration `json:"stream_reset_trip_duration,omitempty"`
+	// If true, ratio factors are only evaluated once the sliding
+	// window has been collecting samples for its full duration since
+	// the breaker was provisioned, tripped, or reset. This prevents
+	// the first few requests from tripping the circuit on their own.
+	RequireFullWindow bool `json:"require_full_window,omitempty"`
+	// For how long after the circuit closes to keep it from tripping
+	// again, unless the breach is severe. This avoids flip-flopping
+	// when failures of requests queued before recovery land right
+	// after the circuit closed. The default is 0 (no cooldown).
+	CooldownAfterClose caddy.Duration `json:"cooldown_after_close,omitempty"`
+	// During the cooldown, how many times its threshold a factor
+	// must be to trip the circuit anyway. The default is 2.
+	CooldownSeverity float64 `json:"cooldown_severity,omitempty"`
+	// What to do with samples of requests that started before the
+	// circuit last tripped but finished after, such as a flood of
+	// late timeouts from before the trip: "window" records them like
+	// any other (the default); "stale" keeps them out of the window,
+	// counting them in a separate bucket reported in the status;
+	// "discard" drops them. Either keeps them from distorting the
+	// decision whether the backend recovered. Error budgets, upstream
+	// states, and candidates still see every sample.
+	LateSamples string `json:"late_samples,omitempty"`
+	// If set, requests still in flight after this multiple of the
+	// window's p99 latency count as presumptive failures of the
+	// error_ratio, status_ratio and latency factors before they
+	// complete, at their age so far for latency, so that hang-style
+	// outages are detected without waiting for the requests to time
+	// out. The last known p99 is used while no requests completed.
+	// Only the handler variant sees requests in flight. Off by default.
+	HungRequestMultiple float64 `json:"hung_request_multiple,omitempty"`
+	// If true, the breaker also keeps a separate state for each
+	// upstream, evaluated with the same settings, based on the
+	// upstream address recorded with each request. The state of
+	// an upstream does not affect the breaker as a whole; it is
+	// reported through the admin API and UpstreamOK, and enforced by
+	// the reverse proxy's circuit_breaker selection policy. Upstreams
+	// are only known to the handler variant of the breaker.
+	PerUpstream bool `json:"per_upstream,omitempty"`
+	// How long the state of an upstream of a per_upstream breaker is
+	// kept after the upstream was last seen, for upstreams that come
+	// and go such as those from SRV or A lookups. States are keyed by
+	// dial address, so each resolved address is tracked on its own.
+	// States of upstreams whose circuit is open are kept until it
+	// closes. The default is 10m.
+	UpstreamTTL caddy.Duration `json:"upstream_ttl,omitempty"`
+	// If true, the states of upstreams of a per_upstream breaker that
+	// were removed from or added to the pool are dropped once the
+	// change is seen, on a config reload or with dynamic upstreams, so
+	// a new backend at a reused address does not inherit stale open
+	// state; open states of unchanged upstreams are kept. The pool is
+	// seen through the circuit_breaker selection policy or SetUpstreams.
+	ResetChangedUpstreams bool `json:"reset_changed_upstreams,omitempty"`
+	// How long an upstream of a per_upstream breaker is warming up
+	// after its address is first seen, as when a new instance is
+	// started on scale-up. During the warmup, its failures count with
+	// a weight that grows linearly from 0 to 1, so that its slow first
+	// requests do not open its circuit right away. Addresses seen
+	// again after the upstream TTL are warmed up anew. Off by default.
+	UpstreamWarmup caddy.Duration `json:"upstream_warmup,omitempty"`
+	// How many seconds of per-second request counts, error counts and
+	// 95th percentile latencies to keep for graphing, retrievable
+	// through the admin API. The default is 0 (disabled); 60 is a
+	// good choice for sparklines.
+	TimeSeries int `json:"time_series,omitempty"`
+	// An optional storage through which the state of this breaker
+	// is shared with other Caddy instances using the same storage:
+	// when one instance trips or resets the circuit, all of them do.
+	// Requires a name, which is the key the state is shared under.
+	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=circuit_breaker.storage inline_key=backend"`
+	// Request matcher sets, any of which lets a request through
+	// regardless of the state of the circuit, such as health probes,
+	// or requests with a priority header marking them as critical.
+	// Only integrations that see the request, such as the handler,
+	// apply them; see OKForRequest. Their outcomes are still recorded.
+	BypassRaw caddyhttp.RawMatcherSets `json:"bypass,omitempty" caddy:"namespace=http.matchers"`
+	// The maximum number of distinct status codes tracked separately
+	// in the sliding window. Once reached, any other status code is
+	// counted under the first code of its class, such as 500 for 503,
+	// and a warning is logged; exact status_weights of such codes no
+	// longer apply. This bounds memory use if upstreams return many
+	// unusual status codes. The default is 64.
+	CardinalityBudget int `json:"cardinality_budget,omitempty"`
+	// Where the suggested admission rate starts falling below 1.0, as
+	// a fraction of the factor's threshold; see AdmissionRate. The
+	// default is 0.5.
+	AdmissionStart float64 `json:"admission_start,omitempty"`
+	// If true, the time spent inside the breaker is measured, for
+	// recording a request, for factor evaluation alone, and for each
+	// OK check, and reported through the admin API with quantiles
+	// precise to within a factor of two. Measuring costs two clock
+	// reads per call.
+	MeasureOverhead bool `json:"measure_overhead,omitempty"`
+	// How many of the most recent factor evaluations to keep for
+	// debugging, with their inputs, computed value, and decision,
+	// retrievable through the admin API. Every recorded request is
+	// evaluated, so this is meant to be enabled while investigating
+	// why the circuit did or did not trip. The default is 0 (disabled).
+	Trace int `json:"trace,omitempty"`
+	// How many of the requests the breaker rejected to keep a sample
+	// of, with their method, host, path, client address, and the
+	// reason. They are retrievable through the admin API, to show
+	// after an incident who was turned away and when. The default is
+	// 0 (disabled).
+	RejectedSamples int `json:"rejected_samples,omitempty"`
+	// The fraction of rejected requests to sample if rejected_samples
+	// is set, which keeps sampling cheap while many requests are
+	// rejected. The default is 0.01.
+	RejectedSampleRate float64 `json:"rejected_sample_rate,omitempty"`
+	// How many of the most recent state transitions to keep in
+	// memory for inspection. The default is 32.
+	HistorySize int `json:"history_size,omitempty"`
+	// The minimum time between two state changes. A trip within this
+	// time after the circuit closed is held back, and an open circuit
+	// stays open until this time passed, even if its trip duration
+	// elapsed earlier. Held back changes are counted in the admin API,
+	// and the first one per state is logged. This keeps a flapping
+	// breaker from whipsawing the load on its upstream. Resets through
+	// the API or shared storage are not limited. The default is 0
+	// (no limit).
+	MinStateInterval caddy.Duration `json:"min_state_interval,omitempty"`
+	// How long a new state must persist before its transition is sent
+	// to the clients of the state socket. Transitions in quicker
+	// succession are summarized as one event, and none is sent if the
+	// breaker ends up in the state it was last reported in, so that
+	// alerting does not get spammed while the breaker oscillates.
+	// Unlike min_state_interval, this does not affect the breaker
+	// itself. The default is 0 (every transition is sent at once).
+	NotifySettle caddy.Duration `json:"notify_settle,omitempty"`
+	// The name of another breaker whose sliding window this breaker
+	// evaluates instead of keeping its own, such as for a latency and
+	// an error policy over the same backend. Requests are recorded
+	// once, through the named breaker, and every breaker sharing its
+	// window is evaluated whenever it records, independently and with
+	// a consistent view. This breaker does not add its own requests to
+	// the window, and its trips and resets leave the window alone. The
+	// named breaker must not itself have window_of set.
+	WindowOf string `json:"window_of,omitempty"`
+	// The path of a small file, memory-mapped, that mirrors the
+	// request counters of the window, so that after a crash and
+	// restart the breaker restores the last seconds of its window
+	// and decides on them right away instead of starting blind. It
+	// is best-effort: the latest counts may be lost if the host
+	// crashes, and latency histograms are not persisted. Each breaker
+	// needs a file of its own, and a name, so that the breaker replacing
+	// it on a config reload takes the file over. Requires the buckets
+	// window_mode and a platform with mmap.
+	WindowFile string `json:"window_file,omitempty"`
+	// The path of a file with the latency quantiles of another
+	// window, such as a breaker's status exported from another
+	// instance through the admin API, that the window is seeded with
+	// when the breaker starts. A new instance joining a fleet then
+	// reads sensible latency quantiles from its first requests on,
+	// instead of judging the latency factor by the few requests it
+	// saw so far. The seeded latencies are not counted as requests,
+	// and drop out of the window after its duration, by when it
+	// holds latencies of its own. Requires the buckets window_mode
+	// and a window of the breaker's own.
+	LatencyBaseline string `json:"latency_baseline,omitempty"`
+	// The request rate per second above which the factor is no longer
+	// evaluated after every request, but at most once per evaluation
+	// interval, so that the CPU cost of the breaker stays bounded on
+	// very hot routes. A trip may then be noticed up to an interval
+	// later. Throttling ends once the rate falls below this again.
+	// The default is 0 (always evaluate after every request).
+	MaxEvaluationQPS int `json:"max_evaluation_qps,omitempty"`
+	// How often to evaluate the factor while throttled by
+	// max_evaluation_qps. The default is 100ms.
+	EvaluationInterval caddy.Duration `json:"evaluation_interval,omitempty"`
+	// An optional seed for the random source of the breaker, which
+	// makes the decisions it leaves to chance reproducible, such as in
+	// tests and simulations. The default is to seed from the time.
+	RandomSeed int64 `json:"random_seed,omitempty"`
+	// Optional labels of this breaker, such as the backend behind the
+	// routes it guards, which propagate_trip_to of other breakers can
+	// refer to.
+	Labels []string `json:"labels,omitempty"`
+	// Labels of sibling breakers that share fate with this one: when
+	// this breaker trips, every other named breaker carrying any of
+	// these labels trips too, for the same duration. A sibling that
+	// is already open, or held back by its min_state_interval, is
+	// left alone, and trips propagated to a sibling do not propagate
+	// any further.
+	PropagateTripTo []string `json:"propagate_trip_to,omitempty"`
+	// An optional failure domain of this breaker, such as the zone or
+	// cluster of its upstream. When every named breaker of a domain
+	// has its circuit tripped, which suggests the domain rather than
+	// an upstream failed, a domain event is sent on the state socket
+	// and to annotations, and the domain is reported as down in the
+	// admin API's summary.
+	FailureDomain string `json:"failure_domain,omitempty"`
+	// A link to the remediation docs of this breaker, included with
+	// its trips in logs, state events, annotations, and problem
+	// details of rejected requests, so on-call engineers land on it.
+	RunbookURL string `json:"runbook_url,omitempty"`
+	// A template of the reason recorded when the breaker trips by
+	// itself, in place of the computed one. Besides global placeholders
+	// such as {env.*}, it may use {circuit_breaker.name},
+	// {circuit_breaker.factor}, {circuit_breaker.cause},
+	// {circuit_breaker.reason} (the computed reason), and
+	// {circuit_breaker.runbook_url}. Trips shared by other instances or
+	// propagated from siblings keep the reason they were recorded with.
+	TripReason string `json:"trip_reason,omitempty"`
+	// Optional error budgets per status code or class, each over its
+	// own period, which trip the circuit when exhausted regardless of
+	// factor. The least remaining budget is reported in the admin API
+	// and, by the handler, in a placeholder.
+	ErrorBudgets []ErrorBudget `json:"error_budgets,omitempty"`
+	// If true, recorded requests are queued without taking a lock and
+	// recorded in batches by a single goroutine, rather than each by
+	// itself. This keeps the cost of recording on the request path
+	// flat when many requests complete together, such as multiplexed
+	// HTTP/2 streams, at the expense of evaluating the factor slightly
+	// later.
+	CoalesceRecords bool `json:"coalesce_records,omitempty"`
+	// How the sliding window keeps samples: "buckets", the default,
+	// counts them in buckets of a second (and latencies of ten
+	// seconds) that expire as a whole, which takes the same memory
+	// however busy the upstream is; "log" keeps every sample with its
+	// time, so that each expires exactly and ratios are exact, at
+	// about 24 bytes per sample up to log_capacity. The log suits
+	// upstreams with few but important requests.
+	WindowMode string `json:"window_mode,omitempty"`
+	// How the buckets window mode keeps latencies: "hdr", the default,
+	// in HDR histograms with quantiles precise to two significant
+	// figures; or "fixed", in fixed log-linear bins of atomic counters
+	// that latencies are recorded in without locking, for quantiles
+	// precise to about 3%. Registering quantiles in the latency block
+	// selects its own histogram instead.
+	Histogram string `json:"histogram,omitempty"`
+	// The most samples kept with window_mode log. Beyond this, the
+	// oldest samples are dropped early, and a warning is logged. The
+	// default is 10000.
+	LogCapacity int `json:"log_capacity,omitempty"`
+	// If true, the values of all factors are computed from the window,
+	// not just that of the selected one, and reported in the admin API
+	// and, once per second, in the time series, so that a switch of
+	// factors can be judged by past data before it is made.
+	ExportAllFactors bool `json:"export_all_factors,omitempty"`
 }
 
 const (
 	factorLatency = iota + 1
 	factorErrorRatio
 	factorStatusCodeRatio
-	defaultTripDuration = 5 * time.Second
+	factorDeadlineMissRatio
+	factorThroughput
+	factorCustom
+	defaultTripDuration       = 5 * time.Second
+	defaultHistorySize        = 32
+	defaultCooldownSeverity   = 2
+	defaultAdmissionStart     = 0.5
+	defaultUpstreamTTL        = 10 * time.Minute
+	defaultEvaluationInterval = 100 * time.Millisecond
+)
+
+// Possible values of Config.WindowMode.
+const (
+	windowModeBuckets = "buckets"
+	windowModeLog     = "log"
+)
+
+// Possible values of Config.Histogram.
+const (
+	histogramHDR   = "hdr"
+	histogramFixed = "fixed"
 )
 
 // typeCB handles converting a Config Factor value to the internal circuit breaker types.
 var typeCB = map[string]int32{
-	"latency":      factorLatency,
-	"error_ratio":  factorErrorRatio,
-	"status_ratio": factorStatusCodeRatio,
+	"latency":             factorLatency,
+	"error_ratio":         factorErrorRatio,
+	"status_ratio":        factorStatusCodeRatio,
+	"deadline_miss_ratio": factorDeadlineMissRatio,
+	"throughput":          factorThroughput,
+	"custom":              factorCustom,
 }
 
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*Simple)(nil)
+	_ caddy.CleanerUpper          = (*Simple)(nil)
 	_ reverseproxy.CircuitBreaker = (*Simple)(nil)
 )
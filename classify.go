@@ -0,0 +1,30 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import "strings"
+
+// isStreamReset reports whether err was caused by the upstream
+// resetting the HTTP/2 stream or sending GOAWAY. The error types
+// involved are unexported in net/http's bundled copy of http2, so
+// this matches on the messages shared by both http2 implementations.
+func isStreamReset(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "stream error:") ||
+		strings.Contains(msg, "GOAWAY")
+}
@@ -0,0 +1,112 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "circuit-breaker-soak",
+		Func:  cmdSoak,
+		Usage: "--config <path> [--phases <phases>] [--rps <n>] [--errors <ratio>] [--latency <duration>] [--seed <n>]",
+		Short: "Drives synthetic load through a circuit breaker config",
+		Long: `
+Validates the settings of a circuit breaker under realistic load before
+they reach production: synthetic request outcomes are driven through a
+breaker with the JSON config at --config, in real time, and the timeline
+of its state transitions is printed along with the counts of each phase.
+
+The load is given as phases separated by semicolons, each a duration
+followed by the settings that change from the previous phase:
+
+	--phases "1m; 30s errors=0.4 latency=300ms; 2m errors=0.01"
+
+Settings are rps, errors (the share of failed requests), status (of
+failed requests, 502 by default), and latency (the mean). The settings
+of the first phase default to the --rps, --errors and --latency flags.
+Without --phases, a single phase of one minute is run.
+
+Requests rejected by the open circuit are not recorded, as with a real
+upstream. With the same --seed, two runs produce the same load.`,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("circuit-breaker-soak", flag.ExitOnError)
+			fs.String("config", "", "The file with the JSON config of the breaker")
+			fs.String("phases", "1m", "The phases of the load")
+			fs.Float64("rps", 100, "The default requests per second")
+			fs.Float64("errors", 0, "The default share of failed requests")
+			fs.Duration("latency", 50*time.Millisecond, "The default mean latency")
+			fs.Int("seed", 1, "The seed of the random load")
+			return fs
+		}(),
+	})
+}
+
+func cmdSoak(fs caddycmd.Flags) (int, error) {
+	configFile := fs.String("config")
+	if configFile == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--config is required")
+	}
+	raw, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("reading config: %v", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("decoding config: %v", err)
+	}
+	phases, err := parseSoakPhases(fs.String("phases"), SoakPhase{
+		RPS:         fs.Float64("rps"),
+		ErrorRate:   fs.Float64("errors"),
+		ErrorStatus: defaultSoakErrorStatus,
+		Latency:     fs.Duration("latency"),
+	})
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--phases: %v", err)
+	}
+
+	result, err := Soak(cfg, phases, int64(fs.Int("seed")))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	printSoakResult(phases, result)
+	return caddy.ExitCodeSuccess, nil
+}
+
+// printSoakResult prints the timeline and phase counts of a soak test.
+func printSoakResult(phases []SoakPhase, result SoakResult) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tFROM\tTO\tCAUSE\tREASON")
+	for _, t := range result.Transitions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", t.Offset.Round(time.Millisecond), t.From, t.To, t.Cause, t.Reason)
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "PHASE\tDURATION\tRPS\tERRORS\tLATENCY\tREQUESTS\tFAILURES\tREJECTED")
+	for i, p := range phases {
+		r := result.Phases[i]
+		fmt.Fprintf(tw, "%d\t%s\t%g\t%g\t%s\t%d\t%d\t%d\n", i+1, p.Duration, p.RPS, p.ErrorRate, p.Latency, r.Requests, r.Failures, r.Rejected)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// DefaultConfig returns the documented defaults of the settings of
+// a breaker that apply whether or not they are configured. Any field
+// left unset in a config, whether provisioned by Caddy or passed to
+// New, takes its value from here. Defaults of settings within a block,
+// such as the quantile of the latency factor, only apply if the block
+// is configured and are not included.
+func DefaultConfig() Config {
+	return Config{
+		TripDuration:      caddy.Duration(defaultTripDuration),
+		CooldownSeverity:  defaultCooldownSeverity,
+		CardinalityBudget: defaultCardinalityBudget,
+		AdmissionStart:    defaultAdmissionStart,
+		UpstreamTTL:       caddy.Duration(defaultUpstreamTTL),
+		HistorySize:       defaultHistorySize,
+	}
+}
+
+// applyDefaults sets the unset fields of cfg that have a default.
+func (cfg *Config) applyDefaults() {
+	def := DefaultConfig()
+	if cfg.TripDuration == 0 {
+		cfg.TripDuration = def.TripDuration
+	}
+	if cfg.CooldownSeverity == 0 {
+		cfg.CooldownSeverity = def.CooldownSeverity
+	}
+	if cfg.CardinalityBudget == 0 {
+		cfg.CardinalityBudget = def.CardinalityBudget
+	}
+	if cfg.AdmissionStart == 0 {
+		cfg.AdmissionStart = def.AdmissionStart
+	}
+	if cfg.UpstreamTTL == 0 {
+		cfg.UpstreamTTL = def.UpstreamTTL
+	}
+	if cfg.HistorySize == 0 {
+		cfg.HistorySize = def.HistorySize
+	}
+}
+
+// DecodeConfig decodes a breaker config from JSON. In strict mode,
+// unknown fields, such as a misspelled "treshold", are an error rather
+// than ignored. Caddy itself always decodes module configs strictly;
+// this is for configs from other sources. Defaults are applied when
+// the breaker is set up, not here.
+func DecodeConfig(data []byte, strict bool) (Config, error) {
+	var cfg Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(&cfg); err != nil {
+		return Config{}, fmt.Errorf("decoding circuit breaker config: %v", err)
+	}
+	if dec.More() {
+		return Config{}, fmt.Errorf("decoding circuit breaker config: unexpected data after config")
+	}
+	return cfg, nil
+}
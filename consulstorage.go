@@ -0,0 +1,265 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(ConsulStorage{})
+}
+
+// ConsulStorage is a Storage backed by the key/value store of a
+// Consul cluster. Updates use Consul's check-and-set on the modify
+// index of the key, and watches use blocking queries, so no leader
+// election between Caddy instances is needed.
+type ConsulStorage struct {
+	// The address of the Consul HTTP API. The default is
+	// http://127.0.0.1:8500.
+	Address string `json:"address,omitempty"`
+	// An optional ACL token.
+	Token string `json:"token,omitempty"`
+	// An optional datacenter to use instead of the agent's own.
+	Datacenter string `json:"datacenter,omitempty"`
+	// A prefix for all keys, such as "caddy/". The default is none.
+	Prefix string `json:"prefix,omitempty"`
+
+	base   *url.URL
+	client *http.Client
+}
+
+// CaddyModule returns the Caddy module information.
+func (ConsulStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "circuit_breaker.storage.consul",
+		New: func() caddy.Module { return new(ConsulStorage) },
+	}
+}
+
+// Provision sets up the storage.
+func (s *ConsulStorage) Provision(ctx caddy.Context) error {
+	if s.Address == "" {
+		s.Address = defaultConsulAddress
+	}
+	base, err := url.Parse(s.Address)
+	if err != nil {
+		return fmt.Errorf("parsing address: %v", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return fmt.Errorf("address must be an http or https URL: %s", s.Address)
+	}
+	s.base = base
+	// no client timeout: blocking queries are bounded by their
+	// wait parameter and all requests by their context
+	s.client = new(http.Client)
+	return nil
+}
+
+// consulKVPair is an entry of the response to a KV read.
+type consulKVPair struct {
+	ModifyIndex uint64
+	Value       []byte // base64 in JSON, decoded by encoding/json
+}
+
+// Get implements Storage.
+func (s *ConsulStorage) Get(ctx context.Context, key string) (SharedState, error) {
+	state, _, err := s.get(ctx, key, 0)
+	return state, err
+}
+
+// get reads key. If index is not 0, it performs a blocking query that
+// returns once the key changed after index or the wait time elapsed.
+// It also returns the index to use for the next blocking query.
+func (s *ConsulStorage) get(ctx context.Context, key string, index uint64) (SharedState, uint64, error) {
+	q := url.Values{}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", consulWait)
+	}
+	resp, err := s.do(ctx, http.MethodGet, key, q, nil)
+	if err != nil {
+		return SharedState{}, 0, err
+	}
+	defer resp.Body.Close()
+
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if resp.StatusCode == http.StatusNotFound {
+		return SharedState{}, next, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return SharedState{}, 0, consulError(resp)
+	}
+
+	var pairs []consulKVPair
+	if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return SharedState{}, 0, fmt.Errorf("decoding response: %v", err)
+	}
+	if len(pairs) == 0 {
+		return SharedState{}, next, nil
+	}
+	state, err := decodeSharedState(pairs[0].Value)
+	if err != nil {
+		return SharedState{}, 0, fmt.Errorf("decoding state of %s: %v", key, err)
+	}
+	state.Version = pairs[0].ModifyIndex
+	return state, next, nil
+}
+
+// CompareAndSet implements Storage. A version of 0 only
+// stores the state if the key does not exist yet.
+func (s *ConsulStorage) CompareAndSet(ctx context.Context, key string, version uint64, state SharedState) (bool, error) {
+	state.Version = 0
+	body, err := state.MarshalBinary()
+	if err != nil {
+		return false, err
+	}
+	q := url.Values{"cas": {strconv.FormatUint(version, 10)}}
+	resp, err := s.do(ctx, http.MethodPut, key, q, body)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, consulError(resp)
+	}
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(result)) == "true", nil
+}
+
+// Watch implements Storage.
+func (s *ConsulStorage) Watch(ctx context.Context, key string) (<-chan SharedState, error) {
+	state, index, err := s.get(ctx, key, 0)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan SharedState)
+	go func() {
+		defer close(out)
+		last := state.Version
+		for {
+			select {
+			case out <- state:
+			case <-ctx.Done():
+				return
+			}
+			for {
+				var next uint64
+				state, next, err = s.get(ctx, key, index)
+				if err != nil {
+					return
+				}
+				// an index that goes backwards means it was reset
+				// and must not be used for the next query
+				if next < index {
+					next = 0
+				}
+				index = next
+				if state.Version != last {
+					last = state.Version
+					break
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (s *ConsulStorage) do(ctx context.Context, method, key string, q url.Values, body []byte) (*http.Response, error) {
+	u := *s.base
+	u.Path = path.Join("/", u.Path, "v1/kv", s.Prefix, key)
+	if s.Datacenter != "" {
+		q.Set("dc", s.Datacenter)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if s.Token != "" {
+		req.Header.Set("X-Consul-Token", s.Token)
+	}
+	return s.client.Do(req)
+}
+
+func consulError(resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("consul: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// UnmarshalCaddyfile sets up the storage from Caddyfile tokens. Syntax:
+//
+//	storage consul {
+//	    address    <url>
+//	    token      <token>
+//	    datacenter <name>
+//	    prefix     <prefix>
+//	}
+func (s *ConsulStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var dest *string
+			switch d.Val() {
+			case "address":
+				dest = &s.Address
+			case "token":
+				dest = &s.Token
+			case "datacenter":
+				dest = &s.Datacenter
+			case "prefix":
+				dest = &s.Prefix
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+			if !d.AllArgs(dest) {
+				return d.ArgErr()
+			}
+		}
+	}
+	return nil
+}
+
+const (
+	defaultConsulAddress = "http://127.0.0.1:8500"
+	consulWait           = "5m"
+)
+
+// Interface guards
+var (
+	_ Storage               = (*ConsulStorage)(nil)
+	_ caddy.Provisioner     = (*ConsulStorage)(nil)
+	_ caddyfile.Unmarshaler = (*ConsulStorage)(nil)
+)
@@ -0,0 +1,175 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// CorrelationGuard suppresses enforcement by all circuit breakers
+// when many named breakers trip at about the same time. That usually
+// points to a problem on this host or its network rather than with
+// the upstreams, and opening every circuit would only make it worse.
+type CorrelationGuard struct {
+	// How many named breakers must have tripped within the window
+	// for the guard to engage. The default is 3.
+	MinBreakers int `json:"min_breakers,omitempty"`
+	// The share of all named breakers that must have tripped within
+	// the window for the guard to engage. The default is 0.5.
+	Ratio float64 `json:"ratio,omitempty"`
+	// How close together the trips must be. The default is 10s.
+	Window caddy.Duration `json:"window,omitempty"`
+	// How long enforcement stays suppressed once the guard engages.
+	// Further correlated trips extend it. The default is 1m.
+	Hold caddy.Duration `json:"hold,omitempty"`
+
+	mu     sync.Mutex
+	until  time.Time
+	since  time.Time // when the current hold began, zero if none
+	reason string    // of the current hold
+	logger *zap.Logger
+}
+
+func (g *CorrelationGuard) provision(logger *zap.Logger) error {
+	if g.MinBreakers < 0 {
+		return fmt.Errorf("min_breakers must not be negative")
+	}
+	if g.Ratio < 0 || g.Ratio > 1 {
+		return fmt.Errorf("ratio must be between 0 and 1")
+	}
+	if g.MinBreakers == 0 {
+		g.MinBreakers = defaultGuardMinBreakers
+	}
+	if g.Ratio == 0 {
+		g.Ratio = defaultGuardRatio
+	}
+	if g.Window == 0 {
+		g.Window = caddy.Duration(defaultGuardWindow)
+	}
+	if g.Hold == 0 {
+		g.Hold = caddy.Duration(defaultGuardHold)
+	}
+	g.logger = logger
+	return nil
+}
+
+// suppressing returns whether breakers should currently let all
+// requests through regardless of their state.
+func (g *CorrelationGuard) suppressing() bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return time.Now().Before(g.until)
+}
+
+// check is called after a breaker trips. It counts the named breakers
+// that tripped within the window and engages the guard if there are
+// enough of them, emitting a correlated failure event. Another event
+// is emitted once the hold ends.
+func (g *CorrelationGuard) check() {
+	if g == nil {
+		return
+	}
+	now := time.Now()
+	var total int
+	var recent []string
+	for _, name := range breakerNames() {
+		c, ok := lookupBreaker(name)
+		if !ok {
+			continue
+		}
+		total++
+		state, since := c.history.current()
+		if state == StateOpen && now.Sub(since) <= time.Duration(g.Window) {
+			recent = append(recent, name)
+		}
+	}
+	if len(recent) < g.MinBreakers || float64(len(recent)) < g.Ratio*float64(total) {
+		return
+	}
+
+	g.mu.Lock()
+	engaged := !g.since.IsZero()
+	g.until = now.Add(time.Duration(g.Hold))
+	until := g.until
+	if !engaged {
+		g.since = now
+		g.reason = fmt.Sprintf("%d of %d named breakers tripped within %v: %s",
+			len(recent), total, time.Duration(g.Window), strings.Join(recent, ", "))
+	}
+	reason := g.reason
+	g.mu.Unlock()
+	time.AfterFunc(time.Duration(g.Hold), func() { g.release(until) })
+
+	if engaged {
+		return
+	}
+	if g.logger != nil {
+		g.logger.Warn("correlated failure: suppressing circuit breakers",
+			zap.Strings("tripped", recent),
+			zap.Int("breakers", total),
+			zap.Duration("hold", time.Duration(g.Hold)))
+	}
+	broadcastState(StateEvent{Correlated: true, From: StateClosed, To: StateOpen, Reason: reason, Time: now})
+}
+
+// release ends the hold that lasts until until, unless a later
+// correlated trip extended it in the meantime.
+func (g *CorrelationGuard) release(until time.Time) {
+	g.mu.Lock()
+	if !g.until.Equal(until) || g.since.IsZero() {
+		g.mu.Unlock()
+		return
+	}
+	since := g.since
+	g.since, g.reason = time.Time{}, ""
+	g.mu.Unlock()
+
+	now := time.Now()
+	if g.logger != nil {
+		g.logger.Info("correlated failure over: enforcing circuit breakers again",
+			zap.Duration("suppressed_for", now.Sub(since)))
+	}
+	broadcastState(StateEvent{Correlated: true, From: StateOpen, To: StateClosed, Reason: "hold of the correlation guard ended", Time: now})
+}
+
+// event returns the event of the current hold, if the guard is engaged,
+// for clients of the state stream that connect later.
+func (g *CorrelationGuard) event() (StateEvent, bool) {
+	if g == nil {
+		return StateEvent{}, false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.since.IsZero() {
+		return StateEvent{}, false
+	}
+	return StateEvent{Correlated: true, To: StateOpen, Reason: g.reason, Time: g.since}, true
+}
+
+const (
+	defaultGuardMinBreakers = 3
+	defaultGuardRatio       = 0.5
+	defaultGuardWindow      = 10 * time.Second
+	defaultGuardHold        = time.Minute
+)
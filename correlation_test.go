@@ -0,0 +1,81 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestCorrelationGuardEvents(t *testing.T) {
+	g := &CorrelationGuard{MinBreakers: 3, Hold: caddy.Duration(50 * time.Millisecond)}
+	if err := g.provision(nil); err != nil {
+		t.Fatal(err)
+	}
+	events := subscribeStates()
+	defer unsubscribeStates(events)
+	for i := 0; i < 3; i++ {
+		c, err := New(Config{Name: fmt.Sprintf("test-correlated-%d", i), Factor: "error_ratio", ErrorRatio: &RatioFactor{Threshold: 0.5}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		registerBreaker(c)
+		defer c.Cleanup()
+		c.trip(ReasonThreshold, "test", time.Minute)
+	}
+	g.check()
+
+	open := nextCorrelatedEvent(t, events)
+	if open.To != StateOpen || open.Breaker != "" || open.Reason == "" {
+		t.Fatalf("engaging the guard sent %+v, want a correlated open event with a reason", open)
+	}
+	if ev, ok := g.event(); !ok || ev.To != StateOpen {
+		t.Fatalf("current event = %+v, %v; want it open", ev, ok)
+	}
+	if text := (&Annotations{}).grafanaAnnotation(open).Text; !strings.HasPrefix(text, "correlated failure: closed → open (") {
+		t.Fatalf("annotation text = %q", text)
+	}
+	closed := nextCorrelatedEvent(t, events)
+	if closed.From != StateOpen || closed.To != StateClosed {
+		t.Fatalf("ending the hold sent %+v, want a correlated closed event", closed)
+	}
+	if g.suppressing() {
+		t.Fatal("still suppressing after the hold ended")
+	}
+	if _, ok := g.event(); ok {
+		t.Fatal("guard still reports a current event after the hold ended")
+	}
+}
+
+// nextCorrelatedEvent returns the next correlated failure event on
+// events, skipping the transitions of breakers.
+func nextCorrelatedEvent(t *testing.T, events chan StateEvent) StateEvent {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Correlated {
+				return ev
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for a correlated failure event")
+		}
+	}
+}
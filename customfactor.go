@@ -0,0 +1,148 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// Factor is a trip condition evaluated over the sliding window of a
+// breaker, selected with the custom factor. Third parties ship their
+// own as Caddy modules in the circuit_breaker.factors namespace, or
+// set Config.CustomFactor when using New. A factor is shared by the
+// upstreams of a per_upstream breaker, so it must be safe for
+// concurrent use.
+type Factor interface {
+	// Evaluate computes the value of the factor from the window, and
+	// whether it breaches the factor's condition, which trips the
+	// circuit.
+	Evaluate(w Window) (value float64, breach bool)
+}
+
+// ThresholdFactor is implemented by factors whose value is compared
+// against a threshold. The breaker uses it to compute how severe a
+// breach is, such as for cooldown_severity and relaxed maintenance
+// windows, and the suggested admission rate. A breach of a factor
+// without a threshold is always of severity 1.
+type ThresholdFactor interface {
+	Factor
+	Threshold() float64
+}
+
+// Window is the read-only view of a breaker's sliding window that
+// factors are evaluated over. It is safe for concurrent use.
+type Window interface {
+	// Requests returns the number of requests in the window.
+	Requests() int64
+	// StatusCodes returns the number of responses per status code.
+	StatusCodes() map[int]int64
+	// NetworkErrorRatio returns the share of 502 and 504 responses.
+	NetworkErrorRatio() float64
+	// LatencyQuantile returns the latency at quantile q, between 0
+	// and 100.
+	LatencyQuantile(q float64) (time.Duration, error)
+	// Full returns whether the window spans its full length yet.
+	Full() bool
+	// Snapshot reads the request counts, status codes, rate, and the
+	// latencies at the given quantiles at the same instant. Factors
+	// combining several values should use it rather than the methods
+	// above, each of which reads the window anew.
+	Snapshot(quantiles ...float64) (WindowSnapshot, error)
+}
+
+// Requests implements Window.
+func (w *window) Requests() int64 { return w.totalCount() }
+
+// StatusCodes implements Window.
+func (w *window) StatusCodes() map[int]int64 { return w.statusCodeCounts() }
+
+// NetworkErrorRatio implements Window.
+func (w *window) NetworkErrorRatio() float64 { return w.networkErrorRatio() }
+
+// LatencyQuantile implements Window.
+func (w *window) LatencyQuantile(q float64) (time.Duration, error) { return w.latencyQuantile(q) }
+
+// Full implements Window.
+func (w *window) Full() bool { return w.full() }
+
+// provisionCustomFactor loads the module of the custom factor, if any.
+func (c *Simple) provisionCustomFactor(ctx caddy.Context) error {
+	if c.CustomFactorRaw == nil {
+		return nil
+	}
+	mod, err := ctx.LoadModule(&c.Config, "CustomFactorRaw")
+	if err != nil {
+		return fmt.Errorf("loading custom factor module: %v", err)
+	}
+	f, ok := mod.(Factor)
+	if !ok {
+		return fmt.Errorf("module %T is not a circuit breaker factor", mod)
+	}
+	c.CustomFactor = f
+	return nil
+}
+
+// evaluateCustom evaluates the custom factor into ev, and returns
+// the reason for tripping and the severity of the breach, if any.
+func (c *Simple) evaluateCustom(ev *Evaluation) (reason string, severity float64) {
+	ev.Requests = c.metrics.totalCount()
+	if t, ok := c.CustomFactor.(ThresholdFactor); ok {
+		ev.Threshold = t.Threshold()
+	}
+	value, breach := c.CustomFactor.Evaluate(c.metrics)
+	ev.Value = value
+	if !breach {
+		return "", 0
+	}
+	severity = 1
+	if ev.Threshold > 0 {
+		severity = value / ev.Threshold
+	}
+	return fmt.Sprintf("custom factor %s value %.3f breached", c.customFactorName(), value), severity
+}
+
+// customFactorName returns the module name of the custom factor, or
+// its Go type if it was not loaded as a module.
+func (c *Simple) customFactorName() string {
+	if mod, ok := c.CustomFactor.(caddy.Module); ok {
+		return mod.CaddyModule().ID.Name()
+	}
+	return fmt.Sprintf("%T", c.CustomFactor)
+}
+
+// unmarshalCustomFactor parses the factor module named by the current
+// token, along with its options, into the JSON of a factor module.
+func unmarshalCustomFactor(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	name := d.Val()
+	modInfo, err := caddy.GetModule("circuit_breaker.factors." + name)
+	if err != nil {
+		return nil, d.Errf("getting factor module '%s': %v", name, err)
+	}
+	mod := modInfo.New()
+	unm, ok := mod.(caddyfile.Unmarshaler)
+	if !ok {
+		return nil, d.Errf("factor module '%s' is not a Caddyfile unmarshaler", name)
+	}
+	if err := unm.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+		return nil, err
+	}
+	return caddyconfig.JSONModuleObject(mod, "name", name, nil), nil
+}
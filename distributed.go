@@ -0,0 +1,142 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// distributed shares the state of a breaker through a Storage: local
+// trips and resets are published, and state published by other
+// instances is applied locally.
+type distributed struct {
+	storage Storage
+	key     string
+	origin  string // identifies this breaker in the states it stores
+	cancel  context.CancelFunc
+}
+
+func (c *Simple) startDistributed(storage Storage) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.shared = &distributed{
+		storage: storage,
+		key:     storageKeyPrefix + c.Name,
+		origin:  fmt.Sprintf("%s/%d", instanceID, atomic.AddUint64(&sharedBreakers, 1)),
+		cancel:  cancel,
+	}
+	go c.watchShared(ctx)
+}
+
+func (c *Simple) stopDistributed() {
+	if c.shared != nil {
+		c.shared.cancel()
+	}
+}
+
+// publish stores state for other instances, retrying if another
+// instance stored a different state at the same time. An open circuit
+// is not overwritten by another open circuit that closes earlier.
+func (c *Simple) publish(state SharedState) {
+	if c.shared == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+	defer cancel()
+
+	state.Origin = c.shared.origin
+	for i := 0; i < maxPublishAttempts; i++ {
+		current, err := c.shared.storage.Get(ctx, c.shared.key)
+		if err != nil {
+			c.logger.Error("loading shared circuit state", zap.String("key", c.shared.key), zap.Error(err))
+			return
+		}
+		if state.Open && current.Open && !current.Until.Before(state.Until) {
+			return
+		}
+		ok, err := c.shared.storage.CompareAndSet(ctx, c.shared.key, current.Version, state)
+		if err != nil {
+			c.logger.Error("storing shared circuit state", zap.String("key", c.shared.key), zap.Error(err))
+			return
+		}
+		if ok {
+			return
+		}
+	}
+	c.logger.Warn("giving up storing shared circuit state after conflicting writes", zap.String("key", c.shared.key))
+}
+
+// watchShared applies state stored by other instances until ctx is done,
+// and starts watching again after a short pause whenever the watch fails.
+func (c *Simple) watchShared(ctx context.Context) {
+	for {
+		states, err := c.shared.storage.Watch(ctx, c.shared.key)
+		if err != nil {
+			c.logger.Error("watching shared circuit state", zap.String("key", c.shared.key), zap.Error(err))
+		} else {
+			for state := range states {
+				c.applyShared(state)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(storageRetryInterval):
+		}
+	}
+}
+
+func (c *Simple) applyShared(state SharedState) {
+	if state.Version == 0 || state.Origin == c.shared.origin {
+		return
+	}
+	reason := fmt.Sprintf("%s (from %s)", state.Reason, state.Origin)
+	if state.Open {
+		if d := time.Until(state.Until); d > 0 {
+			c.trip(ReasonShared, reason, d)
+		}
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked(ReasonShared, reason)
+}
+
+// instanceID identifies this process in shared state. Each breaker
+// sharing its state adds its own sequence number, so that the breaker
+// replacing it on a config reload applies the state it left.
+var instanceID = func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}()
+
+// sharedBreakers counts the breakers of this process that started
+// sharing their state. It is accessed atomically.
+var sharedBreakers uint64
+
+const (
+	storageKeyPrefix     = "circuit_breakers/"
+	storageTimeout       = 5 * time.Second
+	storageRetryInterval = time.Second
+	maxPublishAttempts   = 5
+)
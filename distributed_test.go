@@ -0,0 +1,73 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestMemoryStorageAcrossReload(t *testing.T) {
+	cfg := Config{
+		Name:         "test-memory-reload",
+		Factor:       "error_ratio",
+		ErrorRatio:   &RatioFactor{Threshold: 0.5},
+		TripDuration: caddy.Duration(time.Minute),
+	}
+	old, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.startDistributed(MemoryStorage{})
+	for i := 0; i < 100 && old.OK(); i++ {
+		old.RecordMetric(http.StatusBadGateway, time.Millisecond)
+	}
+	if old.OK() {
+		t.Fatal("breaker did not trip")
+	}
+	waitFor(t, func() bool {
+		state, _ := MemoryStorage{}.Get(context.Background(), storageKeyPrefix+cfg.Name)
+		return state.Open
+	})
+
+	// on reload, the new breaker starts before the old one is cleaned up
+	reloaded, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded.startDistributed(MemoryStorage{})
+	old.Cleanup()
+	defer reloaded.Cleanup()
+	waitFor(t, func() bool { return !reloaded.OK() })
+	if h := reloaded.History(); len(h) != 1 || h[0].Cause != ReasonShared {
+		t.Fatalf("history = %+v, want a single shared trip", h)
+	}
+}
+
+// waitFor fails the test unless cond becomes true within a second.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// failureDomains tracks which failure domains are down: those all of
+// whose named breakers have their circuit tripped, which suggests the
+// zone or cluster failed rather than any one upstream.
+var failureDomains = struct {
+	sync.Mutex
+	down map[string]time.Time // since when
+}{down: make(map[string]time.Time)}
+
+// DomainSummary is the state of the breakers in a failure domain.
+type DomainSummary struct {
+	Breakers int  `json:"breakers"`
+	Open     int  `json:"open"`
+	Down     bool `json:"down"`
+}
+
+// domainSummaries returns the summary of every failure domain that
+// has named breakers.
+func domainSummaries() map[string]DomainSummary {
+	domains := make(map[string]DomainSummary)
+	for _, name := range breakerNames() {
+		c, ok := lookupBreaker(name)
+		if !ok || c.FailureDomain == "" {
+			continue
+		}
+		d := domains[c.FailureDomain]
+		d.Breakers++
+		if atomic.LoadInt32(&c.tripped) == 1 {
+			d.Open++
+		}
+		domains[c.FailureDomain] = d
+	}
+	for name, d := range domains {
+		d.Down = d.Open == d.Breakers
+		domains[name] = d
+	}
+	return domains
+}
+
+// checkFailureDomain re-evaluates the failure domain of c after it
+// changed state. When all breakers of the domain are tripped, or one
+// of them recovers after that, a domain event is sent to the state
+// subscribers, for automation to fail traffic over to another zone.
+// Breakers whose circuit the correlation guard suppresses count as
+// tripped, while draining ones, which are not, do not.
+func (c *Simple) checkFailureDomain() {
+	domain := c.FailureDomain
+	if domain == "" {
+		return
+	}
+	failureDomains.Lock()
+	defer failureDomains.Unlock()
+	d := domainSummaries()[domain]
+	since, wasDown := failureDomains.down[domain]
+	if d.Down == wasDown {
+		return
+	}
+
+	now := time.Now()
+	ev := StateEvent{Domain: domain, Time: now}
+	if d.Down {
+		failureDomains.down[domain] = now
+		ev.From, ev.To = StateClosed, StateOpen
+		ev.Reason = fmt.Sprintf("all %d breakers of failure domain %s are open", d.Breakers, domain)
+		c.logger.Warn("failure domain down",
+			zap.String("domain", domain),
+			zap.Int("breakers", d.Breakers))
+	} else {
+		delete(failureDomains.down, domain)
+		ev.From, ev.To = StateOpen, StateClosed
+		ev.Reason = fmt.Sprintf("%d of %d breakers of failure domain %s are closed", d.Breakers-d.Open, d.Breakers, domain)
+		c.logger.Info("failure domain recovered",
+			zap.String("domain", domain),
+			zap.Duration("down_for", now.Sub(since)))
+	}
+	broadcastState(ev)
+}
+
+// downDomainEvents returns an event for every failure domain that is
+// down, for clients of the state stream that connect later.
+func downDomainEvents() []StateEvent {
+	failureDomains.Lock()
+	defer failureDomains.Unlock()
+	events := make([]StateEvent, 0, len(failureDomains.down))
+	for domain, since := range failureDomains.down {
+		events = append(events, StateEvent{Domain: domain, To: StateOpen, Time: since})
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Domain < events[j].Domain })
+	return events
+}
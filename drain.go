@@ -0,0 +1,101 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// Drain puts the breaker in drain mode, for example ahead of upstream
+// maintenance: new requests are rejected as if the circuit were open,
+// while requests already in flight complete. The returned channel is
+// closed, and an event is logged, once no requests are in flight
+// anymore. Only the handler variant of the breaker sees requests
+// starting, so with the reverse proxy variant the channel is closed
+// right away.
+func (c *Simple) Drain() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if atomic.LoadInt32(&c.draining) == 0 {
+		atomic.StoreInt32(&c.draining, 1)
+		c.drained = make(chan struct{})
+		c.drainedClosed = false
+		c.logger.Info("draining circuit breaker", zap.String("name", c.Name), zap.Int64("in_flight", c.InFlight()))
+		c.checkDrainedLocked()
+	}
+	return c.drained
+}
+
+// Undrain ends drain mode, letting new requests through again. The
+// channel returned by Drain is closed if it was not yet, so that
+// callers waiting on it are released.
+func (c *Simple) Undrain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if atomic.LoadInt32(&c.draining) == 0 {
+		return
+	}
+	atomic.StoreInt32(&c.draining, 0)
+	if !c.drainedClosed {
+		close(c.drained)
+		c.drainedClosed = true
+	}
+	c.logger.Info("circuit breaker undrained", zap.String("name", c.Name), zap.Int64("in_flight", c.InFlight()))
+}
+
+// Draining returns whether the breaker is in drain mode.
+func (c *Simple) Draining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// InFlight returns how many requests seen by the breaker have
+// not completed yet.
+func (c *Simple) InFlight() int64 {
+	return atomic.LoadInt64(&c.inFlight)
+}
+
+// begin marks the start of a request, returning the ID to end it with.
+func (c *Simple) begin() uint64 {
+	atomic.AddInt64(&c.inFlight, 1)
+	if c.hung != nil {
+		return c.hung.begin(c.clock())
+	}
+	return 0
+}
+
+// end marks the completion of a request started with begin.
+func (c *Simple) end(id uint64) {
+	if c.hung != nil {
+		c.hung.end(id)
+	}
+	if atomic.AddInt64(&c.inFlight, -1) == 0 && c.Draining() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.checkDrainedLocked()
+	}
+}
+
+// checkDrainedLocked signals that draining completed if there are no
+// requests in flight anymore. c.mu must be held.
+func (c *Simple) checkDrainedLocked() {
+	if atomic.LoadInt32(&c.draining) == 0 || c.drainedClosed || c.InFlight() > 0 {
+		return
+	}
+	close(c.drained)
+	c.drainedClosed = true
+	c.logger.Info("circuit breaker drained", zap.String("name", c.Name))
+}
@@ -0,0 +1,192 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// DynamicThresholds re-reads the threshold of the selected factor and
+// the trip duration from a file or a placeholder on an interval, so
+// they can be tuned without changing the Caddy config. The source
+// must contain a JSON object such as:
+//
+//	{"threshold": 0.3, "trip_duration": "10s"}
+//
+// For the latency factor, the threshold is a duration like "250ms".
+// Either field may be omitted to keep the configured value. Invalid
+// contents are logged and ignored, keeping the previous values.
+type DynamicThresholds struct {
+	// The path of a file to read.
+	File string `json:"file,omitempty"`
+	// A placeholder to resolve instead of reading a file, such as
+	// "{env.BREAKER_TUNING}".
+	Placeholder string `json:"placeholder,omitempty"`
+	// How often to re-read the source. The default is 10s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	threshold    uint64 // accessed atomically; float64 bits, latencies in ns; 0 if not set
+	tripDuration int64  // accessed atomically; 0 if not set
+	last         string
+	stop         chan struct{}
+}
+
+func (dt *DynamicThresholds) provision() error {
+	if (dt.File == "") == (dt.Placeholder == "") {
+		return fmt.Errorf("exactly one of file or placeholder is required")
+	}
+	if dt.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	if dt.Interval == 0 {
+		dt.Interval = caddy.Duration(defaultDynamicInterval)
+	}
+	return nil
+}
+
+// watchDynamic loads the dynamic thresholds now and then
+// on every interval, until stopDynamic is called.
+func (c *Simple) watchDynamic() {
+	dt := c.Dynamic
+	dt.stop = make(chan struct{})
+	c.loadDynamic()
+	go func() {
+		ticker := time.NewTicker(time.Duration(dt.Interval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.loadDynamic()
+			case <-dt.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *Simple) stopDynamic() {
+	if c.Dynamic != nil && c.Dynamic.stop != nil {
+		close(c.Dynamic.stop)
+		c.Dynamic.stop = nil
+	}
+}
+
+func (c *Simple) loadDynamic() {
+	dt := c.Dynamic
+	var raw string
+	if dt.File != "" {
+		b, err := ioutil.ReadFile(dt.File)
+		if err != nil {
+			c.logger.Warn("reading dynamic thresholds", zap.String("file", dt.File), zap.Error(err))
+			return
+		}
+		raw = string(b)
+	} else {
+		raw = caddy.NewReplacer().ReplaceAll(dt.Placeholder, "")
+	}
+	raw = strings.TrimSpace(raw)
+	if raw == dt.last {
+		return
+	}
+	dt.last = raw
+	if raw == "" {
+		atomic.StoreUint64(&dt.threshold, 0)
+		atomic.StoreInt64(&dt.tripDuration, 0)
+		return
+	}
+
+	threshold, tripDuration, err := c.parseDynamic(raw)
+	if err != nil {
+		c.logger.Warn("invalid dynamic thresholds; keeping previous values", zap.String("name", c.Name), zap.Error(err))
+		return
+	}
+	atomic.StoreUint64(&dt.threshold, math.Float64bits(threshold))
+	atomic.StoreInt64(&dt.tripDuration, int64(tripDuration))
+	c.logger.Info("loaded dynamic thresholds",
+		zap.String("name", c.Name),
+		zap.Float64("threshold", threshold),
+		zap.Duration("trip_duration", tripDuration))
+}
+
+// parseDynamic parses the contents of the dynamic source. Omitted
+// fields are returned as 0.
+func (c *Simple) parseDynamic(raw string) (float64, time.Duration, error) {
+	var fields struct {
+		Threshold    json.RawMessage `json:"threshold"`
+		TripDuration caddy.Duration  `json:"trip_duration"`
+	}
+	if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+		return 0, 0, err
+	}
+	if fields.TripDuration < 0 {
+		return 0, 0, fmt.Errorf("trip_duration must not be negative")
+	}
+
+	var threshold float64
+	if fields.Threshold != nil {
+		if c.cbFactor == factorLatency {
+			var d caddy.Duration
+			if err := json.Unmarshal(fields.Threshold, &d); err != nil {
+				return 0, 0, fmt.Errorf("threshold: %v", err)
+			}
+			threshold = float64(d)
+		} else if err := json.Unmarshal(fields.Threshold, &threshold); err != nil {
+			return 0, 0, fmt.Errorf("threshold: %v", err)
+		}
+		if threshold <= 0 {
+			return 0, 0, fmt.Errorf("threshold: %w: must be positive", ErrInvalidThreshold)
+		}
+	}
+	return threshold, time.Duration(fields.TripDuration), nil
+}
+
+// ratioThreshold returns the dynamic threshold if there is one,
+// and configured otherwise.
+func (c *Simple) ratioThreshold(configured float64) float64 {
+	if c.Dynamic != nil {
+		if t := math.Float64frombits(atomic.LoadUint64(&c.Dynamic.threshold)); t > 0 {
+			return t
+		}
+	}
+	return configured
+}
+
+// latencyThreshold returns the dynamic latency threshold if
+// there is one, and the configured one otherwise.
+func (c *Simple) latencyThreshold() time.Duration {
+	return time.Duration(c.ratioThreshold(float64(c.Latency.Threshold)))
+}
+
+// tripDuration returns the dynamic trip duration if there is
+// one, and configured otherwise.
+func (c *Simple) tripDuration(configured caddy.Duration) time.Duration {
+	if c.Dynamic != nil {
+		if d := atomic.LoadInt64(&c.Dynamic.tripDuration); d > 0 {
+			return time.Duration(d)
+		}
+	}
+	return time.Duration(configured)
+}
+
+const defaultDynamicInterval = 10 * time.Second
@@ -0,0 +1,223 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// ErrorBudget is a budget of responses with a status code or class
+// over a period, such as 0.1% of 5xx per hour. The circuit trips when
+// the budget becomes fully consumed, that is when the share of such
+// responses over the period reaches the budget. It trips only once
+// per exhaustion: the budget must recover below 100% before it can
+// trip the circuit again, so the circuit does not stay open until
+// the whole period has passed.
+type ErrorBudget struct {
+	// The status code ("503") or class ("5xx") the budget is for.
+	Status string `json:"status"`
+	// The share of responses over the period that may have the
+	// status, such as 0.001 for 0.1%.
+	Budget float64 `json:"budget"`
+	// The period over which the budget applies. It is tracked in 60
+	// buckets, so consumption changes in steps of 1/60 of the period.
+	// The default is 1h.
+	Period caddy.Duration `json:"period,omitempty"`
+	// The minimum number of responses in the period before the budget
+	// can trip the circuit.
+	MinRequests int64 `json:"min_requests,omitempty"`
+}
+
+// errorBudget tracks the consumption of an ErrorBudget.
+type errorBudget struct {
+	*ErrorBudget
+	code      int // exact status code, or 0 for a class
+	class     int // leading digit of the class, if code is 0
+	counter   *outcomeCounter
+	exhausted int32 // accessed atomically
+}
+
+// errorBudgetStatus is the admin API representation of an error budget.
+type errorBudgetStatus struct {
+	Status    string  `json:"status"`
+	Budget    float64 `json:"budget"`
+	Period    string  `json:"period"`
+	Requests  int64   `json:"requests"`
+	Consumed  float64 `json:"consumed"`
+	Remaining float64 `json:"remaining"`
+}
+
+// provisionErrorBudgets validates the configured budgets and fills
+// in their defaults.
+func (cfg *Config) provisionErrorBudgets() error {
+	for i := range cfg.ErrorBudgets {
+		b := &cfg.ErrorBudgets[i]
+		if _, _, err := parseStatusKey(b.Status); err != nil {
+			return fmt.Errorf("error_budgets: %v", err)
+		}
+		if b.Budget <= 0 || b.Budget >= 1 {
+			return fmt.Errorf("error_budgets: %w: budget for %s must be above 0 and below 1", ErrInvalidThreshold, b.Status)
+		}
+		if b.Period < 0 {
+			return fmt.Errorf("error_budgets: period for %s must not be negative", b.Status)
+		}
+		if b.Period == 0 {
+			b.Period = caddy.Duration(defaultErrorBudgetPeriod)
+		}
+		if b.MinRequests < 0 {
+			return fmt.Errorf("error_budgets: min_requests for %s must not be negative", b.Status)
+		}
+	}
+	return nil
+}
+
+// newErrorBudgets sets up tracking of validated budgets.
+func newErrorBudgets(budgets []ErrorBudget, elapsed func() time.Duration) []*errorBudget {
+	tracked := make([]*errorBudget, 0, len(budgets))
+	for i := range budgets {
+		b := &budgets[i]
+		code, class, _ := parseStatusKey(b.Status)
+		resolution := time.Duration(b.Period) / errorBudgetBuckets
+		if resolution <= 0 {
+			resolution = 1
+		}
+		tracked = append(tracked, &errorBudget{
+			ErrorBudget: b,
+			code:        code,
+			class:       class,
+			counter:     newOutcomeCounterOver(elapsed, errorBudgetBuckets, resolution),
+		})
+	}
+	return tracked
+}
+
+// parseStatusKey parses a status code, such as "503", or a status
+// class, such as "5xx", as in status_weights.
+func parseStatusKey(key string) (code, class int, err error) {
+	k := strings.ToLower(strings.TrimSpace(key))
+	if len(k) == 3 && strings.HasSuffix(k, "xx") {
+		class, err := strconv.Atoi(k[:1])
+		if err != nil || class < 1 || class > 5 {
+			return 0, 0, fmt.Errorf("invalid status class: %s", key)
+		}
+		return 0, class, nil
+	}
+	code, err = strconv.Atoi(k)
+	if err != nil || code < 100 || code > 599 {
+		return 0, 0, fmt.Errorf("invalid status code: %s", key)
+	}
+	return code, 0, nil
+}
+
+func (b *errorBudget) matches(statusCode int) bool {
+	if b.code != 0 {
+		return statusCode == b.code
+	}
+	return statusCode/100 == b.class
+}
+
+// consumed returns the share of the budget used up over the
+// period, which is 1 or more once it is exhausted, and the number
+// of responses in the period.
+func (b *errorBudget) consumed() (float64, int64) {
+	hits, total := b.counter.counts()
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(hits) / float64(total) / b.Budget, total
+}
+
+func (c *Simple) recordErrorBudgets(samples ...Sample) {
+	for _, b := range c.budgets {
+		var hits int64
+		for _, s := range samples {
+			if b.matches(s.StatusCode) {
+				hits++
+			}
+		}
+		b.counter.add(hits, int64(len(samples)))
+	}
+}
+
+// exhaustedErrorBudget returns the first budget that just became
+// exhausted, and how much of it is consumed. Budgets that recovered
+// below 100% can become exhausted again.
+func (c *Simple) exhaustedErrorBudget() (*errorBudget, float64) {
+	for _, b := range c.budgets {
+		consumed, total := b.consumed()
+		if consumed < 1 {
+			atomic.StoreInt32(&b.exhausted, 0)
+			continue
+		}
+		if total < b.MinRequests {
+			continue
+		}
+		if atomic.CompareAndSwapInt32(&b.exhausted, 0, 1) {
+			return b, consumed
+		}
+	}
+	return nil, 0
+}
+
+// ErrorBudgetRemaining returns the share of the least remaining error
+// budget, from 0.0 when one is exhausted to 1.0 when none is used, or
+// 1.0 if no error budgets are configured.
+func (c *Simple) ErrorBudgetRemaining() float64 {
+	remaining := 1.0
+	for _, b := range c.budgets {
+		consumed, _ := b.consumed()
+		if r := 1 - consumed; r < remaining {
+			remaining = r
+		}
+	}
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+func (c *Simple) errorBudgetStatuses() []errorBudgetStatus {
+	if len(c.budgets) == 0 {
+		return nil
+	}
+	statuses := make([]errorBudgetStatus, 0, len(c.budgets))
+	for _, b := range c.budgets {
+		consumed, total := b.consumed()
+		remaining := 1 - consumed
+		if remaining < 0 {
+			remaining = 0
+		}
+		statuses = append(statuses, errorBudgetStatus{
+			Status:    b.Status,
+			Budget:    b.Budget,
+			Period:    time.Duration(b.Period).String(),
+			Requests:  total,
+			Consumed:  consumed,
+			Remaining: remaining,
+		})
+	}
+	return statuses
+}
+
+const (
+	defaultErrorBudgetPeriod = time.Hour
+	errorBudgetBuckets       = 60
+)
@@ -0,0 +1,36 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import "errors"
+
+// Errors returned, possibly wrapped, by circuit breakers. Use
+// errors.Is to check for them.
+var (
+	// ErrUnknownFactor means that the configured factor does not exist.
+	ErrUnknownFactor = errors.New("unknown factor")
+
+	// ErrInvalidThreshold means that a configured threshold,
+	// or a related setting of a factor, is out of range.
+	ErrInvalidThreshold = errors.New("invalid threshold")
+
+	// ErrMetricsUnavailable means that the metrics a breaker
+	// needs could not be set up or are not being collected.
+	ErrMetricsUnavailable = errors.New("metrics unavailable")
+
+	// ErrMalformedState means that a shared circuit state could
+	// not be decoded.
+	ErrMalformedState = errors.New("malformed shared state")
+)
@@ -0,0 +1,84 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// evalGuard bounds the cost of evaluating the factor on hot routes.
+// It counts requests per second, and while the last second had more
+// than the configured rate, it lets the factor be evaluated only once
+// per interval instead of after every request.
+type evalGuard struct {
+	qps      int64
+	interval time.Duration
+	clock    func() time.Duration
+	onChange func(throttled bool)
+
+	slot      int64 // accessed atomically; the second being counted
+	count     int64 // accessed atomically; requests in that second
+	throttled int32 // accessed atomically
+	last      int64 // accessed atomically; time of the last evaluation
+}
+
+func newEvalGuard(clock func() time.Duration, qps int, interval time.Duration, onChange func(bool)) *evalGuard {
+	if clock == nil {
+		clock = monotonicClock()
+	}
+	return &evalGuard{
+		qps:      int64(qps),
+		interval: interval,
+		clock:    clock,
+		onChange: onChange,
+	}
+}
+
+// allow counts n requests and returns whether to evaluate the
+// factor now. A nil guard always allows.
+func (g *evalGuard) allow(n int) bool {
+	if g == nil {
+		return true
+	}
+	now := g.clock()
+	slot := int64(now / time.Second)
+	if prev := atomic.LoadInt64(&g.slot); prev != slot && atomic.CompareAndSwapInt64(&g.slot, prev, slot) {
+		// a gap of more than a second means the rate was low
+		count := atomic.SwapInt64(&g.count, 0)
+		var throttled int32
+		if slot == prev+1 && count > g.qps {
+			throttled = 1
+		}
+		if atomic.SwapInt32(&g.throttled, throttled) != throttled {
+			g.onChange(throttled == 1)
+		}
+	}
+	atomic.AddInt64(&g.count, int64(n))
+
+	if atomic.LoadInt32(&g.throttled) == 0 {
+		return true
+	}
+	last := atomic.LoadInt64(&g.last)
+	if now-time.Duration(last) < g.interval {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(&g.last, last, int64(now))
+}
+
+// isThrottled returns whether evaluations are currently throttled.
+func (g *evalGuard) isThrottled() bool {
+	return g != nil && atomic.LoadInt32(&g.throttled) == 1
+}
@@ -0,0 +1,469 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// LatencyFactor configures the latency factor, which trips the
+// circuit when a latency percentile exceeds a threshold.
+type LatencyFactor struct {
+	// The percentile of latencies to watch, from 0 to 100.
+	// The default is 99.
+	Quantile float64 `json:"quantile,omitempty"`
+	// The circuit trips when the latency at the quantile exceeds this.
+	Threshold caddy.Duration `json:"threshold,omitempty"`
+	// An optional latency, lower than threshold, above which the
+	// breaker signals that requests should be hedged.
+	Hedge caddy.Duration `json:"hedge,omitempty"`
+	// The unit in which the latency is reported as the factor value,
+	// and in which the deprecated flat threshold and hedge_threshold
+	// are interpreted: one of ns, us (or µs), ms, or s. The default
+	// is ms. Latencies are measured with a resolution of 1µs.
+	Unit string `json:"unit,omitempty"`
+	// If set, the confidence, between 0 and 1, with which the latency
+	// at the quantile must be known to exceed the threshold before the
+	// circuit trips. With few samples in the window a high quantile is
+	// little more than the slowest request; instead, the latency is
+	// read at a lower, sample-size-aware rank that is a lower bound of
+	// the quantile at this confidence. While the window holds too few
+	// samples for any such bound, the circuit does not trip. A typical
+	// value is 0.95.
+	Confidence float64 `json:"confidence,omitempty"`
+	// An optional percentage, below 100, of the slowest samples to
+	// drop before the quantile is evaluated. Where latencies are known
+	// to be bimodal, such as cache hits and misses, this keeps the
+	// occasional slow mode from dominating the tail.
+	Trim float64 `json:"trim,omitempty"`
+	// If true, latencies exclude the time a request spent queued in
+	// the proxy before it began connecting to the upstream, so that
+	// congestion in the proxy itself, which opening the circuit would
+	// only make worse, does not count against the upstream.
+	ExcludeQueueing bool `json:"exclude_queueing,omitempty"`
+	// Optional bounds of plausible latencies, such as to keep 0s
+	// latencies from a short-circuiting path or the durations of
+	// long streaming responses from distorting the quantile. The
+	// request is still counted, but what happens to a latency out of
+	// bounds depends on clamp.
+	Floor   caddy.Duration `json:"floor,omitempty"`
+	Ceiling caddy.Duration `json:"ceiling,omitempty"`
+	// What to do with latencies below floor or above ceiling: "clip"
+	// them to the bound, the default, or "discard" them.
+	Clamp string `json:"clamp,omitempty"`
+	// The exact percentiles to keep latencies for, if known ahead,
+	// such as [95, 99]; they must include the quantile, after trim,
+	// and cannot be combined with confidence. Latencies are then kept
+	// in sparse histograms that only hold the latencies that occur
+	// and are read in one pass for the registered quantiles, instead
+	// of full histograms that are merged for every evaluation; the
+	// window's stats report just these quantiles.
+	Quantiles []float64 `json:"quantiles,omitempty"`
+}
+
+// clamp applies the floor and ceiling to d. It returns noLatency
+// if d is out of bounds and to be discarded.
+func (l LatencyFactor) clamp(d time.Duration) time.Duration {
+	var bound time.Duration
+	switch {
+	case l.Floor > 0 && d < time.Duration(l.Floor):
+		bound = time.Duration(l.Floor)
+	case l.Ceiling > 0 && d > time.Duration(l.Ceiling):
+		bound = time.Duration(l.Ceiling)
+	default:
+		return d
+	}
+	if l.Clamp == clampDiscard {
+		return noLatency
+	}
+	return bound
+}
+
+// unit returns the duration of one latency unit. An unknown
+// unit is reported by provisionFactors; until then it counts
+// as the default.
+func (l LatencyFactor) unit() time.Duration {
+	if u, ok := latencyUnits[l.Unit]; ok {
+		return u
+	}
+	return latencyUnits[defaultLatencyUnit]
+}
+
+// guardedQuantile returns the percentile of all n samples in the
+// window at which to read the latency: the configured quantile of
+// the samples left after trimming, or with a confidence, the rank of
+// the distribution-free lower confidence bound of that quantile. It
+// returns false if n samples are too few to bound the quantile at all.
+func (l LatencyFactor) guardedQuantile(n int64) (float64, bool) {
+	kept := 1 - l.Trim/100
+	if l.Confidence == 0 {
+		return l.Quantile * kept, true
+	}
+	m := math.Floor(float64(n) * kept)
+	if m <= 0 {
+		return 0, false
+	}
+	// the number of samples below the true quantile is binomial;
+	// use its normal approximation to find the lowest rank that
+	// still lies below the quantile with the required confidence
+	p := l.Quantile / 100
+	z := math.Sqrt2 * math.Erfinv(2*l.Confidence-1)
+	mean := m * p
+	rank := math.Floor(mean - z*math.Sqrt(mean*(1-p)))
+	if rank < 1 {
+		return 0, false
+	}
+	return 100 * rank / float64(n), true
+}
+
+// latencyUnits are the possible units of the latency factor.
+var latencyUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"µs": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// RatioFactor configures a factor that trips the circuit when the
+// share of requests with a particular outcome exceeds a threshold.
+type RatioFactor struct {
+	// The ratio, usually between 0 and 1, above which the circuit trips.
+	Threshold float64 `json:"threshold,omitempty"`
+	// The minimum number of requests in the window before the
+	// ratio is evaluated at all. The default is 0.
+	MinRequests int64 `json:"min_requests,omitempty"`
+
+	// Status codes counted as errors by error_ratio in addition to
+	// 502 and 504, such as 408 or 429. Only for error_ratio.
+	Include []int `json:"include,omitempty"`
+	// Network error codes, 502 or 504, that error_ratio does not
+	// count as errors. Only for error_ratio.
+	Exclude []int `json:"exclude,omitempty"`
+}
+
+// StatusRatioFactor configures the status_ratio factor, which trips
+// the circuit when the share of responses with an error status code
+// exceeds a threshold.
+type StatusRatioFactor struct {
+	RatioFactor
+	// The inclusive range of status codes counted as errors, as
+	// a pair of [first, last]. The default is [500, 599].
+	Range []int `json:"range,omitempty"`
+	// Optional inclusive ranges of status codes that make up the
+	// denominator of the ratio, such as [[200, 299], [500, 599]] to
+	// leave client errors out entirely, so that heavy 404 traffic
+	// does not dilute the signal. Codes in range always count towards
+	// the denominator. The default is every status code.
+	Of [][]int `json:"of,omitempty"`
+}
+
+// ratio computes the ratio of counts in the range over counts in the
+// denominator, weighting the numerator with weights if there are any.
+// Codes outside the range never count as errors, whatever their weight.
+func (s *StatusRatioFactor) ratio(counts map[int]int64, weights *statusWeights) float64 {
+	var errors float64
+	var total int64
+	for code, n := range counts {
+		switch {
+		case s.inRange(code):
+			if weights != nil {
+				errors += weights.weight(code) * float64(n)
+			} else {
+				errors += float64(n)
+			}
+		case !s.inDenominator(code):
+			continue
+		}
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	return errors / float64(total)
+}
+
+func (s *StatusRatioFactor) inRange(code int) bool {
+	return code >= s.Range[0] && code <= s.Range[1]
+}
+
+func (s *StatusRatioFactor) inDenominator(code int) bool {
+	if len(s.Of) == 0 {
+		return true
+	}
+	for _, r := range s.Of {
+		if code >= r[0] && code <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// upgradeLegacy converts the flat threshold and hedge_threshold fields
+// into the block of the selected factor, then clears them, and returns
+// whether it did. If no factor is selected yet, for example because it
+// will be inherited, the flat fields are left in place to be converted
+// later.
+func (cfg *Config) upgradeLegacy() bool {
+	if cfg.Threshold == 0 && cfg.HedgeThreshold == 0 {
+		return false
+	}
+
+	switch cfg.Factor {
+	case "latency":
+		var l LatencyFactor
+		if cfg.Latency != nil {
+			l = *cfg.Latency
+		}
+		// the flat threshold served as both the quantile and the latency in the unit;
+		// as a quantile, values above 100 read the maximum latency
+		unit := float64(l.unit())
+		if cfg.Threshold != 0 {
+			l.Quantile = math.Min(cfg.Threshold, 100)
+			l.Threshold = caddy.Duration(cfg.Threshold * unit)
+		}
+		if cfg.HedgeThreshold != 0 {
+			l.Hedge = caddy.Duration(cfg.HedgeThreshold * unit)
+		}
+		cfg.Latency = &l
+	case "error_ratio":
+		cfg.ErrorRatio = upgradeRatio(cfg.ErrorRatio, cfg.Threshold)
+	case "deadline_miss_ratio":
+		cfg.DeadlineMissRatio = upgradeRatio(cfg.DeadlineMissRatio, cfg.Threshold)
+	case "status_ratio":
+		var s StatusRatioFactor
+		if cfg.StatusRatio != nil {
+			s = *cfg.StatusRatio
+		}
+		if cfg.Threshold != 0 {
+			s.Threshold = cfg.Threshold
+		}
+		cfg.StatusRatio = &s
+	default:
+		return false
+	}
+
+	cfg.Threshold = 0
+	cfg.HedgeThreshold = 0
+	return true
+}
+
+// factorBlock returns the block of the selected factor, as it
+// would be configured in JSON.
+func (cfg *Config) factorBlock() interface{} {
+	switch cfg.Factor {
+	case "latency":
+		return cfg.Latency
+	case "error_ratio":
+		return cfg.ErrorRatio
+	case "status_ratio":
+		return cfg.StatusRatio
+	case "deadline_miss_ratio":
+		return cfg.DeadlineMissRatio
+	case "throughput":
+		return cfg.Throughput
+	case "custom":
+		return cfg.CustomFactorRaw
+	}
+	return nil
+}
+
+func upgradeRatio(r *RatioFactor, threshold float64) *RatioFactor {
+	var out RatioFactor
+	if r != nil {
+		out = *r
+	}
+	if threshold != 0 {
+		out.Threshold = threshold
+	}
+	return &out
+}
+
+// inferFactor selects the factor from the factor blocks if no factor
+// was configured explicitly and exactly one block is present.
+func (cfg *Config) inferFactor() {
+	if cfg.Factor != "" {
+		return
+	}
+	var found []string
+	if cfg.Latency != nil {
+		found = append(found, "latency")
+	}
+	if cfg.ErrorRatio != nil {
+		found = append(found, "error_ratio")
+	}
+	if cfg.StatusRatio != nil {
+		found = append(found, "status_ratio")
+	}
+	if cfg.DeadlineMissRatio != nil {
+		found = append(found, "deadline_miss_ratio")
+	}
+	if cfg.Throughput != nil {
+		found = append(found, "throughput")
+	}
+	if cfg.CustomFactorRaw != nil || cfg.CustomFactor != nil {
+		found = append(found, "custom")
+	}
+	if len(found) == 1 {
+		cfg.Factor = found[0]
+	}
+}
+
+// provisionFactors validates the factor blocks and fills in their
+// defaults. The block of the selected factor must be present.
+func (cfg *Config) provisionFactors() error {
+	if l := cfg.Latency; l != nil {
+		if l.Quantile == 0 {
+			l.Quantile = defaultLatencyQuantile
+		}
+		if l.Unit == "" {
+			l.Unit = defaultLatencyUnit
+		}
+		if _, ok := latencyUnits[l.Unit]; !ok {
+			return fmt.Errorf("latency: unknown unit %q; must be one of ns, us, ms, or s", l.Unit)
+		}
+		if l.Quantile < 0 || l.Quantile > 100 {
+			return fmt.Errorf("latency: %w: quantile must be between 0 and 100", ErrInvalidThreshold)
+		}
+		if l.Threshold <= 0 {
+			return fmt.Errorf("latency: %w: must be positive", ErrInvalidThreshold)
+		}
+		if l.Hedge < 0 || (l.Hedge > 0 && l.Hedge >= l.Threshold) {
+			return fmt.Errorf("latency: %w: hedge must be positive and below threshold", ErrInvalidThreshold)
+		}
+		if l.Confidence < 0 || l.Confidence >= 1 {
+			return fmt.Errorf("latency: confidence must be at least 0 and below 1")
+		}
+		if l.Trim < 0 || l.Trim >= 100 {
+			return fmt.Errorf("latency: trim must be at least 0 and below 100")
+		}
+		if l.Floor < 0 || l.Ceiling < 0 || (l.Ceiling > 0 && l.Ceiling <= l.Floor) {
+			return fmt.Errorf("latency: floor and ceiling must be positive, with ceiling above floor")
+		}
+		if err := l.validateQuantiles(); err != nil {
+			return err
+		}
+		switch l.Clamp {
+		case "":
+			l.Clamp = clampClip
+		case clampClip, clampDiscard:
+		default:
+			return fmt.Errorf("latency: unknown clamp %q; must be clip or discard", l.Clamp)
+		}
+	}
+	for name, r := range map[string]*RatioFactor{
+		"error_ratio":         cfg.ErrorRatio,
+		"deadline_miss_ratio": cfg.DeadlineMissRatio,
+	} {
+		if r == nil {
+			continue
+		}
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if name != "error_ratio" && (len(r.Include) > 0 || len(r.Exclude) > 0) {
+			return fmt.Errorf("%s: include and exclude are only supported by error_ratio", name)
+		}
+	}
+	if s := cfg.StatusRatio; s != nil {
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("status_ratio: %w", err)
+		}
+		if s.Range == nil {
+			s.Range = []int{500, 599}
+		}
+		if len(s.Range) != 2 || s.Range[0] > s.Range[1] {
+			return fmt.Errorf("status_ratio: range must be [first, last]")
+		}
+		for _, r := range s.Of {
+			if len(r) != 2 || r[0] > r[1] {
+				return fmt.Errorf("status_ratio: each range of of must be [first, last]")
+			}
+		}
+	}
+
+	if t := cfg.Throughput; t != nil {
+		if err := t.provision(); err != nil {
+			return fmt.Errorf("throughput: %w", err)
+		}
+	}
+
+	var missing bool
+	switch cfg.Factor {
+	case "latency":
+		missing = cfg.Latency == nil
+	case "error_ratio":
+		missing = cfg.ErrorRatio == nil
+	case "status_ratio":
+		missing = cfg.StatusRatio == nil
+	case "deadline_miss_ratio":
+		missing = cfg.DeadlineMissRatio == nil
+	case "throughput":
+		missing = cfg.Throughput == nil
+	case "custom":
+		missing = cfg.CustomFactorRaw == nil && cfg.CustomFactor == nil
+	}
+	if missing {
+		return fmt.Errorf("factor %s is selected but not configured", cfg.Factor)
+	}
+	return nil
+}
+
+func (r RatioFactor) validate() error {
+	if r.Threshold <= 0 {
+		return fmt.Errorf("%w: must be positive", ErrInvalidThreshold)
+	}
+	if r.MinRequests < 0 {
+		return fmt.Errorf("%w: min_requests must not be negative", ErrInvalidThreshold)
+	}
+	for _, code := range r.Include {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("include: invalid status code %d", code)
+		}
+	}
+	for _, code := range r.Exclude {
+		if code != 502 && code != 504 {
+			return fmt.Errorf("exclude: %d is not a network error code; must be 502 or 504", code)
+		}
+	}
+	return nil
+}
+
+// errorCodes returns the set of status codes that error_ratio counts
+// as errors, or nil if it counts only the network errors.
+func (r RatioFactor) errorCodes() map[int]bool {
+	if len(r.Include) == 0 && len(r.Exclude) == 0 {
+		return nil
+	}
+	codes := map[int]bool{502: true, 504: true}
+	for _, code := range r.Exclude {
+		delete(codes, code)
+	}
+	for _, code := range r.Include {
+		codes[code] = true
+	}
+	return codes
+}
+
+const (
+	defaultLatencyQuantile = 99
+	clampClip              = "clip"
+	clampDiscard           = "discard"
+	defaultLatencyUnit     = "ms"
+)
@@ -0,0 +1,104 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+// FactorValues are the values of all factors computed from the same
+// window, whichever factor is selected, so that the effect of switching
+// factors can be judged from data.
+type FactorValues struct {
+	// The latency at the quantile of the latency block, or the 99th
+	// percentile, in the unit of the latency block, or milliseconds.
+	Latency float64 `json:"latency"`
+	// The share of 502 and 504 responses.
+	ErrorRatio float64 `json:"error_ratio"`
+	// The status ratio as configured in the status_ratio block, or
+	// the share of 5xx responses.
+	StatusRatio float64 `json:"status_ratio"`
+	// The share of requests with a deadline that missed it.
+	DeadlineMissRatio float64 `json:"deadline_miss_ratio"`
+	// The value of the custom factor, if one is configured.
+	Custom *float64 `json:"custom,omitempty"`
+}
+
+// FactorValues computes the values of all factors from the window,
+// read at the same instant. This merges latency histograms, so it is
+// best not called for every request.
+func (c *Simple) FactorValues() FactorValues {
+	unit := latencyUnits[defaultLatencyUnit]
+	if c.Latency != nil {
+		unit = c.Latency.unit()
+	}
+	snap, err := c.metrics.snapshot(func(requests int64) []float64 {
+		if c.Latency == nil {
+			return []float64{defaultLatencyQuantile}
+		}
+		if quantile, ok := c.Latency.guardedQuantile(requests); ok {
+			return []float64{quantile}
+		}
+		return nil
+	})
+
+	v := FactorValues{
+		ErrorRatio:        c.errorRatioOf(snap),
+		DeadlineMissRatio: c.deadlines.ratio(),
+	}
+	if err == nil && len(snap.Latencies) > 0 {
+		v.Latency = float64(snap.Latencies[0]) / float64(unit)
+	}
+	if c.StatusRatio != nil {
+		v.StatusRatio = c.StatusRatio.ratio(snap.StatusCodes, c.weights)
+	} else {
+		v.StatusRatio = codeRatio(snap.StatusCodes, 500, 600, 0, 600)
+	}
+	if c.CustomFactor != nil {
+		custom, _ := c.CustomFactor.Evaluate(c.metrics)
+		v.Custom = &custom
+	}
+	return v
+}
+
+// errorRatio returns the error ratio as configured by the error_ratio
+// factor: the network error ratio, unless include or exclude change
+// which status codes count.
+func (c *Simple) errorRatio() float64 {
+	if c.ErrorRatio == nil || c.errors == nil {
+		return c.metrics.networkErrorRatio()
+	}
+	return c.errorCodeRatio(c.metrics.statusCodeCounts())
+}
+
+// errorRatioOf is like errorRatio, but computed from a snapshot.
+func (c *Simple) errorRatioOf(snap WindowSnapshot) float64 {
+	if c.ErrorRatio == nil || c.errors == nil {
+		return snap.NetworkErrorRatio
+	}
+	return c.errorCodeRatio(snap.StatusCodes)
+}
+
+// errorCodeRatio returns the share of the counted status codes that
+// count as errors with include or exclude.
+func (c *Simple) errorCodeRatio(counts map[int]int64) float64 {
+	var errors, total int64
+	for code, n := range counts {
+		if c.errors[code] {
+			errors += n
+		}
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(errors) / float64(total)
+}
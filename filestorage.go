@@ -0,0 +1,227 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(FileStorage{})
+}
+
+// FileStorage is a Storage that keeps state in files of a local
+// directory, by default in shared memory (/dev/shm) where available.
+// It shares state between Caddy processes on the same host, such as
+// the old and new process of a blue/green deployment or socket
+// activated instances, so that a new process does not have to learn
+// about an ongoing outage from scratch. Files are locked while they
+// are read or written, and watched by polling. The processes must run
+// as the same user.
+type FileStorage struct {
+	// The directory to keep states in. The default is
+	// /dev/shm/caddy-circuit-breakers if /dev/shm exists, and
+	// caddy-circuit-breakers in the temporary directory otherwise.
+	Dir string `json:"dir,omitempty"`
+	// How often watched files are checked for changes. The default
+	// is 250ms.
+	PollInterval caddy.Duration `json:"poll_interval,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (FileStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "circuit_breaker.storage.file",
+		New: func() caddy.Module { return new(FileStorage) },
+	}
+}
+
+// Provision sets up the storage.
+func (s *FileStorage) Provision(ctx caddy.Context) error {
+	if s.Dir == "" {
+		s.Dir = filepath.Join(os.TempDir(), fileStorageDir)
+		if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+			s.Dir = filepath.Join("/dev/shm", fileStorageDir)
+		}
+	}
+	if s.PollInterval == 0 {
+		s.PollInterval = caddy.Duration(defaultPollInterval)
+	}
+	if s.PollInterval < 0 {
+		return fmt.Errorf("poll_interval must not be negative")
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return fmt.Errorf("creating state directory: %v", err)
+	}
+	return nil
+}
+
+// open opens the file of key, creating it if it does not exist.
+func (s *FileStorage) open(key string) (*os.File, error) {
+	return os.OpenFile(filepath.Join(s.Dir, url.PathEscape(key)), os.O_RDWR|os.O_CREATE, 0600)
+}
+
+// readStateFile reads the state in f: its version, followed by its binary
+// encoding. An empty file holds the zero state.
+func readStateFile(f *os.File) (SharedState, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return SharedState{}, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxStateFileSize))
+	if err != nil || len(data) == 0 {
+		return SharedState{}, err
+	}
+	if len(data) < 8 {
+		return SharedState{}, fmt.Errorf("%w: state file too short", ErrMalformedState)
+	}
+	state, err := decodeSharedState(data[8:])
+	if err != nil {
+		return SharedState{}, err
+	}
+	state.Version = binary.BigEndian.Uint64(data)
+	return state, nil
+}
+
+// Get implements Storage.
+func (s *FileStorage) Get(ctx context.Context, key string) (SharedState, error) {
+	f, err := s.open(key)
+	if err != nil {
+		return SharedState{}, err
+	}
+	defer f.Close()
+	if err := lockFile(f, false); err != nil {
+		return SharedState{}, err
+	}
+	defer unlockFile(f)
+	return readStateFile(f)
+}
+
+// CompareAndSet implements Storage.
+func (s *FileStorage) CompareAndSet(ctx context.Context, key string, version uint64, state SharedState) (bool, error) {
+	data, err := state.MarshalBinary()
+	if err != nil {
+		return false, err
+	}
+	f, err := s.open(key)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if err := lockFile(f, true); err != nil {
+		return false, err
+	}
+	defer unlockFile(f)
+
+	current, err := readStateFile(f)
+	if err != nil {
+		return false, err
+	}
+	if current.Version != version {
+		return false, nil
+	}
+	buf := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint64(buf, version+1)
+	buf = append(buf, data...)
+	if err := f.Truncate(0); err != nil {
+		return false, err
+	}
+	if _, err := f.WriteAt(buf, 0); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Watch implements Storage.
+func (s *FileStorage) Watch(ctx context.Context, key string) (<-chan SharedState, error) {
+	state, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan SharedState)
+	go func() {
+		defer close(out)
+		ticker := time.NewTicker(time.Duration(s.PollInterval))
+		defer ticker.Stop()
+		for {
+			select {
+			case out <- state:
+			case <-ctx.Done():
+				return
+			}
+			for version := state.Version; state.Version == version; {
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+				if state, err = s.Get(ctx, key); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+// UnmarshalCaddyfile sets up the storage from Caddyfile tokens. Syntax:
+//
+//	storage file [<dir>] {
+//	    poll_interval <duration>
+//	}
+func (s *FileStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			s.Dir = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "poll_interval":
+				if err := parseDurationArg(d, &s.PollInterval); err != nil {
+					return err
+				}
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+const (
+	fileStorageDir      = "caddy-circuit-breakers"
+	defaultPollInterval = 250 * time.Millisecond
+	maxStateFileSize    = 1 << 20
+)
+
+// Interface guards
+var (
+	_ Storage               = (*FileStorage)(nil)
+	_ caddy.Provisioner     = (*FileStorage)(nil)
+	_ caddyfile.Unmarshaler = (*FileStorage)(nil)
+)
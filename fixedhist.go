@@ -0,0 +1,136 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// fixedHist is a latency histogram of fixed log-linear bins in arrays
+// of atomic counters, an alternative to the HDR histograms for windows
+// with histogram fixed. A latency is recorded with one atomic add,
+// without taking the window's lock, at the cost of quantiles that are
+// only as precise as the bins: each power of two of microseconds is
+// split into fixedSubBins linear bins, about 3% wide.
+type fixedHist struct {
+	buckets []fixedBucket
+}
+
+type fixedBucket struct {
+	slot   int64            // accessed atomically
+	counts [fixedBins]int64 // accessed atomically
+}
+
+const (
+	fixedSubBits = 5
+	fixedSubBins = 1 << fixedSubBits
+	// enough magnitudes for histMax, which is below 2^32µs
+	fixedBins = (32 - fixedSubBits + 1) * fixedSubBins
+)
+
+// fixedBin returns the bin of a latency of us microseconds: values
+// below fixedSubBins have a bin each, and every power of two above
+// is split into fixedSubBins bins.
+func fixedBin(us int64) int {
+	if us < fixedSubBins {
+		if us < 0 {
+			return 0
+		}
+		return int(us)
+	}
+	shift := bits.Len64(uint64(us)) - fixedSubBits - 1
+	return (shift+1)*fixedSubBins + int(us>>uint(shift)) - fixedSubBins
+}
+
+// fixedValue returns the highest latency in bin, in microseconds.
+func fixedValue(bin int) int64 {
+	if bin < fixedSubBins {
+		return int64(bin)
+	}
+	shift := uint(bin/fixedSubBins - 1)
+	sub := int64(bin%fixedSubBins + fixedSubBins)
+	return (sub+1)<<shift - 1
+}
+
+func newFixedHist() *fixedHist {
+	h := &fixedHist{buckets: make([]fixedBucket, windowHistBuckets)}
+	h.reset()
+	return h
+}
+
+// record adds latency to the bucket of now. The first sample of a
+// new bucket clears it; samples recorded by others while it is being
+// cleared may be lost, which a histogram of this precision tolerates.
+func (h *fixedHist) record(now time.Duration, latency time.Duration) {
+	us := int64(latency / time.Microsecond)
+	if us > histMax {
+		return // dropped, as by the HDR histograms
+	}
+	slot := int64(now / windowHistResolution)
+	b := &h.buckets[slot%int64(len(h.buckets))]
+	if old := atomic.LoadInt64(&b.slot); old < slot && atomic.CompareAndSwapInt64(&b.slot, old, slot) {
+		for i := range b.counts {
+			atomic.StoreInt64(&b.counts[i], 0)
+		}
+	}
+	atomic.AddInt64(&b.counts[fixedBin(us)], 1)
+}
+
+// quantiles returns the latencies at the given percentiles over the
+// window at now, as the highest latency of the bin each falls in.
+func (h *fixedHist) quantiles(now time.Duration, qs []float64) []time.Duration {
+	var merged [fixedBins]int64
+	var total int64
+	cur := int64(now / windowHistResolution)
+	for i := range h.buckets {
+		b := &h.buckets[i]
+		if slot := atomic.LoadInt64(&b.slot); slot > cur || slot <= cur-int64(len(h.buckets)) {
+			continue
+		}
+		for bin := range b.counts {
+			n := atomic.LoadInt64(&b.counts[bin])
+			merged[bin] += n
+			total += n
+		}
+	}
+
+	out := make([]time.Duration, len(qs))
+	if total == 0 {
+		return out
+	}
+	for i, q := range qs {
+		rank := quantileRank(q, total)
+		var seen int64
+		for bin, n := range merged {
+			if seen += n; seen >= rank {
+				out[i] = time.Duration(fixedValue(bin)) * time.Microsecond
+				break
+			}
+		}
+	}
+	return out
+}
+
+func (h *fixedHist) reset() {
+	for i := range h.buckets {
+		b := &h.buckets[i]
+		atomic.StoreInt64(&b.slot, -1)
+		for bin := range b.counts {
+			atomic.StoreInt64(&b.counts[bin], 0)
+		}
+	}
+}
@@ -0,0 +1,507 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(Handler{})
+	httpcaddyfile.RegisterHandlerDirective("circuit_breaker", parseCaddyfileHandler)
+}
+
+// Handler is the middleware variant of the circuit breaker. It
+// rejects requests with 503 Service Unavailable while its circuit
+// is open, and records the outcome of every request it lets
+// through to the rest of the handler chain.
+//
+// The following placeholders are set for the rest of the chain:
+//
+// Placeholder | Description
+// ------------|-------------
+// `{http.circuit_breaker.hedge}` | Whether latency is above the hedge threshold
+// `{http.circuit_breaker.admission_rate}` | The suggested share of requests to let through, from 0.0 to 1.0
+// `{http.circuit_breaker.error_budget_remaining}` | The share of the least remaining error budget, from 0.0 to 1.0
+// `{http.circuit_breaker.health_score}` | The health score of the upstream, from 0 to 100
+// `{http.circuit_breaker.tier}` | The backpressure tier: normal, warning, or open
+type Handler struct {
+	Config
+
+	// When the circuit is open, hold up to this many requests in
+	// a queue instead of rejecting them right away. A queued request
+	// proceeds if the circuit closes before queue_timeout elapses,
+	// otherwise it is rejected. The default is 0 (no queue).
+	QueueSize int `json:"queue_size,omitempty"`
+
+	// How long a request may wait in the queue. The default is 1s.
+	QueueTimeout caddy.Duration `json:"queue_timeout,omitempty"`
+
+	// Enables debugging aids: every response is tagged with a
+	// header describing the breaker's state and last factor value,
+	// for example "closed; status_ratio=0.030". Not for production.
+	Debug bool `json:"debug,omitempty"`
+
+	// The name of the debug header. The default is X-Circuit-State.
+	DebugHeader string `json:"debug_header,omitempty"`
+
+	// An optional response header through which the rest of the
+	// chain, such as the upstream, tags the outcome of a request as
+	// "success" or "failure" regardless of its status code, so that
+	// for example a 200 with an application-level error counts as a
+	// failure. The header is removed before the response is sent to
+	// the client.
+	OutcomeHeader string `json:"outcome_header,omitempty"`
+
+	// An optional placeholder, such as {http.vars.outcome}, that tags
+	// the outcome of a request like outcome_header does. It is
+	// evaluated once the rest of the chain has handled the request.
+	// The header takes precedence if both tag a request.
+	OutcomePlaceholder string `json:"outcome_placeholder,omitempty"`
+
+	// The status code a request tagged as a failure is recorded
+	// with. The default is 500; requests tagged as a success are
+	// recorded as 200.
+	FailureStatus int `json:"failure_status,omitempty"`
+
+	// If true, rejected requests are answered with 503 and an RFC
+	// 7807 application/problem+json body with the breaker's name and
+	// state, the seconds until the circuit closes if known (also sent
+	// as Retry-After), and a correlation ID, so that API clients can
+	// tell short-circuits apart from upstream errors. Such responses
+	// are written directly rather than through Caddy's error handling.
+	ProblemDetails bool `json:"problem_details,omitempty"`
+
+	// The request header to take the correlation ID from, and the
+	// response header it is echoed in. Requests without one get a
+	// random ID. The default is X-Request-Id.
+	CorrelationHeader string `json:"correlation_header,omitempty"`
+
+	// Which requests an open circuit rejects: "all", the default, or
+	// "upstream" for only those routed to an upstream whose own
+	// circuit is open. With upstream, the breaker must be named and
+	// per_upstream, and the reverse proxy behind it must use the
+	// circuit_breaker selection policy with this breaker, which does
+	// the rejecting once the upstream is chosen; the handler then
+	// lets requests through while the breaker as a whole is open. It
+	// still rejects all requests while draining.
+	TripScope string `json:"trip_scope,omitempty"`
+
+	breaker *Simple
+	queue   chan struct{}
+}
+
+// CaddyModule returns the Caddy module information.
+func (Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.circuit_breaker",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// Provision sets up the handler and its circuit breaker.
+func (h *Handler) Provision(ctx caddy.Context) error {
+	if h.QueueSize < 0 {
+		return fmt.Errorf("queue_size must not be negative")
+	}
+	if h.QueueTimeout < 0 {
+		return fmt.Errorf("queue_timeout must not be negative")
+	}
+	if h.QueueTimeout == 0 {
+		h.QueueTimeout = caddy.Duration(defaultQueueTimeout)
+	}
+	if h.QueueSize > 0 {
+		h.queue = make(chan struct{}, h.QueueSize)
+	}
+	if h.DebugHeader == "" {
+		h.DebugHeader = defaultDebugHeader
+	}
+	if h.CorrelationHeader == "" {
+		h.CorrelationHeader = defaultCorrelationHeader
+	}
+	if h.FailureStatus == 0 {
+		h.FailureStatus = http.StatusInternalServerError
+	}
+	if h.FailureStatus < 100 || h.FailureStatus > 599 {
+		return fmt.Errorf("failure_status must be a valid status code")
+	}
+	switch h.TripScope {
+	case "", tripScopeAll:
+	case tripScopeUpstream:
+		if !h.PerUpstream || h.Name == "" {
+			return fmt.Errorf("trip_scope upstream requires a named per_upstream breaker")
+		}
+	default:
+		return fmt.Errorf("unknown trip_scope %q; must be all or upstream", h.TripScope)
+	}
+
+	h.breaker = &Simple{Config: h.Config}
+	return h.breaker.Provision(ctx)
+}
+
+// Cleanup cleans up the handler's circuit breaker.
+func (h *Handler) Cleanup() error {
+	if h.breaker != nil {
+		return h.breaker.Cleanup()
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if h.Debug {
+		w.Header().Set(h.DebugHeader, fmt.Sprintf("%s; %s=%.3f", h.breaker.State(), h.breaker.Factor, h.breaker.factorValue()))
+	}
+
+	if h.TripScope == tripScopeUpstream {
+		// open upstreams are rejected by the selection policy
+		if h.breaker.Draining() && !h.breaker.bypassed(r) {
+			return h.reject(w, r, errDraining)
+		}
+	} else if !h.breaker.OKForRequest(r) {
+		// a draining breaker does not close by itself, so don't queue
+		if h.breaker.Draining() {
+			return h.reject(w, r, errDraining)
+		}
+		if err := h.wait(r); err == errCircuitOpen {
+			return h.reject(w, r, err)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	defer h.breaker.end(h.breaker.begin())
+
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("http.circuit_breaker.hedge", h.breaker.Hedging())
+	repl.Set("http.circuit_breaker.admission_rate", h.breaker.AdmissionRate())
+	repl.Set("http.circuit_breaker.health_score", h.breaker.HealthScore())
+	repl.Set("http.circuit_breaker.tier", h.breaker.Tier().String())
+	if len(h.breaker.budgets) > 0 {
+		repl.Set("http.circuit_breaker.error_budget_remaining", h.breaker.ErrorBudgetRemaining())
+	}
+
+	rec := &statusRecorder{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		outcomeHeader:         h.OutcomeHeader,
+	}
+	start := time.Now()
+	if l := h.breaker.Latency; l != nil && l.ExcludeQueueing {
+		rec.dialed = new(int64)
+		r = r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+			GetConn: func(string) {
+				// retries connect again; only the first attempt ends the queueing
+				atomic.CompareAndSwapInt64(rec.dialed, 0, int64(time.Since(start)))
+			},
+		}))
+	}
+
+	// the reverse proxy aborts the response by panicking if the
+	// upstream body fails after the headers were sent; record that
+	// as a failure, since otherwise only the 200 would be seen
+	defer func() {
+		if rv := recover(); rv != nil {
+			if rv == http.ErrAbortHandler && rec.status != 0 {
+				h.recordOutcome(r, rec, start, errBodyAborted)
+			}
+			panic(rv)
+		}
+	}()
+
+	err := next.ServeHTTP(rec, r)
+	h.recordOutcome(r, rec, start, err)
+
+	return err
+}
+
+// recordOutcome records the result of a request that went through the
+// rest of the chain. Requests that failed after the response headers were
+// already written, such as when the upstream body was truncated or had
+// broken chunked encoding, are recorded as 502 Bad Gateway regardless
+// of the status code that was written.
+func (h *Handler) recordOutcome(r *http.Request, rec *statusRecorder, start time.Time, err error) {
+	latency := time.Since(start)
+
+	status := rec.status
+	switch {
+	case err != nil && rec.status != 0:
+		status = http.StatusBadGateway
+	case err != nil:
+		status = http.StatusInternalServerError
+		if he, ok := err.(caddyhttp.HandlerError); ok && he.StatusCode != 0 {
+			status = he.StatusCode
+		}
+	case status == 0:
+		status = http.StatusOK
+	}
+
+	// requests tagged by the rest of the chain count as tagged,
+	// unless they failed to complete in the first place
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	outcome := rec.outcome
+	if outcome == "" && h.OutcomePlaceholder != "" {
+		outcome = repl.ReplaceAll(h.OutcomePlaceholder, "")
+	}
+	if err == nil {
+		switch strings.ToLower(strings.TrimSpace(outcome)) {
+		case outcomeSuccess:
+			status = http.StatusOK
+		case outcomeFailure:
+			status = h.FailureStatus
+		}
+	}
+
+	s := Sample{
+		StatusCode: status,
+		Latency:    latency,
+		Bytes:      rec.bytes,
+		Method:     r.Method,
+		Err:        err,
+	}
+	if rec.dialed != nil {
+		s.QueueTime = time.Duration(atomic.LoadInt64(rec.dialed))
+	}
+	// set by the reverse proxy, if it handled the request
+	if upstream, ok := repl.Get("http.reverse_proxy.upstream.hostport"); ok {
+		s.Upstream, _ = upstream.(string)
+	}
+	if deadline, ok := r.Context().Deadline(); ok {
+		s.HasDeadline = true
+		s.MissedDeadline = time.Now().After(deadline)
+	}
+	if h.breaker.records != nil {
+		h.breaker.submit(s)
+	} else {
+		go h.breaker.Record(s)
+	}
+}
+
+// wait holds the request in the queue until the circuit closes,
+// the queue timeout elapses, or the client goes away. If the queue
+// is full or disabled, the request is rejected immediately, which
+// wait reports as errCircuitOpen.
+func (h *Handler) wait(r *http.Request) error {
+	select {
+	case h.queue <- struct{}{}:
+		defer func() { <-h.queue }()
+	default:
+		return errCircuitOpen
+	}
+
+	timer := time.NewTimer(time.Duration(h.QueueTimeout))
+	defer timer.Stop()
+
+	for !h.breaker.OK() {
+		// closedNotify does not wake a draining breaker, which stays
+		// closed underneath, so don't spin on it until the timeout
+		if h.breaker.Draining() {
+			return errCircuitOpen
+		}
+		select {
+		case <-h.breaker.closedNotify():
+		case <-timer.C:
+			return errCircuitOpen
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	circuit_breaker [<matcher>] {
+//	    <breaker subdirectives...>
+//	    queue_size          <n>
+//	    queue_timeout       <duration>
+//	    debug               [<header>]
+//	    outcome_header      <header>
+//	    outcome_placeholder <placeholder>
+//	    failure_status      <code>
+//	    problem_details     [<correlation header>]
+//	    trip_scope          all|upstream
+//	}
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "queue_size":
+				var val string
+				if !d.AllArgs(&val) {
+					return d.ArgErr()
+				}
+				size, err := strconv.Atoi(val)
+				if err != nil {
+					return d.Errf("parsing queue_size: %v", err)
+				}
+				h.QueueSize = size
+
+			case "queue_timeout":
+				var val string
+				if !d.AllArgs(&val) {
+					return d.ArgErr()
+				}
+				dur, err := time.ParseDuration(val)
+				if err != nil {
+					return d.Errf("parsing queue_timeout: %v", err)
+				}
+				h.QueueTimeout = caddy.Duration(dur)
+
+			case "outcome_header":
+				if !d.AllArgs(&h.OutcomeHeader) {
+					return d.ArgErr()
+				}
+
+			case "outcome_placeholder":
+				if !d.AllArgs(&h.OutcomePlaceholder) {
+					return d.ArgErr()
+				}
+
+			case "failure_status":
+				var val string
+				if !d.AllArgs(&val) {
+					return d.ArgErr()
+				}
+				code, err := strconv.Atoi(val)
+				if err != nil {
+					return d.Errf("parsing failure_status: %v", err)
+				}
+				h.FailureStatus = code
+
+			case "problem_details":
+				if d.NextArg() {
+					h.CorrelationHeader = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				h.ProblemDetails = true
+
+			case "trip_scope":
+				if !d.AllArgs(&h.TripScope) {
+					return d.ArgErr()
+				}
+
+			case "debug":
+				if d.NextArg() {
+					h.DebugHeader = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				h.Debug = true
+
+			default:
+				if err := h.Config.unmarshalCaddyfileOption(d); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func parseCaddyfileHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var handler Handler
+	err := handler.UnmarshalCaddyfile(h.Dispenser)
+	return &handler, err
+}
+
+// statusRecorder remembers the status code written by the
+// next handlers so it can be recorded by the breaker.
+type statusRecorder struct {
+	*caddyhttp.ResponseWriterWrapper
+	status int
+	bytes  int64
+	dialed *int64 // time from start until the proxy first connected upstream, if traced
+
+	outcomeHeader string // header tagging the outcome, removed from the response
+	outcome       string // the outcome it tagged
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+		rec.takeOutcome()
+	}
+	rec.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+		rec.takeOutcome()
+	}
+	n, err := rec.ResponseWriterWrapper.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// takeOutcome removes the outcome header from the response before
+// the headers are written, remembering its value.
+func (rec *statusRecorder) takeOutcome() {
+	if rec.outcomeHeader == "" {
+		return
+	}
+	rec.outcome = rec.Header().Get(rec.outcomeHeader)
+	rec.Header().Del(rec.outcomeHeader)
+}
+
+var (
+	errCircuitOpen = fmt.Errorf("circuit breaker is open")
+	errBodyAborted = fmt.Errorf("response aborted after headers were written")
+	errDraining    = fmt.Errorf("circuit breaker is draining")
+	// rejected by the circuit_breaker selection policy
+	errUpstreamOpen = fmt.Errorf("circuit breaker is open for the upstream")
+)
+
+// Values of outcome_header and outcome_placeholder, in any case.
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+)
+
+// Values of trip_scope.
+const (
+	tripScopeAll      = "all"
+	tripScopeUpstream = "upstream"
+)
+
+const (
+	defaultQueueTimeout = time.Second
+	defaultDebugHeader  = "X-Circuit-State"
+)
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Handler)(nil)
+	_ caddy.CleanerUpper          = (*Handler)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Handler)(nil)
+	_ caddyfile.Unmarshaler       = (*Handler)(nil)
+)
@@ -0,0 +1,78 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"net/http"
+	"time"
+)
+
+// HealthCheckResult is the result of one active health check of an
+// upstream, such as a probe by the reverse proxy's health checker.
+type HealthCheckResult struct {
+	// The dial address (host:port) of the checked upstream.
+	Upstream string
+	// Whether the check passed.
+	Healthy bool
+	// The status code of the check's response, or 0 if the check
+	// did not get a response.
+	StatusCode int
+	// How long the check took.
+	Latency time.Duration
+	// The error that failed the check, if any.
+	Err error
+}
+
+// RecordHealthCheck records the result of an active health check
+// as if it were a request, so that the breaker can open even while
+// there is no traffic and the upstream is clearly down. A failed
+// check without a status code counts as a 502 Bad Gateway. This
+// function should be run in a separate goroutine.
+func (c *Simple) RecordHealthCheck(r HealthCheckResult) {
+	c.Record(r.sample())
+}
+
+// RecordHealthCheck records the result of an active health check
+// with the named breaker, for health checkers that know the breakers
+// guarding their upstreams only by name. It returns false if there
+// is no breaker with that name.
+func RecordHealthCheck(name string, r HealthCheckResult) bool {
+	c, ok := lookupBreaker(name)
+	if !ok {
+		return false
+	}
+	c.RecordHealthCheck(r)
+	return true
+}
+
+func (r HealthCheckResult) sample() Sample {
+	status := r.StatusCode
+	switch {
+	case status == 0 && r.Healthy:
+		status = http.StatusOK
+	case status == 0:
+		status = http.StatusBadGateway
+	case !r.Healthy && status < 500:
+		// the check failed on something other than the status,
+		// such as its body or latency
+		status = http.StatusServiceUnavailable
+	}
+	return Sample{
+		StatusCode: status,
+		Latency:    r.Latency,
+		Upstream:   r.Upstream,
+		Err:        r.Err,
+	}
+}
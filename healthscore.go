@@ -0,0 +1,53 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// HealthScore returns a score of the health of the upstream, from 0
+// to 100, for dashboards that want a single number per backend. It
+// combines everything that can trip the circuit: the factor, the
+// stream reset ratio, and the error budgets. Each is taken as the
+// share of the way to tripping it is, and the score is what is left
+// of the way for the closest one; a factor at half its threshold
+// scores 50. The score is 100 while the window holds too few requests
+// to evaluate the factor, and 0 while the circuit is open.
+func (c *Simple) HealthScore() int {
+	if !c.OK() {
+		return 0
+	}
+	worst := math.Float64frombits(atomic.LoadUint64(&c.pressure))
+	if c.StreamResetThreshold > 0 {
+		if p := c.streamResets.ratio() / c.StreamResetThreshold; p > worst {
+			worst = p
+		}
+	}
+	if len(c.budgets) > 0 {
+		if p := 1 - c.ErrorBudgetRemaining(); p > worst {
+			worst = p
+		}
+	}
+	score := math.Round(100 * (1 - worst))
+	switch {
+	case score < 0:
+		return 0
+	case score > 100:
+		return 100
+	}
+	return int(score)
+}
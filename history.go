@@ -0,0 +1,113 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"sync"
+	"time"
+)
+
+// Transition describes a single change of circuit breaker state.
+type Transition struct {
+	From  State  `json:"from"`
+	To    State  `json:"to"`
+	Cause Reason `json:"cause,omitempty"`
+	// A description of the transition, with the details of its cause.
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+	// The ID of the maintenance window in effect, if any, so that
+	// transitions caused by planned work can be told apart.
+	Maintenance string `json:"maintenance,omitempty"`
+}
+
+// history is a bounded ring buffer of the most recent
+// state transitions of a circuit breaker.
+type history struct {
+	mu      sync.Mutex
+	entries []Transition
+	next    int
+	full    bool
+	state   State
+	since   time.Time
+	count   uint64 // transitions ever recorded
+}
+
+func newHistory(size int, initial State) *history {
+	return &history{
+		entries: make([]Transition, size),
+		state:   initial,
+		since:   time.Now(),
+	}
+}
+
+// record appends a transition to the given state, overwriting
+// the oldest entry once the buffer is full, and returns it.
+func (h *history) record(to State, cause Reason, reason, maintenance string) Transition {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	t := Transition{
+		From:        h.state,
+		To:          to,
+		Cause:       cause,
+		Reason:      reason,
+		Time:        now,
+		Maintenance: maintenance,
+	}
+	h.entries[h.next] = t
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+	h.state = to
+	h.since = now
+	h.count++
+	return t
+}
+
+// transitions returns the recorded transitions, oldest first.
+func (h *history) transitions() []Transition {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.transitionsLocked()
+}
+
+func (h *history) transitionsLocked() []Transition {
+	if !h.full {
+		return append([]Transition(nil), h.entries[:h.next]...)
+	}
+	out := make([]Transition, 0, len(h.entries))
+	out = append(out, h.entries[h.next:]...)
+	return append(out, h.entries[:h.next]...)
+}
+
+// after returns the transitions still kept that were recorded after
+// the first n, oldest first, and how many have been recorded in all.
+func (h *history) after(n uint64) ([]Transition, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	all := h.transitionsLocked()
+	if missed := h.count - n; missed < uint64(len(all)) {
+		all = all[uint64(len(all))-missed:]
+	}
+	return all, h.count
+}
+
+// current returns the current state and when it was entered.
+func (h *history) current() (State, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state, h.since
+}
@@ -0,0 +1,186 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hungCheckInterval is how often requests in flight are checked for
+// having taken longer than hung_request_multiple times the p99.
+const hungCheckInterval = 250 * time.Millisecond
+
+// hungTracker keeps the start times of the requests in flight, so
+// that those taking far longer than usual can count as presumptive
+// failures before they complete.
+type hungTracker struct {
+	multiple float64
+	stop     chan struct{}
+
+	mu      sync.Mutex
+	next    uint64
+	started map[uint64]time.Duration
+	p99     time.Duration   // the last known p99 latency of the window
+	overdue []time.Duration // ages of the hung requests, longest first
+}
+
+func newHungTracker(multiple float64) *hungTracker {
+	return &hungTracker{
+		multiple: multiple,
+		started:  make(map[uint64]time.Duration),
+	}
+}
+
+func (h *hungTracker) begin(now time.Duration) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.next++
+	h.started[h.next] = now
+	return h.next
+}
+
+func (h *hungTracker) end(id uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.started, id)
+}
+
+// scan updates the hung requests: those that started after since and
+// are older than the multiple of the last known p99. It returns the
+// number of hung requests before and after the scan.
+func (h *hungTracker) scan(now, since time.Duration, p99 time.Duration) (before, after int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if p99 > 0 {
+		h.p99 = p99
+	}
+	before = len(h.overdue)
+	h.overdue = h.overdue[:0]
+	if h.p99 == 0 {
+		return before, 0
+	}
+	limit := time.Duration(h.multiple * float64(h.p99))
+	for _, start := range h.started {
+		if start >= since && now-start > limit {
+			h.overdue = append(h.overdue, now-start)
+		}
+	}
+	sort.Slice(h.overdue, func(i, j int) bool { return h.overdue[i] > h.overdue[j] })
+	return before, len(h.overdue)
+}
+
+// hungAges returns the ages of the hung requests, longest first.
+func (h *hungTracker) hungAges() []time.Duration {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.overdue) == 0 {
+		return nil
+	}
+	return append([]time.Duration(nil), h.overdue...)
+}
+
+// watchHung periodically checks the requests in flight for hung ones
+// and evaluates the factor while there are any, since a hang-style
+// outage may not complete any requests that would trigger it.
+func (c *Simple) watchHung() {
+	h := c.hung
+	h.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(hungCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.checkHung()
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *Simple) stopHung() {
+	if c.hung != nil && c.hung.stop != nil {
+		close(c.hung.stop)
+		c.hung.stop = nil
+	}
+}
+
+func (c *Simple) checkHung() {
+	p99, err := c.metrics.latencyQuantile(99)
+	if err != nil {
+		p99 = 0
+	}
+	// requests already in flight at the last trip were counted then
+	since := time.Duration(atomic.LoadInt64(&c.trippedAt))
+	if before, after := c.hung.scan(c.clock(), since, p99); before > 0 || after > 0 {
+		c.checkAndSet()
+	}
+}
+
+// Hung returns how many requests in flight count as presumptive
+// failures, having taken longer than hung_request_multiple times the
+// p99 latency. It is always 0 unless hung_request_multiple is set.
+func (c *Simple) Hung() int {
+	return len(c.hung.hungAges())
+}
+
+// presumeFailures returns the ratio over n requests, with k hung
+// requests added as failures.
+func presumeFailures(ratio float64, n, k int64) float64 {
+	if k == 0 {
+		return ratio
+	}
+	return (ratio*float64(n) + float64(k)) / float64(n+k)
+}
+
+// latencyWithHung returns the latency at quantile q over the n
+// completed requests of the window and the hung ones, taken at their
+// current age, which is a lower bound of their latency.
+func (c *Simple) latencyWithHung(q float64, n int64, hung []time.Duration) (time.Duration, error) {
+	k := int64(len(hung))
+	switch {
+	case k == 0:
+		return c.metrics.latencyQuantile(q)
+	case n == 0:
+		return hung[k-1], nil
+	}
+	// the hung requests are the slowest, so the quantile is one of
+	// them if they are more than the share of requests above it
+	above := int64((1 - q/100) * float64(n+k))
+	if k > above {
+		return hung[above], nil
+	}
+	adjusted := q * float64(n+k) / float64(n)
+	if adjusted > 100 {
+		adjusted = 100
+	}
+	return c.metrics.latencyQuantile(adjusted)
+}
+
+// hungReason describes the hung requests included in an evaluation.
+func hungReason(k int64) string {
+	if k == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (including %d hung requests)", k)
+}
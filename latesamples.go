@@ -0,0 +1,83 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Possible values of Config.LateSamples.
+const (
+	lateSamplesWindow  = "window"
+	lateSamplesStale   = "stale"
+	lateSamplesDiscard = "discard"
+)
+
+// staleStatus reports the late samples kept out of the window.
+type staleStatus struct {
+	Requests int64 `json:"requests"`
+	Failures int64 `json:"failures"`
+}
+
+// late returns whether s is from a request that started before the
+// circuit last tripped, and so describes the backend as it was then
+// rather than now. Samples are only ever late if late_samples is set.
+func (c *Simple) late(s Sample) bool {
+	if c.LateSamples == "" || c.LateSamples == lateSamplesWindow {
+		return false
+	}
+	trippedAt := atomic.LoadInt64(&c.trippedAt)
+	return trippedAt >= 0 && c.clock()-s.Latency < time.Duration(trippedAt)
+}
+
+// recordLate accounts the late samples among samples in the stale
+// bucket and returns the others.
+func (c *Simple) recordLate(samples []Sample) []Sample {
+	if c.LateSamples == "" || c.LateSamples == lateSamplesWindow {
+		return samples
+	}
+	current := samples[:0:0]
+	var failures, late int64
+	for _, s := range samples {
+		if !c.late(s) {
+			current = append(current, s)
+			continue
+		}
+		late++
+		if isFailure(s) {
+			failures++
+		}
+	}
+	if late > 0 && c.stale != nil {
+		c.stale.add(failures, late)
+	}
+	return current
+}
+
+// isFailure returns whether s counts as failed in the stale bucket.
+func isFailure(s Sample) bool {
+	return s.Err != nil || s.StatusCode >= 500
+}
+
+// staleStatus returns the contents of the stale bucket, or nil
+// if late samples are not kept there.
+func (c *Simple) staleStatus() *staleStatus {
+	if c.stale == nil {
+		return nil
+	}
+	failures, requests := c.stale.counts()
+	return &staleStatus{Requests: requests, Failures: failures}
+}
@@ -0,0 +1,266 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// MaintenanceWindow is a planned period, such as a deploy, during
+// which breakers do not trip, or only trip on severe breaches, so
+// that the brief spike of errors it causes does not open circuits.
+// Windows are declared through the admin API and belong to the
+// process, so they survive config reloads during the deploy.
+type MaintenanceWindow struct {
+	// The ID of the window, taken from the admin API path.
+	ID string `json:"id"`
+	// When the window starts; the default is when it is declared.
+	Start time.Time `json:"start,omitempty"`
+	// When the window ends. Required.
+	End time.Time `json:"end"`
+	// The labels of the breakers the window applies to, of which a
+	// breaker must carry any. If empty, it applies to all breakers.
+	Labels []string `json:"labels,omitempty"`
+	// What happens to trips during the window: "suppress", the
+	// default, keeps the circuit from tripping at all; "relax" lets
+	// it trip only once a factor exceeds relax times its threshold.
+	Mode string `json:"mode,omitempty"`
+	// With mode relax, how many times its threshold a factor must be
+	// to trip the circuit. The default is 2.
+	Relax float64 `json:"relax,omitempty"`
+	// Why the window was declared, and by whom; the actor is taken
+	// from the Circuit-Breaker-Actor header.
+	Reason string `json:"reason,omitempty"`
+	Actor  string `json:"actor,omitempty"`
+}
+
+// maintenanceWindows holds the declared maintenance windows of this
+// process. n counts them, so that breakers can skip the lookup
+// while there are none.
+var maintenanceWindows = struct {
+	sync.RWMutex
+	m map[string]MaintenanceWindow
+	n int32 // accessed atomically
+}{m: make(map[string]MaintenanceWindow)}
+
+// provision validates w and fills in its defaults, as of now.
+func (w *MaintenanceWindow) provision(now time.Time) error {
+	if w.Start.IsZero() {
+		w.Start = now
+	}
+	if w.End.IsZero() || !w.End.After(w.Start) {
+		return fmt.Errorf("end must be set and after start")
+	}
+	if !w.End.After(now) {
+		return fmt.Errorf("end must be in the future")
+	}
+	switch w.Mode {
+	case "":
+		w.Mode = maintenanceSuppress
+	case maintenanceSuppress, maintenanceRelax:
+	default:
+		return fmt.Errorf("unknown mode %q; must be suppress or relax", w.Mode)
+	}
+	if w.Relax < 0 || (w.Relax > 0 && w.Relax < 1) {
+		return fmt.Errorf("relax must be at least 1")
+	}
+	if w.Mode == maintenanceRelax && w.Relax == 0 {
+		w.Relax = defaultMaintenanceRelax
+	}
+	return nil
+}
+
+// active returns whether w is in effect at now.
+func (w MaintenanceWindow) active(now time.Time) bool {
+	return !now.Before(w.Start) && now.Before(w.End)
+}
+
+// declareMaintenance adds or replaces the maintenance window w.ID.
+func declareMaintenance(w MaintenanceWindow) {
+	maintenanceWindows.Lock()
+	defer maintenanceWindows.Unlock()
+	maintenanceWindows.m[w.ID] = w
+	pruneMaintenanceLocked(time.Now())
+}
+
+// endMaintenance removes the maintenance window id, and returns
+// whether there was one.
+func endMaintenance(id string) bool {
+	maintenanceWindows.Lock()
+	defer maintenanceWindows.Unlock()
+	_, ok := maintenanceWindows.m[id]
+	delete(maintenanceWindows.m, id)
+	pruneMaintenanceLocked(time.Now())
+	return ok
+}
+
+// pruneMaintenanceLocked drops windows that ended before now.
+// maintenanceWindows must be locked.
+func pruneMaintenanceLocked(now time.Time) {
+	for id, w := range maintenanceWindows.m {
+		if !now.Before(w.End) {
+			delete(maintenanceWindows.m, id)
+		}
+	}
+	atomic.StoreInt32(&maintenanceWindows.n, int32(len(maintenanceWindows.m)))
+}
+
+// listMaintenance returns the windows that have not ended, by start.
+func listMaintenance() []MaintenanceWindow {
+	maintenanceWindows.Lock()
+	defer maintenanceWindows.Unlock()
+	pruneMaintenanceLocked(time.Now())
+	list := make([]MaintenanceWindow, 0, len(maintenanceWindows.m))
+	for _, w := range maintenanceWindows.m {
+		list = append(list, w)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Start.Equal(list[j].Start) {
+			return list[i].Start.Before(list[j].Start)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// maintenance returns the maintenance window in effect for c, if
+// any. Of several, a window that suppresses trips wins over those
+// that relax them, and otherwise the most relaxed one.
+func (c *Simple) maintenance() (MaintenanceWindow, bool) {
+	if atomic.LoadInt32(&maintenanceWindows.n) == 0 {
+		return MaintenanceWindow{}, false
+	}
+	now := time.Now()
+	maintenanceWindows.RLock()
+	defer maintenanceWindows.RUnlock()
+	var found MaintenanceWindow
+	var ok bool
+	for _, w := range maintenanceWindows.m {
+		if !w.active(now) || (len(w.Labels) > 0 && !c.hasAnyLabel(w.Labels)) {
+			continue
+		}
+		switch {
+		case !ok,
+			w.Mode == maintenanceSuppress && found.Mode != maintenanceSuppress,
+			w.Mode == found.Mode && w.Relax > found.Relax:
+			found, ok = w, true
+		}
+	}
+	return found, ok
+}
+
+// maintenanceHolds returns whether a maintenance window keeps c
+// from tripping on a breach of severity times its threshold.
+func (c *Simple) maintenanceHolds(severity float64) bool {
+	w, ok := c.maintenance()
+	return ok && (w.Mode == maintenanceSuppress || severity <= w.Relax)
+}
+
+// maintenanceID returns the ID of the maintenance window in effect
+// for c, to annotate its transitions with, or "" if there is none.
+func (c *Simple) maintenanceID() string {
+	w, _ := c.maintenance()
+	return w.ID
+}
+
+// handleMaintenance serves requests for:
+//
+//	GET    /circuit-breaker-maintenance/      windows that have not ended
+//	PUT    /circuit-breaker-maintenance/<id>  declare the window in the body
+//	DELETE /circuit-breaker-maintenance/<id>  end a window early
+//
+// Like other changes, declaring and ending windows is written to the
+// audit log and needs the app's admin token, if one is set.
+func (a adminAPI) handleMaintenance(w http.ResponseWriter, r *http.Request) error {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, maintenancePrefix), "/")
+	if id == "" {
+		if err := requireMethod(r, http.MethodGet); err != nil {
+			return err
+		}
+		return writeJSON(w, listMaintenance())
+	}
+	if strings.Contains(id, "/") {
+		return caddy.APIError{
+			Code: http.StatusNotFound,
+			Err:  fmt.Errorf("not found: %s", r.URL.Path),
+		}
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		actor, err := authorizeAction(r, "", "declare maintenance window "+id)
+		if err != nil {
+			return err
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxCandidateConfigSize))
+		if err != nil {
+			return err
+		}
+		var mw MaintenanceWindow
+		if err := json.Unmarshal(body, &mw); err != nil {
+			return caddy.APIError{
+				Code: http.StatusBadRequest,
+				Err:  fmt.Errorf("decoding maintenance window: %v", err),
+			}
+		}
+		mw.ID, mw.Actor = id, actor
+		if err := mw.provision(time.Now()); err != nil {
+			return caddy.APIError{
+				Code: http.StatusBadRequest,
+				Err:  fmt.Errorf("maintenance window %s: %v", id, err),
+			}
+		}
+		declareMaintenance(mw)
+		return writeJSON(w, listMaintenance())
+
+	case http.MethodDelete:
+		if _, err := authorizeAction(r, "", "end maintenance window "+id); err != nil {
+			return err
+		}
+		if !endMaintenance(id) {
+			return caddy.APIError{
+				Code: http.StatusNotFound,
+				Err:  fmt.Errorf("unknown maintenance window: %s", id),
+			}
+		}
+		return writeJSON(w, listMaintenance())
+	}
+	return caddy.APIError{
+		Code: http.StatusMethodNotAllowed,
+		Err:  fmt.Errorf("method not allowed"),
+	}
+}
+
+// Possible values of MaintenanceWindow.Mode.
+const (
+	maintenanceSuppress = "suppress"
+	maintenanceRelax    = "relax"
+)
+
+const (
+	maintenancePrefix       = "/circuit-breaker-maintenance/"
+	defaultMaintenanceRelax = 2
+)
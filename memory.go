@@ -0,0 +1,160 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// MemoryUsage returns the approximate number of bytes held by the
+// breaker: its windows and histograms, its history and trace, and
+// the states of its upstreams and candidates. It is meant to find
+// breakers whose memory grows, such as from many upstreams or status
+// codes, not to account for every byte; map and allocation overhead
+// is estimated.
+func (c *Simple) MemoryUsage() int64 {
+	n := int64(unsafe.Sizeof(*c))
+	n += c.metrics.memoryUsage()
+	n += c.deadlines.memoryUsage()
+	n += c.streamResets.memoryUsage()
+	n += c.stale.memoryUsage()
+	n += c.throughput.memoryUsage()
+	n += c.series.memoryUsage()
+	n += c.history.memoryUsage()
+	n += c.trace.memoryUsage()
+	if c.overhead != nil {
+		n += int64(unsafe.Sizeof(*c.overhead))
+	}
+	for _, b := range c.budgets {
+		n += int64(unsafe.Sizeof(*b)) + b.counter.memoryUsage()
+	}
+	if c.upstreams != nil {
+		c.upstreams.mu.Lock()
+		upstreams := make([]*Simple, 0, len(c.upstreams.m))
+		for addr, u := range c.upstreams.m {
+			n += 2*(mapEntryBytes+int64(len(addr))) + int64(unsafe.Sizeof(*u))
+			upstreams = append(upstreams, u)
+		}
+		c.upstreams.mu.Unlock()
+		for _, u := range upstreams {
+			n += u.MemoryUsage()
+		}
+	}
+	if c.candidates != nil {
+		c.candidates.mu.RLock()
+		for id, cand := range c.candidates.m {
+			n += mapEntryBytes + int64(len(id)) + cand.MemoryUsage()
+		}
+		c.candidates.mu.RUnlock()
+	}
+	return n
+}
+
+func (w *window) memoryUsage() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := int64(unsafe.Sizeof(*w))
+	if w.log != nil {
+		n += w.log.memoryUsage()
+	}
+	n += int64(len(w.counts)) * int64(unsafe.Sizeof(countBucket{}))
+	for _, b := range w.counts {
+		n += int64(len(b.codes)) * mapEntryBytes
+	}
+	n += int64(len(w.hists)) * (int64(unsafe.Sizeof(histBucket{})) + hdrBytes(histSigFigs))
+	n += w.sparse.memoryUsage()
+	if w.fixed != nil {
+		n += int64(len(w.fixed.buckets)) * int64(unsafe.Sizeof(fixedBucket{}))
+	}
+	return n
+}
+
+func (o *outcomeCounter) memoryUsage() int64 {
+	if o == nil {
+		return 0
+	}
+	return int64(unsafe.Sizeof(*o)) + int64(len(o.buckets))*int64(unsafe.Sizeof(outcomeBucket{}))
+}
+
+func (h *quantileHist) memoryUsage() int64 {
+	if h == nil {
+		return 0
+	}
+	n := int64(unsafe.Sizeof(*h)) + int64(len(h.total))*8
+	n += int64(len(h.buckets)) * int64(unsafe.Sizeof(sparseBucket{}))
+	for _, b := range h.buckets {
+		n += int64(len(b.counts)) * mapEntryBytes
+	}
+	return n
+}
+
+func (ts *timeSeries) memoryUsage() int64 {
+	if ts == nil {
+		return 0
+	}
+	return int64(unsafe.Sizeof(*ts)) +
+		int64(len(ts.buckets))*(int64(unsafe.Sizeof(seriesBucket{}))+hdrBytes(seriesSigFigs))
+}
+
+func (h *history) memoryUsage() int64 {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := int64(unsafe.Sizeof(*h)) + int64(len(h.entries))*int64(unsafe.Sizeof(Transition{}))
+	for _, t := range h.entries {
+		n += int64(len(t.Reason))
+	}
+	return n
+}
+
+func (t *trace) memoryUsage() int64 {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := int64(unsafe.Sizeof(*t)) + int64(len(t.entries))*int64(unsafe.Sizeof(Evaluation{}))
+	for _, e := range t.entries {
+		n += int64(len(e.Reason))
+	}
+	return n
+}
+
+// hdrBytes returns the size of the counts of a latency histogram
+// with the given precision, which is the bulk of its memory.
+func hdrBytes(sigfigs int) int64 {
+	hdrSizes.Lock()
+	defer hdrSizes.Unlock()
+	n, ok := hdrSizes.m[sigfigs]
+	if !ok {
+		n = int64(hdrhistogram.New(histMin, histMax, sigfigs).ByteSize())
+		hdrSizes.m[sigfigs] = n
+	}
+	return n
+}
+
+var hdrSizes = struct {
+	sync.Mutex
+	m map[int]int64
+}{m: make(map[int]int64)}
+
+// mapEntryBytes estimates the memory of one small map entry,
+// including the map's own overhead.
+const mapEntryBytes = 48
@@ -0,0 +1,136 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"context"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(MemoryStorage{})
+}
+
+// MemoryStorage is a Storage that keeps state in the memory of this
+// process. It only shares state between breakers of the same name
+// within one Caddy instance, across config reloads; it is mostly
+// useful for trying out distributed breakers and as a reference for
+// other implementations.
+type MemoryStorage struct{}
+
+// CaddyModule returns the Caddy module information.
+func (MemoryStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "circuit_breaker.storage.memory",
+		New: func() caddy.Module { return new(MemoryStorage) },
+	}
+}
+
+// memoryStore is shared by all MemoryStorage instances.
+var memoryStore = struct {
+	sync.Mutex
+	states   map[string]SharedState
+	watchers map[string]map[chan SharedState]struct{}
+}{
+	states:   make(map[string]SharedState),
+	watchers: make(map[string]map[chan SharedState]struct{}),
+}
+
+// Get implements Storage.
+func (MemoryStorage) Get(ctx context.Context, key string) (SharedState, error) {
+	memoryStore.Lock()
+	defer memoryStore.Unlock()
+	return memoryStore.states[key], nil
+}
+
+// CompareAndSet implements Storage.
+func (MemoryStorage) CompareAndSet(ctx context.Context, key string, version uint64, state SharedState) (bool, error) {
+	memoryStore.Lock()
+	defer memoryStore.Unlock()
+	if memoryStore.states[key].Version != version {
+		return false, nil
+	}
+	state.Version = version + 1
+	memoryStore.states[key] = state
+	for ch := range memoryStore.watchers[key] {
+		// watchers only care about the latest state; drop a
+		// pending one that was not received yet
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- state
+	}
+	return true, nil
+}
+
+// Watch implements Storage.
+func (MemoryStorage) Watch(ctx context.Context, key string) (<-chan SharedState, error) {
+	ch := make(chan SharedState, 1)
+	memoryStore.Lock()
+	if memoryStore.watchers[key] == nil {
+		memoryStore.watchers[key] = make(map[chan SharedState]struct{})
+	}
+	memoryStore.watchers[key][ch] = struct{}{}
+	ch <- memoryStore.states[key]
+	memoryStore.Unlock()
+
+	out := make(chan SharedState)
+	go func() {
+		defer close(out)
+		defer func() {
+			memoryStore.Lock()
+			delete(memoryStore.watchers[key], ch)
+			memoryStore.Unlock()
+		}()
+		for {
+			select {
+			case state := <-ch:
+				select {
+				case out <- state:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// UnmarshalCaddyfile sets up the storage from Caddyfile tokens. Syntax:
+//
+//	storage memory
+func (s *MemoryStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		if d.NextBlock(0) {
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ Storage               = (*MemoryStorage)(nil)
+	_ caddyfile.Unmarshaler = (*MemoryStorage)(nil)
+)
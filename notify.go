@@ -0,0 +1,84 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"sync"
+	"time"
+)
+
+// settleFilter holds back the transitions of a breaker until its
+// state persisted for the settle time. The transitions in between
+// are summarized as one event from the state before the first to the
+// state after the last; if the breaker ends up where it started, no
+// event is sent at all, and the transitions are counted towards the
+// next event instead.
+type settleFilter struct {
+	mu         sync.Mutex
+	settle     time.Duration
+	send       func(StateEvent)
+	pending    *StateEvent
+	count      int    // transitions in pending
+	suppressed int    // transitions of dropped events
+	generation uint64 // compared for equality only, so wrapping is harmless
+}
+
+func newSettleFilter(settle time.Duration, send func(StateEvent)) *settleFilter {
+	return &settleFilter{settle: settle, send: send}
+}
+
+// add adds a transition, restarting the settle time.
+func (f *settleFilter) add(ev StateEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pending == nil {
+		f.pending = &ev
+	} else {
+		f.pending.To = ev.To
+		f.pending.Cause = ev.Cause
+		f.pending.Reason = ev.Reason
+		f.pending.Time = ev.Time
+		f.pending.Maintenance = ev.Maintenance
+		f.pending.RunbookURL = ev.RunbookURL
+	}
+	f.count++
+	f.generation++
+	gen := f.generation
+	time.AfterFunc(f.settle, func() { f.flush(gen) })
+}
+
+// flush sends the pending event if no transition came after it.
+func (f *settleFilter) flush(gen uint64) {
+	f.mu.Lock()
+	if gen != f.generation || f.pending == nil {
+		f.mu.Unlock()
+		return
+	}
+	ev := *f.pending
+	f.pending = nil
+	n := f.count + f.suppressed
+	f.count = 0
+	if ev.From == ev.To {
+		f.suppressed = n
+		f.mu.Unlock()
+		return
+	}
+	f.suppressed = 0
+	f.mu.Unlock()
+	if n > 1 {
+		ev.Transitions = n
+	}
+	f.send(ev)
+}
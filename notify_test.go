@@ -0,0 +1,43 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSettleFilterGenerationWrap(t *testing.T) {
+	var sent []StateEvent
+	f := newSettleFilter(time.Hour, func(ev StateEvent) { sent = append(sent, ev) })
+	f.generation = ^uint64(0) - 1
+
+	f.add(StateEvent{Breaker: "a", From: StateClosed, To: StateOpen})
+	stale := f.generation
+	f.add(StateEvent{Breaker: "a", From: StateClosed, To: StateClosed})
+	f.add(StateEvent{Breaker: "a", From: StateClosed, To: StateOpen})
+	if f.generation != 1 {
+		t.Fatalf("generation = %d, want it to have wrapped to 1", f.generation)
+	}
+
+	f.flush(stale)
+	if len(sent) != 0 {
+		t.Fatalf("stale flush from before the wrap sent %v", sent)
+	}
+	f.flush(f.generation)
+	if len(sent) != 1 || sent[0].To != StateOpen || sent[0].Transitions != 3 {
+		t.Fatalf("sent %+v, want one open event summarizing 3 transitions", sent)
+	}
+}
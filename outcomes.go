@@ -0,0 +1,117 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"sync"
+	"time"
+)
+
+// outcomeCounter tracks, over a sliding window, how many of the
+// requests it was given had a particular outcome, for example
+// missing their deadline. Like window, it is driven by the
+// monotonic clock.
+type outcomeCounter struct {
+	mu         sync.Mutex
+	elapsed    func() time.Duration
+	buckets    []outcomeBucket
+	resolution time.Duration
+}
+
+type outcomeBucket struct {
+	slot  int64
+	hits  int64
+	total int64
+}
+
+// newOutcomeCounter returns an outcomeCounter over the same
+// sliding window as window's counters.
+func newOutcomeCounter(elapsed func() time.Duration) *outcomeCounter {
+	return newOutcomeCounterOver(elapsed, windowCountBuckets, windowCountResolution)
+}
+
+// newOutcomeCounterOver returns an outcomeCounter over a sliding
+// window of the given number of buckets of the given resolution.
+func newOutcomeCounterOver(elapsed func() time.Duration, buckets int, resolution time.Duration) *outcomeCounter {
+	if elapsed == nil {
+		elapsed = monotonicClock()
+	}
+	o := &outcomeCounter{
+		elapsed:    elapsed,
+		buckets:    make([]outcomeBucket, buckets),
+		resolution: resolution,
+	}
+	o.reset()
+	return o
+}
+
+func (o *outcomeCounter) record(hit bool) {
+	var hits int64
+	if hit {
+		hits = 1
+	}
+	o.add(hits, 1)
+}
+
+// add records total requests at once, hits of which had the outcome.
+func (o *outcomeCounter) add(hits, total int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	slot := int64(o.elapsed() / o.resolution)
+	b := &o.buckets[slot%int64(len(o.buckets))]
+	if b.slot != slot {
+		*b = outcomeBucket{slot: slot}
+	}
+	b.total += total
+	b.hits += hits
+}
+
+// ratio returns the fraction of requests that had the outcome.
+func (o *outcomeCounter) ratio() float64 {
+	hits, total := o.counts()
+	if total == 0 {
+		return 0
+	}
+	return float64(hits) / float64(total)
+}
+
+// count returns the number of requests in the window.
+func (o *outcomeCounter) count() int64 {
+	_, total := o.counts()
+	return total
+}
+
+// counts returns how many requests in the window had the
+// outcome, and how many requests there were in total.
+func (o *outcomeCounter) counts() (hits, total int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	cur := int64(o.elapsed() / o.resolution)
+	for _, b := range o.buckets {
+		if b.slot <= cur && b.slot > cur-int64(len(o.buckets)) {
+			hits += b.hits
+			total += b.total
+		}
+	}
+	return hits, total
+}
+
+func (o *outcomeCounter) reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i := range o.buckets {
+		o.buckets[i] = outcomeBucket{slot: -1}
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// overhead measures the time spent inside the breaker itself.
+type overhead struct {
+	record   durationHistogram // Record, including evaluation
+	ok       durationHistogram // OK
+	evaluate durationHistogram // factor evaluation alone
+}
+
+// durationHistogram counts durations in power-of-two nanosecond
+// buckets. It is lock-free so that measuring the breaker does not
+// add contention to the paths being measured; quantiles are only
+// precise to within a factor of two, which is plenty for telling
+// nanoseconds from microseconds.
+//
+// The buckets are halved every overheadDecayEvery observations, so
+// that after months of uptime the quantiles still follow the recent
+// overhead instead of being fixed by the first weeks of it, and the
+// bucket counts stay far from wrapping.
+type durationHistogram struct {
+	buckets [64]uint64 // accessed atomically; bucket i counts durations below 2^i ns
+	ticks   uint64     // accessed atomically; observations since start, wrapping
+	decays  uint64     // accessed atomically; halvings of the buckets since start
+}
+
+// overheadDecayEvery is how many observations pass between halvings
+// of a durationHistogram's buckets.
+const overheadDecayEvery = 1 << 20
+
+func (h *durationHistogram) observe(start time.Time) {
+	d := time.Since(start)
+	if d < 0 {
+		d = 0
+	}
+	atomic.AddUint64(&h.buckets[bits.Len64(uint64(d))%64], 1)
+	if atomic.AddUint64(&h.ticks, 1)%overheadDecayEvery == 0 {
+		atomic.AddUint64(&h.decays, 1)
+		h.decay()
+	}
+}
+
+// count returns the number of observations since start, saturating at
+// the largest uint64 instead of wrapping: ticks wraps exactly as the
+// decays reach 2^64 / overheadDecayEvery.
+func (h *durationHistogram) count() uint64 {
+	if atomic.LoadUint64(&h.decays) >= 1<<64/overheadDecayEvery {
+		return math.MaxUint64
+	}
+	return atomic.LoadUint64(&h.ticks)
+}
+
+// decay halves every bucket. Observations added concurrently are
+// kept, since each bucket is halved by compare-and-swap.
+func (h *durationHistogram) decay() {
+	for i := range h.buckets {
+		for {
+			n := atomic.LoadUint64(&h.buckets[i])
+			if atomic.CompareAndSwapUint64(&h.buckets[i], n, n/2) {
+				break
+			}
+		}
+	}
+}
+
+// OverheadStats summarizes the measured durations of one operation.
+// Count is every observation since start, up to the largest uint64;
+// the quantiles weigh recent observations more, as the buckets decay.
+type OverheadStats struct {
+	Count uint64 `json:"count"`
+	P50   int64  `json:"p50_ns"`
+	P99   int64  `json:"p99_ns"`
+}
+
+func (h *durationHistogram) stats() OverheadStats {
+	var counts [64]uint64
+	var total uint64
+	for i := range h.buckets {
+		counts[i] = atomic.LoadUint64(&h.buckets[i])
+		total += counts[i]
+	}
+	st := OverheadStats{Count: h.count()}
+	if total == 0 {
+		return st
+	}
+	quantile := func(q float64) int64 {
+		rank := uint64(q * float64(total))
+		var seen uint64
+		for i, n := range counts {
+			seen += n
+			if seen > rank {
+				return int64(1) << uint(i) // the bucket's upper bound
+			}
+		}
+		return 1 << 62
+	}
+	st.P50 = quantile(0.5)
+	st.P99 = quantile(0.99)
+	return st
+}
+
+// overheadReport is the admin API representation of overhead.
+type overheadReport struct {
+	Record   OverheadStats `json:"record"`
+	OK       OverheadStats `json:"ok"`
+	Evaluate OverheadStats `json:"evaluate"`
+}
+
+func (o *overhead) report() *overheadReport {
+	if o == nil {
+		return nil
+	}
+	return &overheadReport{
+		Record:   o.record.stats(),
+		OK:       o.ok.stats(),
+		Evaluate: o.evaluate.stats(),
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDurationHistogramDecay(t *testing.T) {
+	var h durationHistogram
+	start := time.Now()
+	for i := 0; i < overheadDecayEvery-1; i++ {
+		h.observe(start)
+	}
+	if st := h.stats(); st.Count != overheadDecayEvery-1 {
+		t.Fatalf("count before decay = %d, want %d", st.Count, overheadDecayEvery-1)
+	}
+	bucketTotal := func() uint64 {
+		var n uint64
+		for _, b := range h.buckets {
+			n += b
+		}
+		return n
+	}
+	if n := bucketTotal(); n != overheadDecayEvery-1 {
+		t.Fatalf("buckets before decay hold %d, want %d", n, overheadDecayEvery-1)
+	}
+
+	h.observe(start)
+	if n := bucketTotal(); n > overheadDecayEvery/2+64 {
+		t.Errorf("buckets after decay hold %d, want about %d", n, overheadDecayEvery/2)
+	}
+	if st := h.stats(); st.Count != overheadDecayEvery {
+		t.Errorf("count after decay = %d, want %d", st.Count, overheadDecayEvery)
+	}
+}
+
+func TestDurationHistogramExtremeVolume(t *testing.T) {
+	// a count about to overflow, as after years at a high request rate
+	h := durationHistogram{
+		ticks:  ^uint64(0) - overheadDecayEvery/2,
+		decays: 1<<64/overheadDecayEvery - 1,
+	}
+	h.buckets[10] = 1 << 62
+	h.decay()
+	for i := 0; i < overheadDecayEvery; i++ {
+		h.observe(time.Now())
+	}
+	if h.buckets[10] >= 1<<62 {
+		t.Errorf("bucket was not halved: %d", h.buckets[10])
+	}
+	st := h.stats()
+	if st.Count != ^uint64(0) {
+		t.Errorf("count = %d, want it to saturate at %d", st.Count, ^uint64(0))
+	}
+	if st.P50 <= 0 || st.P99 < st.P50 {
+		t.Errorf("quantiles p50=%d p99=%d after extreme volume", st.P50, st.P99)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// presets are the built-in named settings selectable with Config.Preset.
+var presets = map[string]Config{
+	// trips early on a moderate share of server errors and
+	// stays open long enough for the backend to recover
+	"aggressive": {
+		Factor:       "status_ratio",
+		StatusRatio:  &StatusRatioFactor{RatioFactor: RatioFactor{Threshold: 0.2}},
+		TripDuration: caddy.Duration(15 * time.Second),
+	},
+	// only trips when most of a reasonable number of requests are failing
+	"conservative": {
+		Factor:       "status_ratio",
+		StatusRatio:  &StatusRatioFactor{RatioFactor: RatioFactor{Threshold: 0.5, MinRequests: 20}},
+		TripDuration: caddy.Duration(5 * time.Second),
+	},
+	// trips when the 99th percentile exceeds 100ms and signals
+	// hedging above 50ms
+	"latency_sensitive": {
+		Factor: "latency",
+		Latency: &LatencyFactor{
+			Quantile:  99,
+			Threshold: caddy.Duration(100 * time.Millisecond),
+			Hedge:     caddy.Duration(50 * time.Millisecond),
+		},
+		TripDuration: caddy.Duration(5 * time.Second),
+	},
+}
+
+// applyPreset fills in every unset field of cfg from its preset, if any.
+func (cfg *Config) applyPreset() error {
+	if cfg.Preset == "" {
+		return nil
+	}
+	preset, ok := presets[cfg.Preset]
+	if !ok {
+		return fmt.Errorf("unknown preset: %s", cfg.Preset)
+	}
+	return cfg.inherit(&preset)
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// problem is an RFC 7807 problem details object describing a
+// request the breaker rejected, with the breaker's details as
+// extension members.
+type problem struct {
+	Type          string `json:"type"`
+	Title         string `json:"title"`
+	Status        int    `json:"status"`
+	Detail        string `json:"detail"`
+	Breaker       string `json:"breaker,omitempty"`
+	State         State  `json:"state"`
+	Reason        string `json:"reason,omitempty"` // of the trip
+	RunbookURL    string `json:"runbook_url,omitempty"`
+	RetryAfter    int64  `json:"retry_after,omitempty"` // seconds
+	CorrelationID string `json:"correlation_id"`
+}
+
+// reject answers a request that the breaker does not let through:
+// with an application/problem+json body if problem_details is
+// enabled, or otherwise by handing a 503 error to Caddy's error
+// handling. The request may be sampled for rejected_samples first.
+func (h *Handler) reject(w http.ResponseWriter, r *http.Request, reason error) error {
+	h.breaker.sampleRejected(r, "", reason)
+	if !h.ProblemDetails {
+		return caddyhttp.Error(http.StatusServiceUnavailable, reason)
+	}
+
+	p := problem{
+		Type:          "about:blank",
+		Title:         http.StatusText(http.StatusServiceUnavailable),
+		Status:        http.StatusServiceUnavailable,
+		Detail:        reason.Error(),
+		Breaker:       h.breaker.Name,
+		State:         h.breaker.State(),
+		Reason:        h.breaker.openReason(),
+		CorrelationID: r.Header.Get(h.CorrelationHeader),
+	}
+	if p.Reason != "" {
+		p.RunbookURL = h.breaker.RunbookURL
+	}
+	if p.CorrelationID == "" {
+		p.CorrelationID = newCorrelationID()
+	}
+	if d := h.breaker.retryAfter(); d > 0 {
+		p.RetryAfter = int64(math.Ceil(d.Seconds()))
+		w.Header().Set("Retry-After", strconv.FormatInt(p.RetryAfter, 10))
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return caddyhttp.Error(http.StatusServiceUnavailable, reason)
+	}
+	w.Header().Set(h.CorrelationHeader, p.CorrelationID)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, err = w.Write(body)
+	return err
+}
+
+// retryAfter returns how long until an open circuit closes, or 0
+// if it is not open or when it closes is not known, as while
+// draining.
+func (c *Simple) retryAfter() time.Duration {
+	if c.Draining() {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if atomic.LoadInt32(&c.tripped) == 0 {
+		return 0
+	}
+	return time.Until(c.openUntil)
+}
+
+// newCorrelationID returns a random ID for a rejected request that
+// did not carry one.
+func newCorrelationID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+const defaultCorrelationHeader = "X-Request-Id"
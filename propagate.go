@@ -0,0 +1,66 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// propagateTrip trips the named breakers that carry any of the labels
+// in propagate_trip_to, after c tripped on its own. Propagated trips
+// do not propagate further, so labels referring to each other cannot
+// make trips bounce between breakers.
+func (c *Simple) propagateTrip(reason string, d time.Duration) {
+	if len(c.PropagateTripTo) == 0 {
+		return
+	}
+	reason = fmt.Sprintf("propagated from %s: %s", c.Name, reason)
+	for _, name := range breakerNames() {
+		sibling, ok := lookupBreaker(name)
+		if !ok || sibling == c || !sibling.hasAnyLabel(c.PropagateTripTo) {
+			continue
+		}
+		if w, ok := sibling.maintenance(); ok && w.Mode == maintenanceSuppress {
+			continue
+		}
+		if sibling.changeLimited() {
+			continue
+		}
+		counts := sibling.metrics.windowCounts()
+		if !sibling.trip(ReasonPropagated, reason, d) {
+			continue
+		}
+		c.logger.Info("propagated trip to sibling breaker",
+			zap.String("name", c.Name),
+			zap.String("sibling", name))
+		sibling.guard.check()
+		go sibling.publish(SharedState{Open: true, Until: time.Now().Add(d), Reason: reason, Counts: counts})
+	}
+}
+
+// hasAnyLabel returns whether c carries any of labels.
+func (c *Simple) hasAnyLabel(labels []string) bool {
+	for _, have := range c.Labels {
+		for _, want := range labels {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
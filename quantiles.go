@@ -0,0 +1,203 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// quantileHist keeps the latencies of a window whose quantiles are
+// registered ahead of time. Latencies are counted in logarithmic bins
+// of 1% width, about the precision of the HDR histograms with two
+// significant figures. Each bucket of the window only holds the bins
+// that were hit, and a running total over the live buckets is kept
+// up to date as samples arrive and buckets expire, so reading the
+// registered quantiles walks the total once instead of merging full
+// histograms for every evaluation.
+type quantileHist struct {
+	buckets []sparseBucket
+	total   []int64 // per bin, over the live buckets
+	n       int64
+	rebased int64 // slot at which total was last rebuilt from the buckets
+}
+
+type sparseBucket struct {
+	slot   int64
+	counts map[int32]int64 // by bin
+}
+
+// sparseGrowth is the ratio between the bounds of consecutive bins.
+const sparseGrowth = 1.01
+
+var (
+	logSparseGrowth = math.Log(sparseGrowth)
+	sparseBins      = int(sparseBin(histMax)) + 1
+)
+
+// sparseBin returns the bin of a latency of us microseconds.
+func sparseBin(us int64) int32 {
+	if us < histMin {
+		us = histMin
+	}
+	return int32(math.Log(float64(us)) / logSparseGrowth)
+}
+
+// sparseValue returns the upper bound of bin in microseconds, which
+// is the value reported for latencies in it, like the highest
+// equivalent value of an HDR histogram.
+func sparseValue(bin int) int64 {
+	return int64(math.Ceil(math.Exp(float64(bin+1) * logSparseGrowth)))
+}
+
+func newQuantileHist() *quantileHist {
+	h := &quantileHist{
+		buckets: make([]sparseBucket, windowHistBuckets),
+		total:   make([]int64, sparseBins),
+	}
+	h.reset()
+	return h
+}
+
+func (h *quantileHist) record(now time.Duration, latency time.Duration) {
+	us := int64(latency / time.Microsecond)
+	if us > histMax {
+		return // dropped, as by the HDR histograms
+	}
+	slot := int64(now / windowHistResolution)
+	h.expire(slot)
+	b := &h.buckets[slot%int64(len(h.buckets))]
+	if b.slot != slot {
+		*b = sparseBucket{slot: slot, counts: make(map[int32]int64)}
+	}
+	bin := sparseBin(us)
+	b.counts[bin]++
+	h.total[bin]++
+	h.n++
+}
+
+// expire takes buckets that dropped out of the window at slot cur
+// out of the total.
+func (h *quantileHist) expire(cur int64) {
+	for i := range h.buckets {
+		b := &h.buckets[i]
+		if b.slot < 0 || b.slot > cur-int64(len(h.buckets)) {
+			continue
+		}
+		for bin, n := range b.counts {
+			h.total[bin] -= n
+			h.n -= n
+		}
+		*b = sparseBucket{slot: -1}
+	}
+	if cur-h.rebased >= int64(len(h.buckets)) {
+		h.rebaseline(cur)
+	}
+}
+
+// rebaseline rebuilds the running total from the live buckets once
+// per length of the window, so that the total cannot drift from the
+// buckets over a long uptime, whatever happens to it in between.
+func (h *quantileHist) rebaseline(cur int64) {
+	for i := range h.total {
+		h.total[i] = 0
+	}
+	h.n = 0
+	for _, b := range h.buckets {
+		if b.slot < 0 {
+			continue
+		}
+		for bin, n := range b.counts {
+			h.total[bin] += n
+			h.n += n
+		}
+	}
+	h.rebased = cur
+}
+
+// quantiles returns the latencies at the given percentiles over the
+// window at now. The registered quantiles are high, so the total is
+// walked from the slowest bin down, which ends after few bins. Like
+// an HDR histogram, an empty window reports 0.
+func (h *quantileHist) quantiles(now time.Duration, qs []float64) []time.Duration {
+	h.expire(int64(now / windowHistResolution))
+	out := make([]time.Duration, len(qs))
+	if h.n == 0 {
+		return out
+	}
+
+	// descending ranks, so that one walk finds them all
+	order := make([]int, len(qs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return qs[order[i]] > qs[order[j]] })
+
+	var above int64 // samples in bins above the current one
+	next := 0
+	for bin := len(h.total) - 1; bin >= 0 && next < len(order); bin-- {
+		above += h.total[bin]
+		for next < len(order) && h.n-above < quantileRank(qs[order[next]], h.n) {
+			out[order[next]] = time.Duration(sparseValue(bin)) * time.Microsecond
+			next++
+		}
+	}
+	return out
+}
+
+// quantileRank returns how many of n samples lie at or below the
+// latency at percentile q, rounded as HDR histograms do.
+func quantileRank(q float64, n int64) int64 {
+	rank := int64(q/100*float64(n) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	return rank
+}
+
+func (h *quantileHist) reset() {
+	for i := range h.buckets {
+		h.buckets[i] = sparseBucket{slot: -1}
+	}
+	for i := range h.total {
+		h.total[i] = 0
+	}
+	h.n = 0
+}
+
+// validateQuantiles checks the registered quantiles of a latency
+// factor, which must include the ones it evaluates.
+func (l LatencyFactor) validateQuantiles() error {
+	if len(l.Quantiles) == 0 {
+		return nil
+	}
+	for _, q := range l.Quantiles {
+		if q <= 0 || q > 100 {
+			return fmt.Errorf("latency: quantiles must be above 0 and at most 100")
+		}
+	}
+	if l.Confidence > 0 {
+		return fmt.Errorf("latency: quantiles cannot be registered with confidence, which reads the latency at a rank that depends on the sample size")
+	}
+	want, _ := l.guardedQuantile(0)
+	for _, q := range l.Quantiles {
+		if q == want {
+			return nil
+		}
+	}
+	return fmt.Errorf("latency: quantiles must include p%v, which the factor evaluates", want)
+}
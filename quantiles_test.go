@@ -0,0 +1,85 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuantileHistRebaselineOverMonths(t *testing.T) {
+	h := newQuantileHist()
+	const months = 90 * 24 * time.Hour
+	step := windowHistResolution / 2
+	var now time.Duration
+	for now = 0; now < months; now += step {
+		// a burst every window keeps the live buckets uneven
+		n := 1 + int(now/step)%7
+		for i := 0; i < n; i++ {
+			h.record(now, time.Duration(1+i)*time.Millisecond)
+		}
+		if int64(now/step)%1000 == 0 {
+			checkQuantileTotals(t, h, now)
+		}
+	}
+	checkQuantileTotals(t, h, now)
+
+	// the window empties after a long pause
+	now += months
+	if got := h.quantiles(now, []float64{99}); got[0] != 0 {
+		t.Errorf("p99 of empty window = %s, want 0", got[0])
+	}
+	checkQuantileTotals(t, h, now)
+	if h.n != 0 {
+		t.Errorf("n of empty window = %d", h.n)
+	}
+}
+
+// checkQuantileTotals checks that the running totals of h equal the
+// sums of its live buckets at now.
+func checkQuantileTotals(t *testing.T, h *quantileHist, now time.Duration) {
+	t.Helper()
+	h.expire(int64(now / windowHistResolution))
+	want := make(map[int32]int64)
+	var n int64
+	for _, b := range h.buckets {
+		if b.slot < 0 {
+			continue
+		}
+		for bin, c := range b.counts {
+			want[bin] += c
+			n += c
+		}
+	}
+	if h.n != n {
+		t.Fatalf("at %s: n = %d, live buckets hold %d", now, h.n, n)
+	}
+	for bin, total := range h.total {
+		if total != want[int32(bin)] {
+			t.Fatalf("at %s: total of bin %d = %d, live buckets hold %d", now, bin, total, want[int32(bin)])
+		}
+	}
+}
+
+func TestQuantileHistRebaselineRepairsDrift(t *testing.T) {
+	h := newQuantileHist()
+	h.record(0, time.Millisecond)
+	// corrupt the running totals, as a drifted counter would be
+	h.total[sparseBin(1000)] += 5
+	h.n += 5
+	now := time.Duration(windowHistBuckets) * windowHistResolution
+	h.record(now, time.Millisecond)
+	checkQuantileTotals(t, h, now)
+}
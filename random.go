@@ -0,0 +1,80 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Random is a source of pseudo-random numbers for the decisions of a
+// breaker that are made by chance, such as sampling. It need not be
+// cryptographically secure, but must be safe for concurrent use.
+type Random interface {
+	// Float64 returns a number in [0.0, 1.0).
+	Float64() float64
+	// Int63n returns a number in [0, n). It panics if n <= 0.
+	Int63n(n int64) int64
+}
+
+// NewRandom returns a Random seeded with seed. Two sources with the
+// same seed return the same sequence, which makes the chance decisions
+// of a breaker reproducible in tests and simulations.
+func NewRandom(seed int64) Random {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+// lockedRand makes a *rand.Rand, which is not safe for
+// concurrent use by itself, safe for concurrent use.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+func (l *lockedRand) Int63n(n int64) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Int63n(n)
+}
+
+// SetRandom replaces the random source of the breaker and of its
+// per-upstream states, for example with NewRandom to make it behave
+// deterministically. It must be called before the breaker is used.
+func (c *Simple) SetRandom(r Random) {
+	c.rand = r
+	if c.upstreams != nil {
+		c.upstreams.mu.Lock()
+		for _, u := range c.upstreams.m {
+			u.SetRandom(r)
+		}
+		c.upstreams.mu.Unlock()
+	}
+}
+
+// newRandom returns the random source configured by seed: seeded
+// with it if it is set, otherwise with the current time.
+func newRandom(seed int64) Random {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return NewRandom(seed)
+}
@@ -0,0 +1,145 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// recordQueue coalesces samples recorded concurrently, such as those
+// of HTTP/2 streams completing together, into batches for a single
+// consumer goroutine. Producers never take a lock: the queue is an
+// intrusive multi-producer, single-consumer linked list (after Dmitry
+// Vyukov's), and the consumer is only woken when it went to sleep.
+type recordQueue struct {
+	head     unsafe.Pointer // *recordNode; most recently pushed, swapped by producers
+	tail     *recordNode    // last consumed; only touched by the consumer
+	sleeping int32          // accessed atomically; 1 while the consumer waits for wake
+	wake     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+type recordNode struct {
+	next   unsafe.Pointer // *recordNode
+	sample Sample
+}
+
+// startRecordQueue starts coalescing the samples submitted to c.
+func (c *Simple) startRecordQueue() {
+	stub := new(recordNode)
+	q := &recordQueue{
+		head: unsafe.Pointer(stub),
+		tail: stub,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	c.records = q
+	go q.consume(c)
+}
+
+// stopRecordQueue records what is left in the queue and stops
+// its consumer.
+func (c *Simple) stopRecordQueue() {
+	if c.records == nil {
+		return
+	}
+	close(c.records.stop)
+	<-c.records.done
+}
+
+// submit records s, through the queue if coalesce_records is
+// enabled. Without the queue, it must be run in a separate goroutine.
+func (c *Simple) submit(s Sample) {
+	if c.records == nil {
+		c.Record(s)
+		return
+	}
+	c.records.push(s)
+}
+
+func (q *recordQueue) push(s Sample) {
+	n := &recordNode{sample: s}
+	prev := (*recordNode)(atomic.SwapPointer(&q.head, unsafe.Pointer(n)))
+	atomic.StorePointer(&prev.next, unsafe.Pointer(n))
+	if atomic.LoadInt32(&q.sleeping) == 1 && atomic.CompareAndSwapInt32(&q.sleeping, 1, 0) {
+		q.wake <- struct{}{}
+	}
+}
+
+// pop returns the oldest sample in the queue. It returns false if
+// the queue is empty, or if the oldest sample is still being pushed.
+func (q *recordQueue) pop() (Sample, bool) {
+	next := (*recordNode)(atomic.LoadPointer(&q.tail.next))
+	if next == nil {
+		return Sample{}, false
+	}
+	q.tail = next
+	s := next.sample
+	next.sample = Sample{} // the node stays around as the new tail
+	return s, true
+}
+
+func (q *recordQueue) empty() bool {
+	return atomic.LoadPointer(&q.tail.next) == nil
+}
+
+// consume records the queued samples in batches until the queue
+// is stopped.
+func (q *recordQueue) consume(c *Simple) {
+	defer close(q.done)
+	batch := make([]Sample, 0, maxRecordBatch)
+	for {
+		for len(batch) < maxRecordBatch {
+			s, ok := q.pop()
+			if !ok {
+				break
+			}
+			batch = append(batch, s)
+		}
+		if len(batch) > 0 {
+			c.RecordBatch(batch)
+			batch = batch[:0]
+			continue
+		}
+
+		atomic.StoreInt32(&q.sleeping, 1)
+		if !q.empty() {
+			// a producer pushed after the queue was drained; if it
+			// also saw the consumer sleeping, its wake-up is pending
+			if !atomic.CompareAndSwapInt32(&q.sleeping, 1, 0) {
+				<-q.wake
+			}
+			continue
+		}
+		select {
+		case <-q.wake:
+		case <-q.stop:
+			for s, ok := q.pop(); ok; s, ok = q.pop() {
+				batch = append(batch, s)
+			}
+			if len(batch) > 0 {
+				c.RecordBatch(batch)
+			}
+			return
+		}
+	}
+}
+
+// maxRecordBatch is the most samples recorded by the queue at once,
+// which bounds how long evaluation is delayed during a long burst.
+const maxRecordBatch = 128
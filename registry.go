@@ -0,0 +1,63 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"sort"
+	"sync"
+)
+
+// breakers holds all named circuit breakers in this process so
+// they can be inspected through the admin API. During a config
+// reload the new breaker replaces the old one before the old one
+// is cleaned up, so removal only happens if the entry still points
+// to the breaker being cleaned up.
+var breakers = struct {
+	sync.RWMutex
+	m map[string]*Simple
+}{m: make(map[string]*Simple)}
+
+func registerBreaker(c *Simple) {
+	breakers.Lock()
+	breakers.m[c.Name] = c
+	breakers.Unlock()
+}
+
+func unregisterBreaker(c *Simple) {
+	breakers.Lock()
+	if breakers.m[c.Name] == c {
+		delete(breakers.m, c.Name)
+	}
+	breakers.Unlock()
+}
+
+func lookupBreaker(name string) (*Simple, bool) {
+	breakers.RLock()
+	defer breakers.RUnlock()
+	c, ok := breakers.m[name]
+	return c, ok
+}
+
+// breakerNames returns the names of all registered breakers, sorted.
+func breakerNames() []string {
+	breakers.RLock()
+	defer breakers.RUnlock()
+	names := make([]string, 0, len(breakers.m))
+	for name := range breakers.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
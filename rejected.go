@@ -0,0 +1,111 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RejectedRequest describes a request that the breaker turned away,
+// as sampled for analysis after an incident.
+type RejectedRequest struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Host   string    `json:"host"`
+	Path   string    `json:"path"`
+	// The IP address of the client that sent the request.
+	Client string `json:"client"`
+	// The upstream the request was rejected for, if the rejection
+	// was for a particular upstream.
+	Upstream string `json:"upstream,omitempty"`
+	// The state of the circuit and why the request was rejected.
+	State  State  `json:"state"`
+	Reason string `json:"reason"`
+}
+
+// defaultRejectedSampleRate is the fraction of rejected requests
+// that are sampled if rejected_samples is set without a rate.
+const defaultRejectedSampleRate = 0.01
+
+// rejectedLog is a bounded ring buffer of sampled rejected requests.
+type rejectedLog struct {
+	mu      sync.Mutex
+	entries []RejectedRequest
+	next    int
+	full    bool
+}
+
+func newRejectedLog(size int) *rejectedLog {
+	return &rejectedLog{entries: make([]RejectedRequest, size)}
+}
+
+// record appends a rejected request, overwriting the oldest one
+// once the buffer is full.
+func (l *rejectedLog) record(rr RejectedRequest) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = rr
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// requests returns the sampled rejected requests, oldest first.
+func (l *rejectedLog) requests() []RejectedRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]RejectedRequest(nil), l.entries[:l.next]...)
+	}
+	out := make([]RejectedRequest, 0, len(l.entries))
+	out = append(out, l.entries[l.next:]...)
+	return append(out, l.entries[:l.next]...)
+}
+
+// sampleRejected records r, which was rejected for reason, if it is
+// sampled at rejected_sample_rate. upstream is the upstream it was
+// rejected for, if any. It is a no-op unless rejected_samples is set.
+func (c *Simple) sampleRejected(r *http.Request, upstream string, reason error) {
+	if c.rejected == nil || c.rand.Float64() >= c.RejectedSampleRate {
+		return
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	c.rejected.record(RejectedRequest{
+		Time:     time.Now(),
+		Method:   r.Method,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		Client:   client,
+		Upstream: upstream,
+		State:    c.State(),
+		Reason:   reason.Error(),
+	})
+}
+
+// Rejected returns the sampled rejected requests, oldest first, or
+// nil if rejected_samples is not enabled.
+func (c *Simple) Rejected() []RejectedRequest {
+	if c.rejected == nil {
+		return nil
+	}
+	return c.rejected.requests()
+}
@@ -0,0 +1,48 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// tripReason returns the reason to record for a trip of the breaker
+// for the given cause: the computed reason, or the trip_reason
+// template with its placeholders replaced, if one is configured.
+func (c *Simple) tripReason(cause Reason, reason string) string {
+	if c.TripReason == "" {
+		return reason
+	}
+	repl := caddy.NewReplacer()
+	repl.Set("circuit_breaker.name", c.Name)
+	repl.Set("circuit_breaker.factor", c.Factor)
+	repl.Set("circuit_breaker.cause", cause.String())
+	repl.Set("circuit_breaker.reason", reason)
+	repl.Set("circuit_breaker.runbook_url", c.RunbookURL)
+	return repl.ReplaceAll(c.TripReason, "")
+}
+
+// openReason returns the reason of the trip that opened the circuit,
+// or "" if it is not open.
+func (c *Simple) openReason() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if atomic.LoadInt32(&c.tripped) == 0 {
+		return ""
+	}
+	return c.openedFor
+}
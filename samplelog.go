@@ -0,0 +1,119 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"net/http"
+	"time"
+	"unsafe"
+
+	"github.com/vulcand/oxy/memmetrics"
+)
+
+// sampleLog is the exact alternative to the buckets of a window: it
+// keeps every sample with its time, so that samples expire exactly
+// when they fall out of the window rather than a whole bucket at a
+// time. Counts cover the same 10s and latencies the same 60s as the
+// buckets. It holds at most a fixed number of samples, dropping the
+// oldest beyond that, so its memory is bounded. Its methods are
+// called by window with the window's lock held.
+type sampleLog struct {
+	entries []logEntry // ring buffer
+	start   int        // index of the oldest entry
+	n       int        // number of entries
+	onDrop  func()     // called whenever a sample is dropped for space
+}
+
+type logEntry struct {
+	at      time.Duration
+	code    int
+	latency time.Duration
+}
+
+func newSampleLog(capacity int, onDrop func()) *sampleLog {
+	return &sampleLog{entries: make([]logEntry, capacity), onDrop: onDrop}
+}
+
+func (l *sampleLog) record(now time.Duration, code int, latency time.Duration) {
+	l.expire(now)
+	if l.n == len(l.entries) {
+		l.start = (l.start + 1) % len(l.entries)
+		l.n--
+		if l.onDrop != nil {
+			l.onDrop()
+		}
+	}
+	l.entries[(l.start+l.n)%len(l.entries)] = logEntry{at: now, code: code, latency: latency}
+	l.n++
+}
+
+// expire drops the samples older than the longest span of the window.
+func (l *sampleLog) expire(now time.Duration) {
+	for l.n > 0 && now-l.entries[l.start].at >= logLatencySpan {
+		l.start = (l.start + 1) % len(l.entries)
+		l.n--
+	}
+}
+
+// each calls f for every sample within span of now, oldest first.
+func (l *sampleLog) each(now, span time.Duration, f func(logEntry)) {
+	for i := 0; i < l.n; i++ {
+		e := l.entries[(l.start+i)%len(l.entries)]
+		if now-e.at < span {
+			f(e)
+		}
+	}
+}
+
+func (l *sampleLog) counts(now time.Duration) (total, netErrors int64, codes map[int]int64) {
+	codes = make(map[int]int64)
+	l.each(now, logCountSpan, func(e logEntry) {
+		total++
+		if e.code == http.StatusGatewayTimeout || e.code == http.StatusBadGateway {
+			netErrors++
+		}
+		codes[e.code]++
+	})
+	return total, netErrors, codes
+}
+
+func (l *sampleLog) latencyHistogram(now time.Duration) (*memmetrics.HDRHistogram, error) {
+	hist, err := memmetrics.NewHDRHistogram(histMin, histMax, histSigFigs)
+	if err != nil {
+		return nil, err
+	}
+	l.each(now, logLatencySpan, func(e logEntry) {
+		if e.latency != noLatency {
+			_ = hist.RecordLatencies(e.latency, 1)
+		}
+	})
+	return hist, nil
+}
+
+func (l *sampleLog) reset() {
+	l.start, l.n = 0, 0
+}
+
+func (l *sampleLog) memoryUsage() int64 {
+	return int64(unsafe.Sizeof(*l)) + int64(len(l.entries))*int64(unsafe.Sizeof(logEntry{}))
+}
+
+// the same spans as the buckets of a window
+const (
+	logCountSpan   = windowCountBuckets * windowCountResolution
+	logLatencySpan = windowHistBuckets * windowHistResolution
+
+	defaultLogCapacity = 10000
+)
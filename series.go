@@ -0,0 +1,144 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/memmetrics"
+)
+
+// timeSeries keeps per-second request counts and latencies for
+// the last few seconds, for drawing simple graphs. Latencies are
+// kept at a coarser precision than in the window to save memory.
+type timeSeries struct {
+	mu      sync.Mutex
+	elapsed func() time.Duration
+	start   time.Time // wall clock time at elapsed() == 0
+	buckets []seriesBucket
+}
+
+type seriesBucket struct {
+	slot     int64
+	requests int64
+	errors   int64
+	hist     *memmetrics.HDRHistogram
+	factors  *FactorValues
+}
+
+// SeriesPoint is one second of a breaker's time series.
+type SeriesPoint struct {
+	Time     time.Time `json:"time"`
+	Requests int64     `json:"requests"`
+	Errors   int64     `json:"errors"`         // responses with a 5xx status
+	P95      int64     `json:"p95_latency_us"` // in microseconds
+	// The values of all factors early in the second, with
+	// export_all_factors enabled.
+	Factors *FactorValues `json:"factors,omitempty"`
+}
+
+func newTimeSeries(seconds int, elapsed func() time.Duration) (*timeSeries, error) {
+	if elapsed == nil {
+		elapsed = monotonicClock()
+	}
+	ts := &timeSeries{
+		elapsed: elapsed,
+		start:   time.Now().Add(-elapsed()),
+		buckets: make([]seriesBucket, seconds),
+	}
+	for i := range ts.buckets {
+		h, err := memmetrics.NewHDRHistogram(histMin, histMax, seriesSigFigs)
+		if err != nil {
+			return nil, err
+		}
+		ts.buckets[i] = seriesBucket{slot: -1, hist: h}
+	}
+	return ts, nil
+}
+
+func (ts *timeSeries) record(statusCode int, latency time.Duration) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.recordLocked(statusCode, latency)
+}
+
+// recordBatch records several samples while holding the lock once.
+func (ts *timeSeries) recordBatch(samples []Sample) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, s := range samples {
+		ts.recordLocked(s.StatusCode, s.Latency)
+	}
+}
+
+func (ts *timeSeries) recordLocked(statusCode int, latency time.Duration) {
+	slot := int64(ts.elapsed() / time.Second)
+	b := &ts.buckets[slot%int64(len(ts.buckets))]
+	if b.slot != slot {
+		b.slot = slot
+		b.requests = 0
+		b.errors = 0
+		b.hist.Reset()
+		b.factors = nil
+	}
+	b.requests++
+	if statusCode >= 500 && statusCode < 600 {
+		b.errors++
+	}
+	if latency != noLatency {
+		_ = b.hist.RecordLatencies(latency, 1)
+	}
+}
+
+// recordFactors sets the factor values of the current second,
+// unless they were already set, to the result of compute.
+func (ts *timeSeries) recordFactors(compute func() FactorValues) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	slot := int64(ts.elapsed() / time.Second)
+	b := &ts.buckets[slot%int64(len(ts.buckets))]
+	if b.slot != slot || b.factors != nil {
+		return
+	}
+	v := compute()
+	b.factors = &v
+}
+
+// points returns one point per second, oldest first, including
+// seconds without any requests.
+func (ts *timeSeries) points() []SeriesPoint {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	cur := int64(ts.elapsed() / time.Second)
+	n := int64(len(ts.buckets))
+	points := make([]SeriesPoint, 0, n)
+	for slot := cur - n + 1; slot <= cur; slot++ {
+		if slot < 0 {
+			continue
+		}
+		p := SeriesPoint{Time: ts.start.Add(time.Duration(slot) * time.Second)}
+		if b := &ts.buckets[slot%n]; b.slot == slot {
+			p.Requests = b.requests
+			p.Errors = b.errors
+			p.P95 = b.hist.ValueAtQuantile(95)
+			p.Factors = b.factors
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+const seriesSigFigs = 1
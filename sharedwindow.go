@@ -0,0 +1,118 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// windowShare is the window of a named breaker shared with the
+// breakers that name it in window_of. Either side may be provisioned
+// first, so the share is created by whichever comes first, and kept
+// as long as any breaker uses it. This also keeps the window across
+// config reloads, while the old and new breakers overlap.
+type windowShare struct {
+	w       *window
+	members map[*Simple]bool // true for followers
+}
+
+// windowShares holds the shared windows, by the name of the breaker
+// that records into them. n is the number of shares, accessed
+// atomically, so that breakers need not take the lock on every
+// record while no window is shared.
+var windowShares = struct {
+	sync.Mutex
+	m map[string]*windowShare
+	n int32
+}{m: make(map[string]*windowShare)}
+
+// joinWindowShare makes c use the shared window it is part of, if any:
+// as a follower if it has window_of, or as the recording breaker if
+// another breaker names it in window_of.
+func (c *Simple) joinWindowShare() {
+	windowShares.Lock()
+	defer windowShares.Unlock()
+	switch {
+	case c.WindowOf != "":
+		s := windowShares.m[c.WindowOf]
+		if s == nil {
+			s = &windowShare{w: c.metrics, members: make(map[*Simple]bool)}
+			if leader, ok := lookupBreaker(c.WindowOf); ok && leader.WindowOf == "" {
+				s.w = leader.metrics
+				s.members[leader] = false
+			}
+			windowShares.m[c.WindowOf] = s
+			atomic.AddInt32(&windowShares.n, 1)
+		}
+		s.members[c] = true
+		c.metrics = s.w
+	case c.Name != "":
+		if s := windowShares.m[c.Name]; s != nil {
+			s.members[c] = false
+			c.metrics = s.w
+		}
+	}
+}
+
+// leaveWindowShare undoes joinWindowShare.
+func (c *Simple) leaveWindowShare() {
+	name := c.WindowOf
+	if name == "" {
+		name = c.Name
+	}
+	windowShares.Lock()
+	defer windowShares.Unlock()
+	s := windowShares.m[name]
+	if s == nil {
+		return
+	}
+	if _, ok := s.members[c]; !ok {
+		return
+	}
+	delete(s.members, c)
+	if len(s.members) == 0 {
+		delete(windowShares.m, name)
+		atomic.AddInt32(&windowShares.n, -1)
+	}
+}
+
+// evaluateFollowers evaluates the breakers that share the window of c,
+// once c recorded into it.
+func (c *Simple) evaluateFollowers() {
+	if c.Name == "" || c.WindowOf != "" || atomic.LoadInt32(&windowShares.n) == 0 {
+		return
+	}
+	windowShares.Lock()
+	s := windowShares.m[c.Name]
+	if s == nil {
+		windowShares.Unlock()
+		return
+	}
+	if _, ok := s.members[c]; !ok {
+		windowShares.Unlock()
+		return
+	}
+	followers := make([]*Simple, 0, len(s.members))
+	for f, follower := range s.members {
+		if follower {
+			followers = append(followers, f)
+		}
+	}
+	windowShares.Unlock()
+	for _, f := range followers {
+		f.checkAndSet()
+	}
+}
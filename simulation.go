@@ -0,0 +1,230 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Simulation runs a breaker on virtual time, for regression tests
+// of breaker settings, such as in the CI pipeline of the repository
+// holding the Caddy config: feed it synthetic samples, advance the
+// time, and assert whether and when the circuit tripped. Nothing
+// waits for real time to pass, so an hour of traffic is simulated
+// in moments, and runs with the same seed and inputs are the same.
+//
+//	sim, err := circuitbreaker.NewSimulation(cfg, 1)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer sim.Close()
+//	sim.Run(circuitbreaker.SoakPhase{Duration: time.Minute, RPS: 50, ErrorRate: 0.01})
+//	if sim.State() != circuitbreaker.StateClosed {
+//		t.Errorf("1%% errors tripped the breaker: %v", sim.Transitions())
+//	}
+//
+// A Simulation is not safe for concurrent use.
+type Simulation struct {
+	c           *Simple
+	now         int64 // accessed atomically; the virtual time
+	rnd         Random
+	mu          sync.Mutex
+	timers      []simulatedTimer
+	transitions []SoakTransition
+	seen        uint64 // transitions of the breaker collected so far
+}
+
+// simulatedTimer is a call scheduled on the virtual time.
+type simulatedTimer struct {
+	at time.Duration
+	f  func()
+}
+
+// NewSimulation returns a simulation of a breaker with the given
+// config, created as with New. Settings that depend on real time or
+// on other breakers cannot be simulated: dynamic, coalesce_records,
+// window_of, and window_file. The random source of the breaker and
+// of the synthetic load in Run are seeded with seed.
+func NewSimulation(cfg Config, seed int64) (*Simulation, error) {
+	switch {
+	case cfg.Dynamic != nil:
+		return nil, fmt.Errorf("dynamic cannot be simulated")
+	case cfg.CoalesceRecords:
+		return nil, fmt.Errorf("coalesce_records cannot be simulated")
+	case cfg.WindowOf != "":
+		return nil, fmt.Errorf("window_of cannot be simulated")
+	case cfg.WindowFile != "":
+		return nil, fmt.Errorf("window_file cannot be simulated")
+	}
+	s := &Simulation{rnd: NewRandom(seed)}
+	cfg.RandomSeed = seed
+	c, err := newStandalone(cfg, func(c *Simple) {
+		c.logger = zap.NewNop()
+		c.clock = s.Now
+		c.afterFunc = s.afterFunc
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.c = c
+	return s, nil
+}
+
+// Breaker returns the simulated breaker, for inspecting more than
+// the simulation reports, such as its FactorValues or Evaluations.
+func (s *Simulation) Breaker() *Simple {
+	return s.c
+}
+
+// Now returns the virtual time since the simulation started.
+func (s *Simulation) Now() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.now))
+}
+
+func (s *Simulation) afterFunc(d time.Duration, f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timers = append(s.timers, simulatedTimer{at: s.Now() + d, f: f})
+}
+
+// Advance moves the virtual time forward by d, running what the
+// breaker scheduled in the meantime, such as closing the circuit
+// once the trip duration elapsed, at its time and in order.
+func (s *Simulation) Advance(d time.Duration) {
+	if d < 0 {
+		return
+	}
+	end := s.Now() + d
+	for {
+		s.mu.Lock()
+		sort.SliceStable(s.timers, func(i, j int) bool { return s.timers[i].at < s.timers[j].at })
+		if len(s.timers) == 0 || s.timers[0].at > end {
+			s.mu.Unlock()
+			break
+		}
+		t := s.timers[0]
+		s.timers = s.timers[1:]
+		s.mu.Unlock()
+		if t.at > s.Now() {
+			atomic.StoreInt64(&s.now, int64(t.at))
+		}
+		t.f()
+		s.collect()
+	}
+	atomic.StoreInt64(&s.now, int64(end))
+}
+
+// Record records samples at the current virtual time, whatever the
+// state of the circuit.
+func (s *Simulation) Record(samples ...Sample) {
+	s.c.RecordBatch(samples)
+	s.collect()
+}
+
+// Request records sample as a request that first asks the breaker
+// whether it may go through, and returns whether it did. Rejected
+// requests are not recorded, as with a real upstream.
+func (s *Simulation) Request(sample Sample) bool {
+	if !s.c.OK() {
+		return false
+	}
+	s.c.Record(sample)
+	s.collect()
+	return true
+}
+
+// Run sends the synthetic load of the phases through Request, with
+// the requests of each phase spread evenly over it, advancing the
+// virtual time to the end of each phase, and returns their counts.
+// Latencies and failures are drawn as in Soak.
+func (s *Simulation) Run(phases ...SoakPhase) ([]SoakPhaseResult, error) {
+	results := make([]SoakPhaseResult, 0, len(phases))
+	for i, p := range phases {
+		if p.ErrorStatus == 0 {
+			p.ErrorStatus = defaultSoakErrorStatus
+		}
+		if err := p.validate(); err != nil {
+			return results, fmt.Errorf("phase %d: %v", i+1, err)
+		}
+		var res SoakPhaseResult
+		n := int64(math.Round(p.RPS * p.Duration.Seconds()))
+		start := s.Now()
+		for j := int64(0); j < n; j++ {
+			s.Advance(start + time.Duration(float64(p.Duration)*float64(j)/float64(n)) - s.Now())
+			sample := Sample{StatusCode: 200, Latency: soakLatency(p.Latency, s.rnd)}
+			failed := s.rnd.Float64() < p.ErrorRate
+			if failed {
+				sample.StatusCode = p.ErrorStatus
+			}
+			if !s.Request(sample) {
+				res.Rejected++
+				continue
+			}
+			res.Requests++
+			if failed {
+				res.Failures++
+			}
+		}
+		s.Advance(start + p.Duration - s.Now())
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// State returns the state of the circuit.
+func (s *Simulation) State() State {
+	return s.c.State()
+}
+
+// Transitions returns the state transitions so far, oldest first,
+// with their virtual time as the offset. Their Time is the real time
+// at which they were simulated.
+func (s *Simulation) Transitions() []SoakTransition {
+	s.collect()
+	return append([]SoakTransition(nil), s.transitions...)
+}
+
+// Tripped returns whether the circuit tripped at any time so far.
+func (s *Simulation) Tripped() bool {
+	for _, t := range s.Transitions() {
+		if t.To == StateOpen {
+			return true
+		}
+	}
+	return false
+}
+
+// collect notes the transitions that happened since the last call.
+func (s *Simulation) collect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var fresh []Transition
+	fresh, s.seen = s.c.history.after(s.seen)
+	for _, t := range fresh {
+		s.transitions = append(s.transitions, SoakTransition{Offset: s.Now(), Transition: t})
+	}
+}
+
+// Close cleans up the simulated breaker.
+func (s *Simulation) Close() error {
+	return s.c.Cleanup()
+}
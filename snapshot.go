@@ -0,0 +1,91 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import "time"
+
+// WindowSnapshot holds values of a window read at the same instant,
+// so that factors combining several of them, such as the error ratio
+// and a latency quantile, do not base a decision on values that
+// changed in between under concurrent recording.
+type WindowSnapshot struct {
+	// The number of requests in the window.
+	Requests int64
+	// The share of 502 and 504 responses.
+	NetworkErrorRatio float64
+	// The number of responses per status code.
+	StatusCodes map[int]int64
+	// The latencies at the quantiles the snapshot was taken with, in
+	// the same order.
+	Latencies []time.Duration
+	// The rate of requests per second over the window, or over the
+	// time since the window was last reset, if shorter, but at least
+	// one second.
+	RPS float64
+}
+
+// Snapshot implements Window.
+func (w *window) Snapshot(qs ...float64) (WindowSnapshot, error) {
+	return w.snapshot(func(int64) []float64 { return qs })
+}
+
+// snapshot reads the window at one instant under its lock, with the
+// latency quantiles chosen by qs from the number of requests, as the
+// latency factor guards its quantile against too few samples. With a
+// fixed histogram, which is recorded without the lock, the latencies
+// are read at the same instant, but may include samples recorded
+// while the snapshot was taken.
+func (w *window) snapshot(qs func(requests int64) []float64) (WindowSnapshot, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.elapsed()
+
+	var s WindowSnapshot
+	var netErrors int64
+	if w.log != nil {
+		s.Requests, netErrors, s.StatusCodes = w.log.counts(now)
+	} else {
+		s.StatusCodes = make(map[int]int64)
+		w.liveCounts(now, func(b *countBucket) {
+			s.Requests += b.total
+			netErrors += b.netErrors
+			for code, n := range b.codes {
+				s.StatusCodes[code] += n
+			}
+		})
+	}
+	if s.Requests > 0 {
+		s.NetworkErrorRatio = float64(netErrors) / float64(s.Requests)
+	}
+	// a window reset a moment ago counts as one bucket old, or the
+	// rate of its first requests would be far off
+	span := now - w.since
+	switch {
+	case span < windowCountResolution:
+		span = windowCountResolution
+	case span > windowCountBuckets*windowCountResolution:
+		span = windowCountBuckets * windowCountResolution
+	}
+	s.RPS = float64(s.Requests) / span.Seconds()
+
+	if quantiles := qs(s.Requests); len(quantiles) > 0 {
+		latencies, err := w.latencyQuantilesAt(now, quantiles)
+		if err != nil {
+			return s, err
+		}
+		s.Latencies = latencies
+	}
+	return s, nil
+}
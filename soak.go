@@ -0,0 +1,211 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SoakPhase is one phase of the synthetic load of a soak test.
+type SoakPhase struct {
+	// How long the phase lasts.
+	Duration time.Duration
+	// The number of requests per second.
+	RPS float64
+	// The share of requests that fail, from 0 to 1.
+	ErrorRate float64
+	// The status code of failed requests. The default is 502.
+	ErrorStatus int
+	// The mean latency of requests; latencies are spread around it
+	// with a long tail. Failed requests have the same latencies.
+	Latency time.Duration
+}
+
+// SoakResult is the outcome of a soak test.
+type SoakResult struct {
+	// The state transitions of the breaker, with their time since
+	// the start of the test.
+	Transitions []SoakTransition
+	// The counts of each phase.
+	Phases []SoakPhaseResult
+}
+
+// SoakTransition is a state transition during a soak test.
+type SoakTransition struct {
+	Offset time.Duration
+	Transition
+}
+
+// SoakPhaseResult counts the requests of a phase of a soak test.
+type SoakPhaseResult struct {
+	// The requests let through and recorded.
+	Requests int64
+	// The requests that failed.
+	Failures int64
+	// The requests rejected because the circuit was open.
+	Rejected int64
+}
+
+const (
+	// soakTick is how often a soak test sends the requests that are due.
+	soakTick               = 10 * time.Millisecond
+	defaultSoakErrorStatus = 502
+)
+
+// Soak drives synthetic request outcomes through a breaker with the
+// given config, phase after phase, in real time, and returns when it
+// tripped and closed, so that settings can be validated under
+// realistic load before they reach production. Rejected requests are
+// not recorded, as with a real upstream. The breaker is created with
+// New, so the config cannot use a storage, bypass matchers, or custom
+// factor modules. The random source is seeded with seed, so two runs
+// with the same seed produce the same load.
+func Soak(cfg Config, phases []SoakPhase, seed int64) (SoakResult, error) {
+	phases = append([]SoakPhase(nil), phases...)
+	for i := range phases {
+		if phases[i].ErrorStatus == 0 {
+			phases[i].ErrorStatus = defaultSoakErrorStatus
+		}
+		if err := phases[i].validate(); err != nil {
+			return SoakResult{}, fmt.Errorf("phase %d: %v", i+1, err)
+		}
+	}
+	c, err := New(cfg)
+	if err != nil {
+		return SoakResult{}, err
+	}
+	defer c.Cleanup()
+	// the result has the timeline; don't log it as well
+	c.logger = zap.NewNop()
+	rnd := NewRandom(seed)
+
+	var result SoakResult
+	start := time.Now()
+	var seen uint64 // transitions of the breaker collected so far
+	collect := func() {
+		var fresh []Transition
+		fresh, seen = c.history.after(seen)
+		for _, t := range fresh {
+			result.Transitions = append(result.Transitions, SoakTransition{Offset: t.Time.Sub(start), Transition: t})
+		}
+	}
+
+	ticker := time.NewTicker(soakTick)
+	defer ticker.Stop()
+	for _, p := range phases {
+		var res SoakPhaseResult
+		phaseStart := time.Now()
+		var sent int64
+		for elapsed := time.Duration(0); elapsed < p.Duration; elapsed = time.Since(phaseStart) {
+			<-ticker.C
+			due := int64(p.RPS*math.Min(time.Since(phaseStart).Seconds(), p.Duration.Seconds())) - sent
+			for ; due > 0; due-- {
+				sent++
+				if !c.OK() {
+					res.Rejected++
+					continue
+				}
+				s := Sample{StatusCode: 200, Latency: soakLatency(p.Latency, rnd)}
+				if rnd.Float64() < p.ErrorRate {
+					s.StatusCode = p.ErrorStatus
+					res.Failures++
+				}
+				res.Requests++
+				c.Record(s)
+			}
+			collect()
+		}
+		result.Phases = append(result.Phases, res)
+	}
+	collect()
+	return result, nil
+}
+
+// soakLatency returns a latency spread exponentially around mean,
+// but at least half of it.
+func soakLatency(mean time.Duration, rnd Random) time.Duration {
+	return time.Duration(float64(mean) * (0.5 - 0.5*math.Log(1-rnd.Float64())))
+}
+
+// parseSoakPhases parses phases written as a duration followed by
+// settings, such as "30s rps=100 errors=0.01; 1m errors=0.5
+// latency=400ms". Settings not given in a phase are carried over
+// from the previous one, starting from defaults.
+func parseSoakPhases(s string, defaults SoakPhase) ([]SoakPhase, error) {
+	var phases []SoakPhase
+	p := defaults
+	for _, raw := range strings.Split(s, ";") {
+		fields := strings.Fields(raw)
+		if len(fields) == 0 {
+			continue
+		}
+		d, err := time.ParseDuration(fields[0])
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("phase %q: must start with a positive duration", strings.TrimSpace(raw))
+		}
+		p.Duration = d
+		for _, field := range fields[1:] {
+			key, val := field, ""
+			if i := strings.Index(field, "="); i >= 0 {
+				key, val = field[:i], field[i+1:]
+			}
+			switch key {
+			case "rps":
+				p.RPS, err = strconv.ParseFloat(val, 64)
+			case "errors":
+				p.ErrorRate, err = strconv.ParseFloat(val, 64)
+			case "status":
+				p.ErrorStatus, err = strconv.Atoi(val)
+			case "latency":
+				p.Latency, err = time.ParseDuration(val)
+			default:
+				err = fmt.Errorf("unknown setting %q", key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("phase %q: %v", strings.TrimSpace(raw), err)
+			}
+		}
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("phase %q: %v", strings.TrimSpace(raw), err)
+		}
+		phases = append(phases, p)
+	}
+	if len(phases) == 0 {
+		return nil, fmt.Errorf("no phases")
+	}
+	return phases, nil
+}
+
+func (p SoakPhase) validate() error {
+	switch {
+	case p.Duration <= 0:
+		return fmt.Errorf("duration must be positive")
+	case p.RPS <= 0:
+		return fmt.Errorf("rps must be positive")
+	case p.ErrorRate < 0 || p.ErrorRate > 1:
+		return fmt.Errorf("errors must be between 0 and 1")
+	case p.ErrorStatus < 100 || p.ErrorStatus > 599:
+		return fmt.Errorf("status must be a valid status code")
+	case p.Latency < 0:
+		return fmt.Errorf("latency must not be negative")
+	}
+	return nil
+}
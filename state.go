@@ -0,0 +1,165 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// State is the state of a circuit breaker. It is written as its
+// name, such as "open", in logs, events and the admin API. The zero
+// State means no state, such as the state before the first event.
+type State uint8
+
+const (
+	// StateClosed lets requests through.
+	StateClosed State = iota + 1
+	// StateOpen rejects requests, until the trip duration elapsed.
+	StateOpen
+	// StateHalfOpen lets trial requests through while the circuit
+	// is open. The Simple breaker has no such state; it is there for
+	// other breakers to report theirs in the same vocabulary.
+	StateHalfOpen
+	// StateForcedOpen rejects requests regardless of the factor, as
+	// while draining.
+	StateForcedOpen
+	// StateForcedClosed lets requests through although the circuit is
+	// open, as while the correlation guard suppresses enforcement.
+	StateForcedClosed
+)
+
+var stateNames = map[State]string{
+	StateClosed:       "closed",
+	StateOpen:         "open",
+	StateHalfOpen:     "half_open",
+	StateForcedOpen:   "forced_open",
+	StateForcedClosed: "forced_closed",
+}
+
+// String returns the name of s.
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("State(%d)", s)
+}
+
+// MarshalText encodes s as its name.
+func (s State) MarshalText() ([]byte, error) {
+	if _, ok := stateNames[s]; !ok && s != 0 {
+		return nil, fmt.Errorf("unknown state %d", s)
+	}
+	return []byte(stateNames[s]), nil
+}
+
+// UnmarshalText decodes s from its name.
+func (s *State) UnmarshalText(text []byte) error {
+	for state, name := range stateNames {
+		if name == string(text) {
+			*s = state
+			return nil
+		}
+	}
+	if len(text) == 0 {
+		*s = 0
+		return nil
+	}
+	return fmt.Errorf("unknown state %q", text)
+}
+
+// Reason is the cause of a state transition. It is written as its
+// name, such as "threshold", alongside the description of the
+// transition, which has the details.
+type Reason uint8
+
+const (
+	// ReasonThreshold is the factor exceeding its threshold.
+	ReasonThreshold Reason = iota + 1
+	// ReasonStreamResets is the stream reset ratio exceeding
+	// stream_reset_threshold.
+	ReasonStreamResets
+	// ReasonErrorBudget is an error budget being exhausted.
+	ReasonErrorBudget
+	// ReasonTripElapsed is the trip duration having elapsed.
+	ReasonTripElapsed
+	// ReasonReset is a reset through the API.
+	ReasonReset
+	// ReasonShared is a change made by another instance, through
+	// shared storage.
+	ReasonShared
+	// ReasonPropagated is a trip propagated from a sibling breaker.
+	ReasonPropagated
+	// ReasonCarriedOver is an open circuit carried over from the
+	// previous config.
+	ReasonCarriedOver
+)
+
+var reasonNames = map[Reason]string{
+	ReasonThreshold:    "threshold",
+	ReasonStreamResets: "stream_resets",
+	ReasonErrorBudget:  "error_budget",
+	ReasonTripElapsed:  "trip_elapsed",
+	ReasonReset:        "reset",
+	ReasonShared:       "shared",
+	ReasonPropagated:   "propagated",
+	ReasonCarriedOver:  "carried_over",
+}
+
+// String returns the name of r.
+func (r Reason) String() string {
+	if name, ok := reasonNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Reason(%d)", r)
+}
+
+// MarshalText encodes r as its name.
+func (r Reason) MarshalText() ([]byte, error) {
+	if _, ok := reasonNames[r]; !ok && r != 0 {
+		return nil, fmt.Errorf("unknown reason %d", r)
+	}
+	return []byte(reasonNames[r]), nil
+}
+
+// UnmarshalText decodes r from its name.
+func (r *Reason) UnmarshalText(text []byte) error {
+	for reason, name := range reasonNames {
+		if name == string(text) {
+			*r = reason
+			return nil
+		}
+	}
+	if len(text) == 0 {
+		*r = 0
+		return nil
+	}
+	return fmt.Errorf("unknown reason %q", text)
+}
+
+// State returns the current state of the breaker: open or closed,
+// or forced open while draining, or forced closed while the
+// correlation guard suppresses enforcement of an open circuit.
+func (c *Simple) State() State {
+	switch {
+	case c.Draining():
+		return StateForcedOpen
+	case !c.OK():
+		return StateOpen
+	case atomic.LoadInt32(&c.tripped) == 1:
+		return StateForcedClosed
+	}
+	return StateClosed
+}
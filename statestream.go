@@ -0,0 +1,276 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// StateEvent is a state transition of a named breaker, as streamed
+// to the clients of the state socket, one JSON object per line. Right
+// after connecting, a client receives one event per breaker with its
+// current state, without a From state.
+type StateEvent struct {
+	// The breaker that changed state, or "" for an event of the
+	// failure domain Domain, which is open while all of its breakers
+	// are tripped, or for a correlated failure event, which is open
+	// while the correlation guard suppresses enforcement.
+	Breaker    string    `json:"breaker"`
+	Domain     string    `json:"domain,omitempty"`
+	Correlated bool      `json:"correlated,omitempty"`
+	From       State     `json:"from,omitempty"`
+	To         State     `json:"to"`
+	Cause      Reason    `json:"cause,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Time       time.Time `json:"time"`
+	// The ID of the maintenance window the transition happened in.
+	Maintenance string `json:"maintenance,omitempty"`
+	// The runbook_url of the breaker, for trips.
+	RunbookURL string `json:"runbook_url,omitempty"`
+	// With notify_settle, the number of transitions this event
+	// summarizes, if more than one.
+	Transitions int `json:"transitions,omitempty"`
+}
+
+// stateSubscribers receive the transitions of all named breakers.
+var stateSubscribers = struct {
+	sync.Mutex
+	m map[chan StateEvent]struct{}
+}{m: make(map[chan StateEvent]struct{})}
+
+// notifyTransition logs a transition and, for a named breaker, sends
+// it to all subscribers, once it settled if notify_settle is set.
+func (c *Simple) notifyTransition(t Transition) {
+	fields := []zap.Field{
+		zap.String("name", c.Name),
+		zap.Stringer("from", t.From),
+		zap.Stringer("to", t.To),
+		zap.Stringer("cause", t.Cause),
+		zap.String("reason", t.Reason),
+	}
+	if t.Maintenance != "" {
+		fields = append(fields, zap.String("maintenance", t.Maintenance))
+	}
+	var runbook string
+	if t.To == StateOpen {
+		runbook = c.RunbookURL
+	}
+	if runbook != "" {
+		fields = append(fields, zap.String("runbook_url", runbook))
+	}
+	c.logger.Info("circuit breaker state changed", fields...)
+	if c.Name == "" {
+		return
+	}
+	if registered, ok := lookupBreaker(c.Name); !ok || registered != c {
+		return
+	}
+	defer c.checkFailureDomain() // after the breaker's own event
+	ev := StateEvent{Breaker: c.Name, From: t.From, To: t.To, Cause: t.Cause, Reason: t.Reason, Time: t.Time, Maintenance: t.Maintenance, RunbookURL: runbook}
+	if c.settle != nil {
+		c.settle.add(ev)
+		return
+	}
+	broadcastState(ev)
+}
+
+// broadcastState sends ev to all subscribers. Subscribers that cannot
+// keep up are disconnected rather than silently missing events.
+func broadcastState(ev StateEvent) {
+	stateSubscribers.Lock()
+	defer stateSubscribers.Unlock()
+	for ch := range stateSubscribers.m {
+		select {
+		case ch <- ev:
+		default:
+			delete(stateSubscribers.m, ch)
+			close(ch)
+		}
+	}
+}
+
+func subscribeStates() chan StateEvent {
+	ch := make(chan StateEvent, stateSubscriberBuffer)
+	stateSubscribers.Lock()
+	stateSubscribers.m[ch] = struct{}{}
+	stateSubscribers.Unlock()
+	return ch
+}
+
+func unsubscribeStates(ch chan StateEvent) {
+	stateSubscribers.Lock()
+	if _, ok := stateSubscribers.m[ch]; ok {
+		delete(stateSubscribers.m, ch)
+		close(ch)
+	}
+	stateSubscribers.Unlock()
+}
+
+// stateServer streams breaker transitions to local clients over
+// a unix socket, for sidecars and agents that should not need the
+// admin API.
+type stateServer struct {
+	path     string
+	socket   os.FileInfo // of the socket file at path, as created by listener
+	listener net.Listener
+	logger   *zap.Logger
+	guard    *CorrelationGuard // of the app, if any
+	wg       sync.WaitGroup
+	done     chan struct{} // closed once the server is closing
+
+	mu    sync.Mutex
+	conns map[net.Conn]chan StateEvent // with the subscription streaming to it, once subscribed
+}
+
+func startStateServer(path string, guard *CorrelationGuard, logger *zap.Logger) (*stateServer, error) {
+	// a socket left behind by a previous process would make listening fail
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// on a reload the new server listens on the path before the old
+	// one closes, so the old one must not unlink the new socket
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	socket, err := os.Lstat(path)
+	if err == nil {
+		err = os.Chmod(path, stateSocketMode)
+	}
+	if err != nil {
+		ln.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	s := &stateServer{
+		path:     path,
+		socket:   socket,
+		listener: ln,
+		logger:   logger,
+		guard:    guard,
+		done:     make(chan struct{}),
+		conns:    make(map[net.Conn]chan StateEvent),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *stateServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = nil
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.stream(conn)
+	}
+}
+
+// stream writes the current state of every named breaker to conn,
+// followed by every transition, until conn or the server is closed.
+func (s *stateServer) stream(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	// subscribe first so no transition is missed between the two
+	events := subscribeStates()
+	defer unsubscribeStates(events)
+	s.mu.Lock()
+	s.conns[conn] = events
+	s.mu.Unlock()
+
+	enc := json.NewEncoder(conn)
+	for _, name := range breakerNames() {
+		c, ok := lookupBreaker(name)
+		if !ok {
+			continue
+		}
+		state, since := c.history.current()
+		if err := enc.Encode(StateEvent{Breaker: name, To: state, Time: since}); err != nil {
+			return
+		}
+	}
+	for _, ev := range downDomainEvents() {
+		if err := enc.Encode(ev); err != nil {
+			return
+		}
+	}
+	if ev, ok := s.guard.event(); ok {
+		if err := enc.Encode(ev); err != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				select {
+				case <-s.done:
+				default:
+					s.logger.Warn("disconnected state socket client that could not keep up")
+				}
+				return
+			}
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// close stops the server and disconnects its clients. The socket
+// file is only removed if it is still this server's, and not that
+// of a server started on the same path since.
+func (s *stateServer) close() error {
+	close(s.done)
+	err := s.listener.Close()
+	s.mu.Lock()
+	for conn, events := range s.conns {
+		conn.Close()
+		if events != nil {
+			unsubscribeStates(events)
+		}
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	if fi, statErr := os.Lstat(s.path); statErr == nil && os.SameFile(fi, s.socket) {
+		os.Remove(s.path)
+	}
+	return err
+}
+
+const (
+	stateSubscriberBuffer = 256
+	stateSocketMode       = 0660
+)
@@ -0,0 +1,59 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import "fmt"
+
+// statusWeights is the parsed form of Config.StatusWeights.
+type statusWeights struct {
+	codes   map[int]float64
+	classes map[int]float64 // keyed by the leading digit, e.g. 5 for 5xx
+}
+
+// parseStatusWeights converts the configured weighting table into
+// lookup maps, rejecting keys that are not a status code or class.
+func parseStatusWeights(raw map[string]float64) (*statusWeights, error) {
+	w := &statusWeights{
+		codes:   make(map[int]float64),
+		classes: make(map[int]float64),
+	}
+	for key, weight := range raw {
+		if weight < 0 {
+			return nil, fmt.Errorf("weight for %s must not be negative", key)
+		}
+		code, class, err := parseStatusKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if code == 0 {
+			w.classes[class] = weight
+			continue
+		}
+		w.codes[code] = weight
+	}
+	return w, nil
+}
+
+// weight returns the weight of a single status code counted as an
+// error, 1 if it has none.
+func (w *statusWeights) weight(code int) float64 {
+	if weight, ok := w.codes[code]; ok {
+		return weight
+	}
+	if weight, ok := w.classes[code/100]; ok {
+		return weight
+	}
+	return 1
+}
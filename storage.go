@@ -0,0 +1,62 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"context"
+	"time"
+)
+
+// Storage shares circuit breaker state between Caddy instances, so
+// that a circuit tripped by one instance opens on all of them.
+// Implementations are guest modules in the circuit_breaker.storage
+// namespace and must be safe for concurrent use.
+type Storage interface {
+	// Get returns the state stored at key. If nothing is stored
+	// there yet, it returns the zero SharedState, whose version is 0.
+	Get(ctx context.Context, key string) (SharedState, error)
+
+	// CompareAndSet stores state at key, but only if the version
+	// currently stored there is still version. It returns whether
+	// state was stored. The stored version must be greater than
+	// version afterwards; state.Version is ignored.
+	CompareAndSet(ctx context.Context, key string, version uint64, state SharedState) (bool, error)
+
+	// Watch sends the state stored at key on the returned channel,
+	// first once right away and then every time it changes, until
+	// ctx is done or an error occurs; either way the channel is
+	// closed afterwards.
+	Watch(ctx context.Context, key string) (<-chan SharedState, error)
+}
+
+// SharedState is the state of a circuit as shared through a Storage.
+// Storages that keep states as bytes should use its compact binary
+// encoding, MarshalBinary, rather than JSON.
+type SharedState struct {
+	// Set by the storage to tell writes apart.
+	Version uint64 `json:"version"`
+	// Whether the circuit is open.
+	Open bool `json:"open"`
+	// When an open circuit closes again.
+	Until time.Time `json:"until,omitempty"`
+	// Why the circuit last changed state.
+	Reason string `json:"reason,omitempty"`
+	// The breaker that stored this state: the host and process ID of
+	// its instance, followed by a sequence number of the breaker.
+	Origin string `json:"origin,omitempty"`
+	// The counts of the sliding window of the origin when it stored
+	// this state, if known.
+	Counts *WindowCounts `json:"counts,omitempty"`
+}
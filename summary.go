@@ -0,0 +1,114 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Summary counts the named breakers of this process by state, as a
+// single signal of fleet health, such as to alert when more than a
+// tenth of all routes have their circuit open.
+type Summary struct {
+	// The number of named breakers.
+	Breakers int `json:"breakers"`
+	// The number and fraction of breakers in each state, including
+	// states no breaker is in.
+	States map[State]StateCount `json:"states"`
+	// The fraction of breakers that reject requests: those open or
+	// forced open.
+	OpenFraction float64 `json:"open_fraction"`
+	// The state of each failure domain, if breakers have one.
+	Domains map[string]DomainSummary `json:"domains,omitempty"`
+}
+
+// StateCount is the number of breakers in a state, and their
+// fraction of all breakers.
+type StateCount struct {
+	Count    int     `json:"count"`
+	Fraction float64 `json:"fraction"`
+}
+
+// Summarize returns the summary of all named breakers.
+func Summarize() Summary {
+	counts := make(map[State]int, len(stateNames))
+	var total int
+	for _, name := range breakerNames() {
+		if c, ok := lookupBreaker(name); ok {
+			counts[c.State()]++
+			total++
+		}
+	}
+
+	s := Summary{Breakers: total, States: make(map[State]StateCount, len(stateNames))}
+	for state := range stateNames {
+		sc := StateCount{Count: counts[state]}
+		if total > 0 {
+			sc.Fraction = float64(sc.Count) / float64(total)
+		}
+		s.States[state] = sc
+	}
+	s.OpenFraction = s.States[StateOpen].Fraction + s.States[StateForcedOpen].Fraction
+	if domains := domainSummaries(); len(domains) > 0 {
+		s.Domains = domains
+	}
+	return s
+}
+
+// writeSummary writes s as JSON or, with format prometheus, as
+// gauges in the Prometheus text format, for scrapers.
+func writeSummary(w http.ResponseWriter, format string, s Summary) error {
+	switch format {
+	case "", "json":
+		return writeJSON(w, s)
+	case "prometheus":
+	default:
+		return caddy.APIError{
+			Code: http.StatusBadRequest,
+			Err:  fmt.Errorf("unknown format: %s", format),
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintln(w, "# HELP caddy_circuit_breakers Named circuit breakers by state.")
+	fmt.Fprintln(w, "# TYPE caddy_circuit_breakers gauge")
+	for state := StateClosed; state <= StateForcedClosed; state++ {
+		fmt.Fprintf(w, "caddy_circuit_breakers{state=%q} %d\n", state, s.States[state].Count)
+	}
+	fmt.Fprintln(w, "# HELP caddy_circuit_breakers_open_ratio Fraction of named circuit breakers that reject requests.")
+	fmt.Fprintln(w, "# TYPE caddy_circuit_breakers_open_ratio gauge")
+	fmt.Fprintf(w, "caddy_circuit_breakers_open_ratio %g\n", s.OpenFraction)
+	if len(s.Domains) == 0 {
+		return nil
+	}
+	domains := make([]string, 0, len(s.Domains))
+	for domain := range s.Domains {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	fmt.Fprintln(w, "# HELP caddy_circuit_breaker_domain_down Whether all named circuit breakers of a failure domain are tripped.")
+	fmt.Fprintln(w, "# TYPE caddy_circuit_breaker_domain_down gauge")
+	for _, domain := range domains {
+		var down int
+		if s.Domains[domain].Down {
+			down = 1
+		}
+		fmt.Fprintf(w, "caddy_circuit_breaker_domain_down{domain=%q} %d\n", domain, down)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// ThroughputFactor configures the throughput factor, which trips
+// when the rate of successful responses, or of the bytes they carry,
+// drops by more than a fraction relative to a trailing baseline. It
+// catches brownouts in which status codes stay fine but the backend
+// barely serves. Its value is the fraction of the baseline lost.
+type ThroughputFactor struct {
+	// The fraction of the baseline throughput, between 0 and 1,
+	// that must be lost for the circuit to trip, such as 0.5 for
+	// throughput falling to half of the baseline.
+	Threshold float64 `json:"threshold,omitempty"`
+	// What to measure the throughput in: "responses" per second, the
+	// default, or "bytes" of response bodies per second. Bytes are
+	// only known to the handler variant of the breaker.
+	Metric string `json:"metric,omitempty"`
+	// How far back the baseline reaches. The baseline is the average
+	// throughput over this time before the last 10 seconds, which are
+	// compared against it. The circuit does not trip before the
+	// breaker has seen a full baseline since it started or last
+	// tripped. The default is 10m.
+	Baseline caddy.Duration `json:"baseline,omitempty"`
+	// The baseline throughput per second, in the unit of the metric,
+	// below which the circuit does not trip, so that quiet periods do
+	// not count as drops. The default is 1.
+	MinBaseline float64 `json:"min_baseline,omitempty"`
+}
+
+func (t *ThroughputFactor) provision() error {
+	if t.Threshold <= 0 || t.Threshold >= 1 {
+		return fmt.Errorf("%w: must be above 0 and below 1", ErrInvalidThreshold)
+	}
+	switch t.Metric {
+	case "":
+		t.Metric = throughputResponses
+	case throughputResponses, throughputBytes:
+	default:
+		return fmt.Errorf("unknown metric %q; must be responses or bytes", t.Metric)
+	}
+	if t.Baseline == 0 {
+		t.Baseline = caddy.Duration(defaultThroughputBaseline)
+	}
+	if time.Duration(t.Baseline) < 2*throughputCurrent {
+		return fmt.Errorf("baseline must be at least %s", 2*throughputCurrent)
+	}
+	if t.MinBaseline == 0 {
+		t.MinBaseline = defaultMinBaseline
+	}
+	if t.MinBaseline < 0 {
+		return fmt.Errorf("min_baseline must not be negative")
+	}
+	return nil
+}
+
+// throughputCounter counts successful responses and their bytes per
+// second, over the baseline and the current part of the window.
+type throughputCounter struct {
+	mu      sync.Mutex
+	elapsed func() time.Duration
+	buckets []throughputBucket
+	resetAt time.Duration
+}
+
+type throughputBucket struct {
+	slot      int64
+	responses int64
+	bytes     int64
+}
+
+func newThroughputCounter(elapsed func() time.Duration, baseline time.Duration) *throughputCounter {
+	if elapsed == nil {
+		elapsed = monotonicClock()
+	}
+	return &throughputCounter{
+		elapsed: elapsed,
+		buckets: make([]throughputBucket, int((baseline+throughputCurrent)/time.Second)+1),
+	}
+}
+
+// record counts s if it was successful.
+func (t *throughputCounter) record(samples ...Sample) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slot := int64(t.elapsed() / time.Second)
+	b := &t.buckets[slot%int64(len(t.buckets))]
+	if b.slot != slot {
+		*b = throughputBucket{slot: slot}
+	}
+	for _, s := range samples {
+		if s.Err == nil && s.StatusCode < 400 {
+			b.responses++
+			b.bytes += s.Bytes
+		}
+	}
+}
+
+// rates returns the throughput per second of the last complete
+// seconds of the window and of the baseline before them. It is
+// not ready until a full baseline was seen since the breaker started
+// or last tripped.
+func (t *throughputCounter) rates(bytes bool) (current, baseline float64, ready bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.elapsed()
+	cur := int64(now / time.Second)
+	nCurrent := int64(throughputCurrent / time.Second)
+	nBaseline := int64(len(t.buckets)) - 1 - nCurrent
+	if now-t.resetAt < time.Duration(nBaseline+nCurrent+1)*time.Second {
+		return 0, 0, false
+	}
+	var sum [2]int64
+	for i := int64(1); i <= nBaseline+nCurrent; i++ {
+		slot := cur - i
+		b := t.buckets[slot%int64(len(t.buckets))]
+		if b.slot != slot {
+			continue
+		}
+		v := b.responses
+		if bytes {
+			v = b.bytes
+		}
+		if i <= nCurrent {
+			sum[0] += v
+		} else {
+			sum[1] += v
+		}
+	}
+	return float64(sum[0]) / float64(nCurrent), float64(sum[1]) / float64(nBaseline), true
+}
+
+// reset restarts the baseline, since throughput while the circuit
+// was open says nothing about the backend.
+func (t *throughputCounter) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.resetAt = t.elapsed()
+	for i := range t.buckets {
+		t.buckets[i] = throughputBucket{}
+	}
+}
+
+func (t *throughputCounter) memoryUsage() int64 {
+	if t == nil {
+		return 0
+	}
+	return int64(len(t.buckets)) * 24
+}
+
+// evaluateThroughput evaluates the throughput factor into ev,
+// returning the reason to trip, if the circuit should trip.
+func (c *Simple) evaluateThroughput(ev *Evaluation) string {
+	ev.Requests = c.metrics.totalCount()
+	ev.Threshold = c.ratioThreshold(c.Throughput.Threshold)
+	current, baseline, ready := c.throughput.rates(c.Throughput.Metric == throughputBytes)
+	if !ready {
+		ev.Decision = decisionWindowNotFull
+		return ""
+	}
+	if baseline < c.Throughput.MinBaseline {
+		ev.Decision = decisionTooFewRequests
+		return ""
+	}
+	drop := 1 - current/baseline
+	if drop < 0 {
+		drop = 0
+	}
+	ev.Value = drop
+	if drop <= ev.Threshold {
+		return ""
+	}
+	return fmt.Sprintf("throughput %.3g %s/s dropped %.0f%% below baseline %.3g %s/s, more than threshold %v",
+		current, c.Throughput.Metric, 100*drop, baseline, c.Throughput.Metric, ev.Threshold)
+}
+
+const (
+	throughputResponses = "responses"
+	throughputBytes     = "bytes"
+
+	// the recent part of the window compared against the baseline
+	throughputCurrent         = windowCountBuckets * windowCountResolution
+	defaultThroughputBaseline = 10 * time.Minute
+	defaultMinBaseline        = 1
+)
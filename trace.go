@@ -0,0 +1,92 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"sync"
+	"time"
+)
+
+// Evaluation describes a single evaluation of a breaker's factor.
+type Evaluation struct {
+	Time   time.Time `json:"time"`
+	Factor string    `json:"factor"`
+	// The number of requests the factor was computed over.
+	Requests int64 `json:"requests"`
+	// The computed value of the factor and the threshold it was
+	// compared to; latencies are in the unit of the latency factor.
+	// The value is 0 if the factor was not computed.
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	// What the breaker did, such as "tripped" or "below threshold".
+	Decision string `json:"decision"`
+	// Why the circuit would trip, if it would.
+	Reason string `json:"reason,omitempty"`
+	// How many of the requests are hung requests still in flight,
+	// counted as presumptive failures.
+	Hung int64 `json:"hung,omitempty"`
+}
+
+// Decisions of an Evaluation.
+const (
+	decisionBelowThreshold = "below threshold"
+	decisionWindowNotFull  = "skipped: window not full"
+	decisionTooFewRequests = "skipped: too few requests"
+	decisionCoolingDown    = "suppressed: cooling down after close"
+	decisionRateLimited    = "suppressed: min_state_interval"
+	decisionMaintenance    = "suppressed: maintenance window"
+	decisionAlreadyOpen    = "already open"
+	decisionTripped        = "tripped"
+)
+
+// trace is a bounded ring buffer of the most recent evaluations.
+type trace struct {
+	mu      sync.Mutex
+	entries []Evaluation
+	next    int
+	full    bool
+}
+
+func newTrace(size int) *trace {
+	return &trace{entries: make([]Evaluation, size)}
+}
+
+// record appends an evaluation, overwriting the oldest one once
+// the buffer is full. It is a no-op on a nil trace.
+func (t *trace) record(ev Evaluation) {
+	if t == nil {
+		return
+	}
+	ev.Time = time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[t.next] = ev
+	t.next = (t.next + 1) % len(t.entries)
+	if t.next == 0 {
+		t.full = true
+	}
+}
+
+// evaluations returns the recorded evaluations, oldest first.
+func (t *trace) evaluations() []Evaluation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.full {
+		return append([]Evaluation(nil), t.entries[:t.next]...)
+	}
+	out := make([]Evaluation, 0, len(t.entries))
+	out = append(out, t.entries[t.next:]...)
+	return append(out, t.entries[:t.next]...)
+}
@@ -0,0 +1,342 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// upstreamSet holds the per-upstream states of a breaker, keyed by
+// the dial address of the upstream. Each state is a breaker of its
+// own, sharing the settings of its parent but none of its process-wide
+// features (name registration, storage, time series, nested upstreams).
+//
+// Upstreams from dynamic sources, such as SRV or A lookups, come and
+// go, so states of addresses that have not been seen for the upstream
+// TTL are expired, unless their circuit is still open.
+//
+// An address seen for the first time, or again after it expired, is
+// taken to be a newly started instance: within the upstream warmup its
+// failures only count with a weight that grows from 0 to 1.
+type upstreamSet struct {
+	mu        sync.Mutex
+	m         map[string]*Simple
+	lastSeen  map[string]time.Duration
+	firstSeen map[string]time.Duration
+	lastSweep time.Duration
+	ttl       time.Duration
+	warmup    time.Duration
+	clock     func() time.Duration
+	known     map[string]bool // the addresses last given to SetUpstreams
+}
+
+func newUpstreamSet(ttl, warmup time.Duration) *upstreamSet {
+	return &upstreamSet{
+		m:         make(map[string]*Simple),
+		lastSeen:  make(map[string]time.Duration),
+		firstSeen: make(map[string]time.Duration),
+		ttl:       ttl,
+		warmup:    warmup,
+		clock:     monotonicClock(),
+	}
+}
+
+// upstream returns the state of the upstream at addr,
+// creating it if it does not exist yet.
+func (c *Simple) upstream(addr string) *Simple {
+	c.upstreams.mu.Lock()
+	defer c.upstreams.mu.Unlock()
+	now := c.upstreams.clock()
+	c.expireUpstreamsLocked(now)
+	c.upstreams.lastSeen[addr] = now
+	if u, ok := c.upstreams.m[addr]; ok {
+		return u
+	}
+	u, err := c.newUpstream(addr)
+	if err != nil {
+		c.logger.Error("creating upstream state", zap.String("upstream", addr), zap.Error(err))
+		return nil
+	}
+	c.upstreams.m[addr] = u
+	c.upstreams.firstSeen[addr] = now
+	return u
+}
+
+// warmupWeight returns the weight of failures of the upstream at addr:
+// 1 once its warmup is over, and less before.
+func (set *upstreamSet) warmupWeight(addr string) float64 {
+	if set.warmup <= 0 {
+		return 1
+	}
+	set.mu.Lock()
+	first, ok := set.firstSeen[addr]
+	now := set.clock()
+	set.mu.Unlock()
+	if !ok || now-first >= set.warmup {
+		return 1
+	}
+	return float64(now-first) / float64(set.warmup)
+}
+
+// keepWarmingUp returns whether the upstream state u, with failures
+// of the given warmup weight, should record s. During the warmup,
+// failures are kept with a probability of their weight, so that a
+// just-started instance's slow first requests do not eject it right
+// away.
+func (c *Simple) keepWarmingUp(u *Simple, weight float64, s Sample) bool {
+	return weight >= 1 || !u.failed(s) || c.rand.Float64() < weight
+}
+
+// warmingUp returns which of samples, all from the upstream at addr,
+// the upstream state u should record.
+func (c *Simple) warmingUp(addr string, u *Simple, samples []Sample) []Sample {
+	weight := c.upstreams.warmupWeight(addr)
+	if weight >= 1 {
+		return samples
+	}
+	kept := samples[:0:0]
+	for _, s := range samples {
+		if c.keepWarmingUp(u, weight, s) {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// failed returns whether s counts against the breaker: a network or
+// server error, a missed deadline, or, with a latency factor, a
+// latency above the threshold.
+func (c *Simple) failed(s Sample) bool {
+	switch {
+	case s.Err != nil, s.StatusCode >= 500, s.MissedDeadline:
+		return true
+	case c.StatusRatio != nil && c.StatusRatio.inRange(s.StatusCode):
+		return true
+	case c.Latency != nil:
+		return c.serviceTime(s) > c.latencyThreshold()
+	}
+	return false
+}
+
+// expireUpstreamsLocked drops the states of upstreams with a closed
+// circuit that were not seen within the TTL. To keep this cheap on
+// the recording path, it only looks at all upstreams once per
+// quarter of the TTL. c.upstreams.mu must be held.
+func (c *Simple) expireUpstreamsLocked(now time.Duration) {
+	set := c.upstreams
+	if now-set.lastSweep < set.ttl/4 {
+		return
+	}
+	set.lastSweep = now
+	for addr, u := range set.m {
+		if now-set.lastSeen[addr] > set.ttl && u.OK() {
+			delete(set.m, addr)
+			delete(set.lastSeen, addr)
+			delete(set.firstSeen, addr)
+		}
+	}
+}
+
+func (c *Simple) newUpstream(addr string) (*Simple, error) {
+	u := &Simple{
+		Config:   c.Config,
+		cbFactor: c.cbFactor,
+		weights:  c.weights,
+		logger:   c.logger.With(zap.String("upstream", addr)),
+	}
+	u.Name = addr
+	u.StorageRaw = nil
+	u.TimeSeries = 0
+	u.PerUpstream = false
+	u.Labels = nil
+	u.PropagateTripTo = nil
+	u.WindowOf = ""
+	u.HungRequestMultiple = 0
+	u.WindowFile = ""
+	u.LatencyBaseline = ""
+	u.RejectedSamples = 0
+	u.clock = c.clock
+	u.afterFunc = c.afterFunc
+	if err := u.initState(); err != nil {
+		return nil, err
+	}
+	u.rand = c.rand
+	return u, nil
+}
+
+// UpstreamOK returns whether the circuit of the upstream at addr is
+// closed. It is always true for upstreams without a state of their
+// own, including when per_upstream is not enabled.
+func (c *Simple) UpstreamOK(addr string) bool {
+	if c.upstreams == nil {
+		return true
+	}
+	c.upstreams.mu.Lock()
+	u, ok := c.upstreams.m[addr]
+	c.upstreams.mu.Unlock()
+	return !ok || u.OK()
+}
+
+// SetUpstreams tells a per_upstream breaker which upstreams currently
+// exist, for integrations that see the pool of upstreams, such as the
+// circuit_breaker selection policy. Changes to the set are logged. With
+// reset_changed_upstreams, the states of upstreams that were removed,
+// added, or are not in the set at all are dropped, so that they start
+// out closed.
+func (c *Simple) SetUpstreams(addrs []string) {
+	if c.upstreams == nil {
+		return
+	}
+	c.upstreams.mu.Lock()
+	defer c.upstreams.mu.Unlock()
+	known := c.upstreams.known
+	if sameUpstreams(known, addrs) {
+		return
+	}
+	current := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		current[addr] = true
+	}
+	if known != nil {
+		var added, removed []string
+		for addr := range current {
+			if !known[addr] {
+				added = append(added, addr)
+			}
+		}
+		for addr := range known {
+			if !current[addr] {
+				removed = append(removed, addr)
+			}
+		}
+		sort.Strings(added)
+		sort.Strings(removed)
+		c.logger.Info("upstreams changed",
+			zap.String("name", c.Name),
+			zap.Strings("added", added),
+			zap.Strings("removed", removed))
+	}
+	c.upstreams.known = current
+
+	if !c.ResetChangedUpstreams {
+		return
+	}
+	for addr := range c.upstreams.m {
+		if current[addr] && (known == nil || known[addr]) {
+			continue
+		}
+		delete(c.upstreams.m, addr)
+		delete(c.upstreams.lastSeen, addr)
+		delete(c.upstreams.firstSeen, addr)
+		c.logger.Info("dropped state of changed upstream", zap.String("name", c.Name), zap.String("upstream", addr))
+	}
+}
+
+// sameUpstreams returns whether addrs are exactly the addresses in known.
+func sameUpstreams(known map[string]bool, addrs []string) bool {
+	if known == nil || len(known) != len(addrs) {
+		return false
+	}
+	for _, addr := range addrs {
+		if !known[addr] {
+			return false
+		}
+	}
+	return true
+}
+
+// inheritUpstreams carries the open upstream circuits of the breaker
+// this one replaces on a config reload over to this one, for the rest
+// of their trip duration, along with the upstreams it last knew of.
+// With reset_changed_upstreams, the next SetUpstreams then drops the
+// states of upstreams that changed with the new config.
+func (c *Simple) inheritUpstreams() {
+	if c.Name == "" {
+		return
+	}
+	prev, ok := lookupBreaker(c.Name)
+	if !ok || prev == c || prev.upstreams == nil {
+		return
+	}
+
+	prev.upstreams.mu.Lock()
+	openUntil := make(map[string]time.Time)
+	for addr, u := range prev.upstreams.m {
+		u.mu.Lock()
+		if !u.OK() {
+			openUntil[addr] = u.openUntil
+		}
+		u.mu.Unlock()
+	}
+	known := prev.upstreams.known
+	prev.upstreams.mu.Unlock()
+
+	c.upstreams.mu.Lock()
+	c.upstreams.known = known
+	c.upstreams.mu.Unlock()
+	for addr, until := range openUntil {
+		if d := time.Until(until); d > 0 {
+			if u := c.upstream(addr); u != nil {
+				u.trip(ReasonCarriedOver, "carried over from previous config", d)
+			}
+		}
+	}
+}
+
+// Quarantined returns the addresses of the upstreams whose circuit
+// is open, sorted, or nil if per_upstream is not enabled.
+func (c *Simple) Quarantined() []string {
+	if c.upstreams == nil {
+		return nil
+	}
+	c.upstreams.mu.Lock()
+	defer c.upstreams.mu.Unlock()
+	addrs := make([]string, 0)
+	for addr, u := range c.upstreams.m {
+		if !u.OK() {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// upstreamStatuses returns the status of each upstream, by address.
+func (c *Simple) upstreamStatuses() []breakerStatus {
+	c.upstreams.mu.Lock()
+	addrs := make([]string, 0, len(c.upstreams.m))
+	for addr := range c.upstreams.m {
+		addrs = append(addrs, addr)
+	}
+	c.upstreams.mu.Unlock()
+	sort.Strings(addrs)
+
+	statuses := make([]breakerStatus, 0, len(addrs))
+	for _, addr := range addrs {
+		c.upstreams.mu.Lock()
+		u, ok := c.upstreams.m[addr]
+		c.upstreams.mu.Unlock()
+		if ok {
+			st := u.status(false)
+			st.WarmingUp = c.upstreams.warmupWeight(addr) < 1
+			statuses = append(statuses, st)
+		}
+	}
+	return statuses
+}
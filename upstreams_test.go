@@ -0,0 +1,80 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// firstUpstream is a selection policy choosing the first upstream.
+type firstUpstream struct{}
+
+func (firstUpstream) Select(pool reverseproxy.UpstreamPool, r *http.Request) *reverseproxy.Upstream {
+	return pool[0]
+}
+
+func TestResetChangedUpstreamsOnReload(t *testing.T) {
+	cfg := Config{
+		Name:                  "test-changed-upstreams",
+		Factor:                "error_ratio",
+		ErrorRatio:            &RatioFactor{Threshold: 0.5},
+		PerUpstream:           true,
+		ResetChangedUpstreams: true,
+	}
+	old, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerBreaker(old)
+	old.SetUpstreams([]string{"10.0.0.1:80", "10.0.0.2:80"})
+	for _, addr := range []string{"10.0.0.1:80", "10.0.0.2:80"} {
+		old.upstream(addr).trip(ReasonThreshold, "test", time.Minute)
+	}
+
+	// the new config replaces 10.0.0.2 with 10.0.0.3, which the
+	// selection policy sees on the first request
+	reloaded, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerBreaker(reloaded)
+	old.Cleanup()
+	defer reloaded.Cleanup()
+	s := &UpstreamSelection{Breaker: cfg.Name}
+	if err := s.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	s.policy = firstUpstream{}
+	pool := reverseproxy.UpstreamPool{{Dial: "10.0.0.1:80"}, {Dial: "10.0.0.3:80"}}
+	if u := s.Select(pool, httptest.NewRequest("GET", "/", nil)); u != nil {
+		t.Fatalf("selected %s, whose carried over circuit is open", u.Dial)
+	}
+
+	if got := reloaded.Quarantined(); len(got) != 1 || got[0] != "10.0.0.1:80" {
+		t.Fatalf("quarantined = %v, want only the unchanged 10.0.0.1:80", got)
+	}
+	reloaded.upstreams.mu.Lock()
+	_, kept := reloaded.upstreams.m["10.0.0.2:80"]
+	reloaded.upstreams.mu.Unlock()
+	if kept {
+		t.Fatal("state of the removed upstream 10.0.0.2:80 was kept")
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+func init() {
+	caddy.RegisterModule(UpstreamSelection{})
+}
+
+// UpstreamSelection is a load balancing selection policy of the
+// reverse proxy that cooperates with a named per_upstream breaker
+// whose handler has trip_scope upstream: it lets another policy
+// choose the upstream, and rejects the request if the circuit of
+// the chosen upstream is open, so that only the requests routed to
+// an offending upstream are turned away instead of all of them.
+//
+// Upstreams are identified by their dial address, with placeholders
+// replaced, as the handler records them. Upstreams found through SRV
+// lookups are only resolved when dialed, so they are never rejected.
+// The policy also tells the breaker which upstreams are in the pool,
+// so that it notices when they change.
+type UpstreamSelection struct {
+	// The name of the breaker, which must be a per_upstream breaker
+	// in front of this reverse proxy.
+	Breaker string `json:"breaker,omitempty"`
+	// The policy that chooses the upstream. The default is random.
+	SelectRaw json.RawMessage `json:"select,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
+
+	policy reverseproxy.Selector
+
+	mu    *sync.Mutex
+	pool  reverseproxy.UpstreamPool // the last pool seen, if it has no placeholders
+	addrs []string                  // the addresses of pool
+}
+
+// CaddyModule returns the Caddy module information.
+func (UpstreamSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.circuit_breaker",
+		New: func() caddy.Module { return new(UpstreamSelection) },
+	}
+}
+
+// Provision loads the policy that chooses the upstream.
+func (s *UpstreamSelection) Provision(ctx caddy.Context) error {
+	if s.Breaker == "" {
+		return fmt.Errorf("breaker is required")
+	}
+	s.mu = new(sync.Mutex)
+	if s.SelectRaw == nil {
+		s.policy = reverseproxy.RandomSelection{}
+		return nil
+	}
+	mod, err := ctx.LoadModule(s, "SelectRaw")
+	if err != nil {
+		return fmt.Errorf("loading selection policy: %v", err)
+	}
+	s.policy = mod.(reverseproxy.Selector)
+	return nil
+}
+
+// Select returns the upstream chosen by the policy, or nil, which
+// the reverse proxy answers with 503 Service Unavailable, if its
+// circuit is open. Requests matched by the breaker's bypass matcher
+// sets are not rejected. The breaker is looked up by name for every
+// request, so that it may be provisioned after the reverse proxy;
+// while there is no breaker of that name, no request is rejected.
+func (s *UpstreamSelection) Select(pool reverseproxy.UpstreamPool, r *http.Request) *reverseproxy.Upstream {
+	u := s.policy.Select(pool, r)
+	if u == nil || u.Dial == "" {
+		return u
+	}
+	c, ok := lookupBreaker(s.Breaker)
+	if !ok {
+		return u
+	}
+	c.SetUpstreams(s.poolAddrs(pool, r))
+	if c.bypassed(r) {
+		return u
+	}
+	addr := upstreamAddr(u, r)
+	if c.UpstreamOK(addr) {
+		return u
+	}
+	c.sampleRejected(r, addr, errUpstreamOpen)
+	return nil
+}
+
+// poolAddrs returns the addresses of the upstreams in pool that are
+// dialed directly. They are only worked out again once the pool
+// changes, as on a config reload, unless their dial addresses have
+// placeholders, which may be replaced differently for every request.
+func (s *UpstreamSelection) poolAddrs(pool reverseproxy.UpstreamPool, r *http.Request) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if samePool(s.pool, pool) {
+		return s.addrs
+	}
+	addrs := make([]string, 0, len(pool))
+	placeholders := false
+	for _, u := range pool {
+		if u.Dial == "" {
+			continue
+		}
+		placeholders = placeholders || strings.Contains(u.Dial, "{")
+		addrs = append(addrs, upstreamAddr(u, r))
+	}
+	s.pool, s.addrs = nil, addrs
+	if !placeholders {
+		s.pool = append(reverseproxy.UpstreamPool(nil), pool...)
+	}
+	return addrs
+}
+
+// samePool returns whether a and b hold the same upstreams, in order.
+func samePool(a, b reverseproxy.UpstreamPool) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// upstreamAddr returns the address of u as the reverse proxy dials
+// it for r, which is what the handler records the upstream as.
+func upstreamAddr(u *reverseproxy.Upstream, r *http.Request) string {
+	dial := u.Dial
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		dial = repl.ReplaceAll(dial, "")
+	}
+	addr, err := caddy.ParseNetworkAddress(dial)
+	if err != nil || addr.PortRangeSize() != 1 {
+		return dial
+	}
+	return addr.JoinHostPort(0)
+}
+
+// UnmarshalCaddyfile sets up the policy from Caddyfile tokens. Syntax:
+//
+//	lb_policy circuit_breaker <breaker> [<policy> [<options...>]]
+func (s *UpstreamSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		s.Breaker = d.Val()
+		if !d.NextArg() {
+			continue
+		}
+		name := d.Val()
+		mod, err := caddy.GetModule("http.reverse_proxy.selection_policies." + name)
+		if err != nil {
+			return d.Errf("getting selection policy module '%s': %v", name, err)
+		}
+		unm, ok := mod.New().(caddyfile.Unmarshaler)
+		if !ok {
+			return d.Errf("selection policy module '%s' is not a Caddyfile unmarshaler", name)
+		}
+		if err := unm.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+			return err
+		}
+		sel, ok := unm.(reverseproxy.Selector)
+		if !ok {
+			return d.Errf("module %s is not a selection policy", name)
+		}
+		s.SelectRaw = caddyconfig.JSONModuleObject(sel, "policy", name, nil)
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*UpstreamSelection)(nil)
+	_ reverseproxy.Selector = (*UpstreamSelection)(nil)
+	_ caddyfile.Unmarshaler = (*UpstreamSelection)(nil)
+)
@@ -0,0 +1,501 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/memmetrics"
+)
+
+// window is a sliding window of request outcomes. It keeps the same
+// shape as memmetrics.RTMetrics (counters over 10x1s buckets, latencies
+// over 6x10s buckets), but buckets are selected by time elapsed on the
+// monotonic clock rather than by wall clock time. A wall clock step,
+// such as an NTP correction, therefore cannot move samples in or out
+// of the window or make the window appear empty or stale. While the
+// host is suspended the monotonic clock does not advance, so samples
+// from before a suspend are still considered right after resuming.
+type window struct {
+	mu      sync.Mutex
+	elapsed func() time.Duration
+	since   time.Duration // when the window was created or last reset
+	counts  []countBucket
+	hists   []histBucket
+	sparse  *quantileHist      // used instead of hists if quantiles are registered
+	fixed   *fixedHist         // used instead of hists with histogram fixed
+	budget  *cardinalityBudget // of distinct status codes; nil means unbounded
+	log     *sampleLog         // if set, used instead of the buckets
+	file    *windowFile        // if set, mirrors the counter buckets
+
+	// the latency quantiles the breaker reads, if registered;
+	// they are the ones reported in the window's stats
+	quantiles []float64
+}
+
+type countBucket struct {
+	slot      int64
+	total     int64
+	netErrors int64
+	codes     map[int]int64
+}
+
+type histBucket struct {
+	slot int64
+	hist *memmetrics.HDRHistogram
+}
+
+// newWindow returns an empty window measuring time with elapsed,
+// which must be monotonic. If elapsed is nil, the monotonic clock
+// of this process is used.
+func newWindow(elapsed func() time.Duration) (*window, error) {
+	if elapsed == nil {
+		elapsed = monotonicClock()
+	}
+	w := &window{
+		elapsed: elapsed,
+		counts:  make([]countBucket, windowCountBuckets),
+		hists:   make([]histBucket, windowHistBuckets),
+	}
+	for i := range w.hists {
+		h, err := memmetrics.NewHDRHistogram(histMin, histMax, histSigFigs)
+		if err != nil {
+			return nil, err
+		}
+		w.hists[i].hist = h
+	}
+	w.reset()
+	return w, nil
+}
+
+// newQuantileWindow returns an empty window like newWindow, but
+// for a breaker that only reads the given latency quantiles, so
+// that its latencies are kept in sparse histograms.
+func newQuantileWindow(elapsed func() time.Duration, quantiles []float64) *window {
+	if elapsed == nil {
+		elapsed = monotonicClock()
+	}
+	w := &window{
+		elapsed:   elapsed,
+		counts:    make([]countBucket, windowCountBuckets),
+		sparse:    newQuantileHist(),
+		quantiles: quantiles,
+	}
+	w.reset()
+	return w
+}
+
+// newFixedWindow returns an empty window like newWindow, but with
+// its latencies kept in a fixedHist.
+func newFixedWindow(elapsed func() time.Duration) *window {
+	if elapsed == nil {
+		elapsed = monotonicClock()
+	}
+	w := &window{
+		elapsed: elapsed,
+		counts:  make([]countBucket, windowCountBuckets),
+		fixed:   newFixedHist(),
+	}
+	w.reset()
+	return w
+}
+
+// newLogWindow returns an empty window that keeps up to capacity
+// samples in a sampleLog instead of buckets, calling onDrop whenever
+// it has to drop one for space.
+func newLogWindow(elapsed func() time.Duration, capacity int, onDrop func()) *window {
+	if elapsed == nil {
+		elapsed = monotonicClock()
+	}
+	w := &window{
+		elapsed: elapsed,
+		log:     newSampleLog(capacity, onDrop),
+	}
+	w.reset()
+	return w
+}
+
+// monotonicClock returns a function reporting the time elapsed
+// since it was created, as measured by the monotonic clock.
+func monotonicClock() func() time.Duration {
+	start := time.Now()
+	return func() time.Duration { return time.Since(start) }
+}
+
+// record adds one request outcome to the window.
+func (w *window) record(statusCode int, latency time.Duration) {
+	if w.fixed != nil {
+		// the fixed histogram does not need the lock
+		now := w.elapsed()
+		if latency != noLatency {
+			w.fixed.record(now, latency)
+		}
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.recordLocked(now, statusCode, noLatency)
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.recordLocked(w.elapsed(), statusCode, latency)
+}
+
+// recordBatch adds several request outcomes while holding the lock
+// and reading the clock once.
+func (w *window) recordBatch(samples []Sample) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.elapsed()
+	for _, s := range samples {
+		latency := s.Latency
+		if w.fixed != nil && latency != noLatency {
+			w.fixed.record(now, latency)
+			latency = noLatency
+		}
+		w.recordLocked(now, s.StatusCode, latency)
+	}
+}
+
+func (w *window) recordLocked(now time.Duration, statusCode int, latency time.Duration) {
+	if w.log != nil {
+		w.log.record(now, w.budget.statusCode(statusCode), latency)
+		return
+	}
+
+	cb := w.countBucket(now)
+	cb.total++
+	if statusCode == http.StatusGatewayTimeout || statusCode == http.StatusBadGateway {
+		cb.netErrors++
+	}
+	code := w.budget.statusCode(statusCode)
+	cb.codes[code]++
+	if w.file != nil {
+		w.file.record(cb, code)
+	}
+
+	// like memmetrics, latencies outside of the histogram's range are dropped
+	switch {
+	case latency == noLatency:
+	case w.sparse != nil:
+		w.sparse.record(now, latency)
+	default:
+		_ = w.histBucket(now).hist.RecordLatencies(latency, 1)
+	}
+}
+
+// seedLatencies adds latencies to the window's histograms at the
+// current time without counting them as requests.
+func (w *window) seedLatencies(latencies []time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.elapsed()
+	for _, l := range latencies {
+		switch {
+		case w.log != nil:
+			return // latencies are only kept with the requests
+		case w.fixed != nil:
+			w.fixed.record(now, l)
+		case w.sparse != nil:
+			w.sparse.record(now, l)
+		default:
+			_ = w.histBucket(now).hist.RecordLatencies(l, 1)
+		}
+	}
+}
+
+// countBucket returns the counter bucket for the current time,
+// clearing it first if it still holds an expired slot.
+func (w *window) countBucket(now time.Duration) *countBucket {
+	slot := int64(now / windowCountResolution)
+	b := &w.counts[slot%int64(len(w.counts))]
+	if b.slot != slot {
+		*b = countBucket{slot: slot, codes: make(map[int]int64)}
+	}
+	return b
+}
+
+func (w *window) histBucket(now time.Duration) *histBucket {
+	slot := int64(now / windowHistResolution)
+	b := &w.hists[slot%int64(len(w.hists))]
+	if b.slot != slot {
+		b.slot = slot
+		b.hist.Reset()
+	}
+	return b
+}
+
+// liveCounts calls f for every counter bucket within the window
+// as of now. w.mu must be held.
+func (w *window) liveCounts(now time.Duration, f func(*countBucket)) {
+	cur := int64(now / windowCountResolution)
+	for i := range w.counts {
+		b := &w.counts[i]
+		if b.slot <= cur && b.slot > cur-int64(len(w.counts)) {
+			f(b)
+		}
+	}
+}
+
+// totalCount returns the number of requests in the window.
+func (w *window) totalCount() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.log != nil {
+		total, _, _ := w.log.counts(w.elapsed())
+		return total
+	}
+	var total int64
+	w.liveCounts(w.elapsed(), func(b *countBucket) { total += b.total })
+	return total
+}
+
+// windowCounts returns the request counts of the window, without status
+// codes the wire encoding of a SharedState can't carry.
+func (w *window) windowCounts() *WindowCounts {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	c := &WindowCounts{StatusCodes: make(map[int]int64)}
+	if w.log != nil {
+		c.Requests, c.NetworkErrors, c.StatusCodes = w.log.counts(w.elapsed())
+	} else {
+		w.liveCounts(w.elapsed(), func(b *countBucket) {
+			c.Requests += b.total
+			c.NetworkErrors += b.netErrors
+			for code, n := range b.codes {
+				c.StatusCodes[code] += n
+			}
+		})
+	}
+	for code := range c.StatusCodes {
+		if code < 0 || code > 999 {
+			delete(c.StatusCodes, code)
+		}
+	}
+	return c
+}
+
+// networkErrorRatio returns the share of requests that ended in
+// 502 Bad Gateway or 504 Gateway Timeout, as memmetrics does.
+func (w *window) networkErrorRatio() float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var total, netErrors int64
+	if w.log != nil {
+		total, netErrors, _ = w.log.counts(w.elapsed())
+	} else {
+		w.liveCounts(w.elapsed(), func(b *countBucket) {
+			total += b.total
+			netErrors += b.netErrors
+		})
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(netErrors) / float64(total)
+}
+
+// responseCodeRatio returns count(startA to endA) / count(startB to endB).
+func (w *window) responseCodeRatio(startA, endA, startB, endB int) float64 {
+	return codeRatio(w.statusCodeCounts(), startA, endA, startB, endB)
+}
+
+// codeRatio returns count(startA to endA) / count(startB to endB) of
+// the given status code counts.
+func codeRatio(counts map[int]int64, startA, endA, startB, endB int) float64 {
+	var a, b int64
+	for code, n := range counts {
+		if code >= startA && code < endA {
+			a += n
+		}
+		if code >= startB && code < endB {
+			b += n
+		}
+	}
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+// statusCodeCounts returns the number of responses per status code.
+func (w *window) statusCodeCounts() map[int]int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.log != nil {
+		_, _, codes := w.log.counts(w.elapsed())
+		return codes
+	}
+	counts := make(map[int]int64)
+	w.liveCounts(w.elapsed(), func(b *countBucket) {
+		for code, n := range b.codes {
+			counts[code] += n
+		}
+	})
+	return counts
+}
+
+// latencyHistogram returns the merged latency histogram of the window.
+func (w *window) latencyHistogram() (*memmetrics.HDRHistogram, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.latencyHistogramAt(w.elapsed())
+}
+
+// latencyHistogramAt returns the merged latency histogram of the
+// window as of now. w.mu must be held.
+func (w *window) latencyHistogramAt(now time.Duration) (*memmetrics.HDRHistogram, error) {
+	if w.log != nil {
+		return w.log.latencyHistogram(now)
+	}
+	merged, err := memmetrics.NewHDRHistogram(histMin, histMax, histSigFigs)
+	if err != nil {
+		return nil, err
+	}
+	cur := int64(now / windowHistResolution)
+	for i := range w.hists {
+		b := &w.hists[i]
+		if b.slot <= cur && b.slot > cur-int64(len(w.hists)) {
+			if err := merged.Merge(b.hist); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return merged, nil
+}
+
+// latencyQuantiles returns the latencies at the given percentiles
+// over the window.
+func (w *window) latencyQuantiles(qs ...float64) ([]time.Duration, error) {
+	if w.fixed != nil {
+		return w.fixed.quantiles(w.elapsed(), qs), nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.latencyQuantilesAt(w.elapsed(), qs)
+}
+
+// latencyQuantilesAt returns the latencies at the given percentiles
+// over the window as of now. w.mu must be held, unless the window
+// has a fixed histogram, which is read atomically.
+func (w *window) latencyQuantilesAt(now time.Duration, qs []float64) ([]time.Duration, error) {
+	switch {
+	case w.fixed != nil:
+		return w.fixed.quantiles(now, qs), nil
+	case w.sparse != nil:
+		return w.sparse.quantiles(now, qs), nil
+	}
+	hist, err := w.latencyHistogramAt(now)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]time.Duration, len(qs))
+	for i, q := range qs {
+		out[i] = hist.LatencyAtQuantile(q)
+	}
+	return out, nil
+}
+
+// latencyQuantile returns the latency at percentile q over the window.
+func (w *window) latencyQuantile(q float64) (time.Duration, error) {
+	l, err := w.latencyQuantiles(q)
+	if err != nil {
+		return 0, err
+	}
+	return l[0], nil
+}
+
+// windowStats summarizes the contents of a window.
+type windowStats struct {
+	Requests          int64            `json:"requests"`
+	NetworkErrorRatio float64          `json:"network_error_ratio"`
+	StatusCodes       map[int]int64    `json:"status_codes"`
+	Latency           map[string]int64 `json:"latency_us,omitempty"` // by quantile, in microseconds
+}
+
+// windowStatsQuantiles are the latency quantiles reported in windowStats.
+var windowStatsQuantiles = []float64{50, 90, 95, 99, 99.9, 100}
+
+func (w *window) stats() windowStats {
+	qs := windowStatsQuantiles
+	if len(w.quantiles) > 0 {
+		qs = w.quantiles
+	}
+	snap, err := w.Snapshot(qs...)
+	stats := windowStats{
+		Requests:          snap.Requests,
+		NetworkErrorRatio: snap.NetworkErrorRatio,
+		StatusCodes:       snap.StatusCodes,
+	}
+	if err == nil {
+		stats.Latency = make(map[string]int64, len(qs))
+		for i, q := range qs {
+			stats.Latency["p"+strconv.FormatFloat(q, 'f', -1, 64)] = int64(snap.Latencies[i] / time.Microsecond)
+		}
+	}
+	return stats
+}
+
+// full reports whether the window has been collecting samples for
+// at least its whole duration since it was created or last reset.
+func (w *window) full() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.elapsed()-w.since >= windowCountBuckets*windowCountResolution
+}
+
+// reset empties the window.
+func (w *window) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.since = w.elapsed()
+	if w.log != nil {
+		w.log.reset()
+	}
+	for i := range w.counts {
+		w.counts[i] = countBucket{slot: -1}
+	}
+	if w.file != nil {
+		w.file.clear()
+	}
+	for i := range w.hists {
+		w.hists[i].slot = -1
+		w.hists[i].hist.Reset()
+	}
+	if w.sparse != nil {
+		w.sparse.reset()
+	}
+	if w.fixed != nil {
+		w.fixed.reset()
+	}
+}
+
+// same layout and histogram range as memmetrics' defaults
+const (
+	windowCountBuckets    = 10
+	windowCountResolution = time.Second
+	windowHistBuckets     = 6
+	windowHistResolution  = 10 * time.Second
+
+	histMin     = 1
+	histMax     = 3600000000 // 1 hour in microseconds
+	histSigFigs = 2
+
+	// noLatency is recorded for a request whose latency is discarded,
+	// so that only the request is counted.
+	noLatency time.Duration = -1
+)
@@ -0,0 +1,272 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// windowFile mirrors the counter buckets of a window in a small
+// memory-mapped file, so that a breaker restarted after a crash can
+// restore the recent history of its window instead of starting
+// blind. Every record writes the new counts of its bucket to the
+// mapping; the kernel writes them back to the file, also when the
+// process dies. This is best-effort: a crash of the host may lose
+// or tear the latest writes. Latency histograms are not persisted.
+//
+// The file starts with a header of windowFileHeader words, followed
+// by windowCountBuckets buckets of windowFileBucket words: the wall
+// clock time the bucket starts at in Unix nanoseconds (0 if it is
+// empty), the total, the network errors, the number of status codes,
+// and that many pairs of status code and count. All words are
+// little-endian int64s.
+type windowFile struct {
+	f    *os.File
+	path string // absolute, the key in windowFiles
+	data []byte
+	base time.Time // the wall clock time at elapsed() == 0
+}
+
+// windowFiles holds the windows backed by a window file in this
+// process by the absolute path of the file, with the name of their
+// breaker, so that two breakers never write into the same file.
+// During a config reload, the new breaker of a name takes the file
+// over from the old one, which stops mirroring its window.
+var windowFiles = struct {
+	sync.Mutex
+	m map[string]windowFileUser
+}{m: make(map[string]windowFileUser)}
+
+type windowFileUser struct {
+	name string
+	w    *window
+}
+
+const (
+	windowFileMagic   = 0x63627769_6e646f77 // "cbwindow"
+	windowFileVersion = 1
+	windowFileCodes   = 32 // status codes per bucket; more are not persisted
+	windowFileHeader  = 4  // magic, version, buckets, resolution
+	windowFileBucket  = 4 + 2*windowFileCodes
+	windowFileSize    = 8 * (windowFileHeader + windowCountBuckets*windowFileBucket)
+)
+
+// openWindowFile opens, and creates if needed, the window file at
+// path and maps it into memory. A file with another layout, such as
+// from another version, is started over.
+func openWindowFile(path string, base time.Time) (*windowFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(windowFileSize); err != nil {
+		f.Close()
+		return nil, err
+	}
+	data, err := mapFile(f, windowFileSize)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	wf := &windowFile{f: f, data: data, base: base}
+	if wf.word(0) != windowFileMagic || wf.word(1) != windowFileVersion ||
+		wf.word(2) != windowCountBuckets || wf.word(3) != int64(windowCountResolution) {
+		for i := range data {
+			data[i] = 0
+		}
+		wf.setWord(0, windowFileMagic)
+		wf.setWord(1, windowFileVersion)
+		wf.setWord(2, windowCountBuckets)
+		wf.setWord(3, int64(windowCountResolution))
+	}
+	return wf, nil
+}
+
+func (wf *windowFile) word(i int) int64 {
+	return int64(binary.LittleEndian.Uint64(wf.data[8*i:]))
+}
+
+func (wf *windowFile) setWord(i int, v int64) {
+	binary.LittleEndian.PutUint64(wf.data[8*i:], uint64(v))
+}
+
+// bucketWord returns the index of word j of bucket i.
+func bucketWord(i, j int) int {
+	return windowFileHeader + i*windowFileBucket + j
+}
+
+// bucketIndex returns the index of the bucket of slot, which may be
+// negative for restored buckets.
+func bucketIndex(slot int64) int {
+	return int((slot%windowCountBuckets + windowCountBuckets) % windowCountBuckets)
+}
+
+// wall returns the wall clock time the given slot starts at.
+func (wf *windowFile) wall(slot int64) int64 {
+	return wf.base.Add(time.Duration(slot) * windowCountResolution).UnixNano()
+}
+
+// record writes the counts of b, which now has code counted, to the
+// file. The caller must hold the window's lock.
+func (wf *windowFile) record(b *countBucket, code int) {
+	i := bucketIndex(b.slot)
+	if start := wf.wall(b.slot); wf.word(bucketWord(i, 0)) != start {
+		wf.setWord(bucketWord(i, 3), 0)
+		wf.setWord(bucketWord(i, 0), start)
+	}
+	wf.setWord(bucketWord(i, 1), b.total)
+	wf.setWord(bucketWord(i, 2), b.netErrors)
+	n := int(wf.word(bucketWord(i, 3)))
+	for j := 0; j < n; j++ {
+		if wf.word(bucketWord(i, 4+2*j)) == int64(code) {
+			wf.setWord(bucketWord(i, 5+2*j), b.codes[code])
+			return
+		}
+	}
+	if n < windowFileCodes {
+		wf.setWord(bucketWord(i, 4+2*n), int64(code))
+		wf.setWord(bucketWord(i, 5+2*n), b.codes[code])
+		wf.setWord(bucketWord(i, 3), int64(n+1))
+	}
+}
+
+// restore loads the buckets of the file that are still within the
+// window as of now into w, and returns the age of the oldest one,
+// or 0 if there is none. The caller must hold the window's lock.
+func (wf *windowFile) restore(w *window, now time.Duration) time.Duration {
+	cur := int64(now / windowCountResolution)
+	var oldest time.Duration
+	for i := 0; i < windowCountBuckets; i++ {
+		start := wf.word(bucketWord(i, 0))
+		n := int(wf.word(bucketWord(i, 3)))
+		if start == 0 || n < 0 || n > windowFileCodes {
+			continue
+		}
+		// the slot its start falls in on this process's clock,
+		// negative for the time before the process started
+		offset := time.Unix(0, start).Sub(wf.base)
+		slot := int64(offset / windowCountResolution)
+		if offset < 0 && offset%windowCountResolution != 0 {
+			slot--
+		}
+		if slot > cur || slot <= cur-windowCountBuckets {
+			continue
+		}
+		b := countBucket{
+			slot:      slot,
+			total:     wf.word(bucketWord(i, 1)),
+			netErrors: wf.word(bucketWord(i, 2)),
+			codes:     make(map[int]int64, n),
+		}
+		for j := 0; j < n; j++ {
+			b.codes[int(wf.word(bucketWord(i, 4+2*j)))] = wf.word(bucketWord(i, 5+2*j))
+		}
+		w.counts[bucketIndex(slot)] = b
+		if age := now - time.Duration(slot)*windowCountResolution; age > oldest {
+			oldest = age
+		}
+	}
+	return oldest
+}
+
+// clear empties all buckets of the file.
+func (wf *windowFile) clear() {
+	for i := 0; i < windowCountBuckets; i++ {
+		wf.setWord(bucketWord(i, 0), 0)
+		wf.setWord(bucketWord(i, 3), 0)
+	}
+}
+
+func (wf *windowFile) close() error {
+	err := unmapFile(wf.data)
+	if cerr := wf.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// attachFile backs the counter buckets of w, the window of the breaker
+// called name, with the window file at path, restoring the buckets
+// still within the window from it. It fails if the file is in use by
+// a breaker of another name.
+func (w *window) attachFile(path, name string) error {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("opening window file: %v", err)
+	}
+	windowFiles.Lock()
+	defer windowFiles.Unlock()
+	if u, ok := windowFiles.m[key]; ok && u.w != w {
+		if u.name != name {
+			return fmt.Errorf("window file %s is already used by circuit breaker %q", path, u.name)
+		}
+		if err := u.w.releaseFile(); err != nil {
+			return fmt.Errorf("closing window file of the previous circuit breaker: %v", err)
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.elapsed()
+	wf, err := openWindowFile(path, time.Now().Add(-now))
+	if err != nil {
+		return fmt.Errorf("opening window file: %v", err)
+	}
+	wf.path = key
+	if oldest := wf.restore(w, now); oldest > 0 {
+		w.since = now - oldest
+	}
+	// buckets restored into a slot of another bucket of the file
+	// are rewritten there on their next record; start over with
+	// what was restored
+	wf.clear()
+	for i := range w.counts {
+		b := &w.counts[i]
+		for code := range b.codes {
+			wf.record(b, code)
+		}
+	}
+	w.file = wf
+	windowFiles.m[key] = windowFileUser{name: name, w: w}
+	return nil
+}
+
+// closeFile stops backing w with its window file.
+func (w *window) closeFile() error {
+	windowFiles.Lock()
+	defer windowFiles.Unlock()
+	return w.releaseFile()
+}
+
+// releaseFile closes the window file of w, if any, and gives up its
+// entry in windowFiles, which must be locked.
+func (w *window) releaseFile() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	if windowFiles.m[w.file.path].w == w {
+		delete(windowFiles.m, w.file.path)
+	}
+	err := w.file.close()
+	w.file = nil
+	return err
+}
@@ -0,0 +1,33 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package circuitbreaker
+
+import (
+	"fmt"
+	"os"
+)
+
+// mapFile is not supported on this platform, so neither is the
+// window file.
+func mapFile(f *os.File, size int) ([]byte, error) {
+	return nil, fmt.Errorf("window_file is not supported on this platform")
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
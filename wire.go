@@ -0,0 +1,249 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// WindowCounts are the request counts of a sliding window, as
+// exchanged between instances along with the state of a circuit.
+type WindowCounts struct {
+	// The number of requests in the window.
+	Requests int64 `json:"requests"`
+	// How many of them ended in 502 or 504.
+	NetworkErrors int64 `json:"network_errors"`
+	// The number of responses per status code.
+	StatusCodes map[int]int64 `json:"status_codes,omitempty"`
+}
+
+// The binary encoding of a SharedState is, in order:
+//
+//	magic        2 bytes, "cb"
+//	version      1 byte, wireVersion
+//	flags        1 byte, wireFlag*
+//	until        varint, Unix nanoseconds; only with wireFlagUntil
+//	reason       uvarint length, then bytes
+//	origin       uvarint length, then bytes
+//	counts       only with wireFlagCounts: uvarint requests, uvarint
+//	             network errors, uvarint number of status codes,
+//	             then uvarint code and uvarint count for each, by code
+//
+// The version of the state is assigned by the storage and therefore
+// not encoded. Decoders reject unknown versions and flags, so a new
+// field needs a new flag or version.
+const (
+	wireVersion = 1
+
+	wireFlagOpen   = 1 << 0
+	wireFlagUntil  = 1 << 1
+	wireFlagCounts = 1 << 2
+	wireFlagsKnown = wireFlagOpen | wireFlagUntil | wireFlagCounts
+
+	// bounds that keep a malformed message from allocating much
+	wireMaxString      = 1 << 12
+	wireMaxStatusCodes = 1 << 10
+)
+
+var wireMagic = [2]byte{'c', 'b'}
+
+// MarshalBinary encodes the state, except for its version, in the
+// compact binary format used to share state between instances.
+func (s SharedState) MarshalBinary() ([]byte, error) {
+	if len(s.Reason) > wireMaxString || len(s.Origin) > wireMaxString {
+		return nil, fmt.Errorf("%w: reason or origin longer than %d bytes", ErrMalformedState, wireMaxString)
+	}
+	var flags byte
+	if s.Open {
+		flags |= wireFlagOpen
+	}
+	if !s.Until.IsZero() {
+		flags |= wireFlagUntil
+	}
+	if s.Counts != nil {
+		if len(s.Counts.StatusCodes) > wireMaxStatusCodes {
+			return nil, fmt.Errorf("%w: more than %d status codes", ErrMalformedState, wireMaxStatusCodes)
+		}
+		flags |= wireFlagCounts
+	}
+
+	b := make([]byte, 0, 32+len(s.Reason)+len(s.Origin))
+	b = append(b, wireMagic[0], wireMagic[1], wireVersion, flags)
+	if flags&wireFlagUntil != 0 {
+		b = appendVarint(b, s.Until.UnixNano())
+	}
+	b = appendString(b, s.Reason)
+	b = appendString(b, s.Origin)
+	if c := s.Counts; c != nil {
+		b = appendUvarint(b, uint64(c.Requests))
+		b = appendUvarint(b, uint64(c.NetworkErrors))
+		codes := make([]int, 0, len(c.StatusCodes))
+		for code := range c.StatusCodes {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		b = appendUvarint(b, uint64(len(codes)))
+		for _, code := range codes {
+			b = appendUvarint(b, uint64(code))
+			b = appendUvarint(b, uint64(c.StatusCodes[code]))
+		}
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes a state encoded by MarshalBinary. Its
+// version is left at 0. Errors wrap ErrMalformedState.
+func (s *SharedState) UnmarshalBinary(data []byte) error {
+	d := wireDecoder{b: data}
+	if len(data) < 4 || data[0] != wireMagic[0] || data[1] != wireMagic[1] {
+		return fmt.Errorf("%w: not a circuit breaker state", ErrMalformedState)
+	}
+	if data[2] != wireVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrMalformedState, data[2])
+	}
+	flags := data[3]
+	if flags&^wireFlagsKnown != 0 {
+		return fmt.Errorf("%w: unknown flags %#x", ErrMalformedState, flags)
+	}
+	d.b = data[4:]
+
+	state := SharedState{Open: flags&wireFlagOpen != 0}
+	if flags&wireFlagUntil != 0 {
+		state.Until = time.Unix(0, d.varint())
+	}
+	state.Reason = d.string()
+	state.Origin = d.string()
+	if flags&wireFlagCounts != 0 {
+		c := &WindowCounts{
+			Requests:      d.count(),
+			NetworkErrors: d.count(),
+		}
+		n := d.uvarint()
+		if n > wireMaxStatusCodes {
+			d.fail("too many status codes")
+		}
+		if n > 0 && d.err == nil {
+			c.StatusCodes = make(map[int]int64, n)
+			for i := uint64(0); i < n && d.err == nil; i++ {
+				code := d.uvarint()
+				if code > 999 {
+					d.fail("invalid status code")
+				}
+				c.StatusCodes[int(code)] = d.count()
+			}
+		}
+		state.Counts = c
+	}
+	if d.err == nil && len(d.b) > 0 {
+		d.fail("trailing bytes")
+	}
+	if d.err != nil {
+		return d.err
+	}
+	*s = state
+	return nil
+}
+
+// decodeSharedState decodes a state stored by a storage backend: the
+// binary format, or JSON as stored by earlier versions.
+func decodeSharedState(data []byte) (SharedState, error) {
+	var state SharedState
+	if len(data) > 0 && data[0] == '{' {
+		err := json.Unmarshal(data, &state)
+		return state, err
+	}
+	err := state.UnmarshalBinary(data)
+	return state, err
+}
+
+// wireDecoder reads the fields of a binary state, remembering the
+// first error so that fields can be read without checking each one.
+type wireDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *wireDecoder) fail(msg string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrMalformedState, msg)
+	}
+	d.b = nil
+}
+
+func (d *wireDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.fail("truncated or overlong integer")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *wireDecoder) varint() int64 {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.fail("truncated or overlong integer")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// count reads a non-negative count.
+func (d *wireDecoder) count() int64 {
+	v := d.uvarint()
+	if v > 1<<63-1 {
+		d.fail("count out of range")
+		return 0
+	}
+	return int64(v)
+}
+
+func (d *wireDecoder) string() string {
+	n := d.uvarint()
+	if n > wireMaxString || n > uint64(len(d.b)) {
+		d.fail("invalid string length")
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUvarint(b, uint64(len(s))), s...)
+}
+
+// Interface guards
+var (
+	_ encoding.BinaryMarshaler   = SharedState{}
+	_ encoding.BinaryUnmarshaler = (*SharedState)(nil)
+)
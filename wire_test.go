@@ -0,0 +1,60 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package circuitbreaker
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func FuzzSharedStateUnmarshalBinary(f *testing.F) {
+	for _, s := range []SharedState{
+		{},
+		{Open: true, Until: time.Unix(0, 1600000000000000000), Reason: "error ratio 0.6 exceeded threshold 0.5", Origin: "a"},
+		{Reason: "reset", Counts: &WindowCounts{Requests: 120, NetworkErrors: 7, StatusCodes: map[int]int64{200: 100, 502: 5, 504: 2, 503: 13}}},
+		{Open: true, Counts: &WindowCounts{}},
+	} {
+		b, err := s.MarshalBinary()
+		if err != nil {
+			f.Fatalf("marshaling %+v: %v", s, err)
+		}
+		f.Add(b)
+	}
+	f.Add([]byte("cb"))
+	f.Add([]byte("{}"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var s SharedState
+		if err := s.UnmarshalBinary(data); err != nil {
+			if !errors.Is(err, ErrMalformedState) {
+				t.Fatalf("error %v doesn't wrap ErrMalformedState", err)
+			}
+			return
+		}
+		b, err := s.MarshalBinary()
+		if err != nil {
+			t.Fatalf("re-marshaling decoded state %+v: %v", s, err)
+		}
+		var again SharedState
+		if err := again.UnmarshalBinary(b); err != nil {
+			t.Fatalf("decoding re-marshaled state %+v: %v", s, err)
+		}
+		if !reflect.DeepEqual(again, s) {
+			t.Fatalf("round trip changed state: got %+v, want %+v", again, s)
+		}
+	})
+}